@@ -1,19 +1,33 @@
 import { TestBed } from '@angular/core/testing';
-import { HttpClientModule } from '@angular/common/http'; // Import HttpClientModule
+import { HttpClientTestingModule, HttpTestingController } from '@angular/common/http/testing';
 import { UserService } from './user.service';
 
 describe('UserService', () => {
   let service: UserService;
+  let httpMock: HttpTestingController;
 
   beforeEach(() => {
     TestBed.configureTestingModule({
-      imports: [HttpClientModule], // Ensure HttpClientModule is imported here
+      imports: [HttpClientTestingModule],
       providers: [UserService] // Optional, can be omitted if using inject directly
     });
     service = TestBed.inject(UserService);
+    httpMock = TestBed.inject(HttpTestingController);
+  });
+
+  afterEach(() => {
+    httpMock.verify();
   });
 
   it('should be created', () => {
     expect(service).toBeTruthy();
   });
+
+  it('should send the version it read as If-Match on writes', () => {
+    service.putUser(1, { user_name: 'jdoe' }, 3).subscribe();
+    service.deleteUser(2, 5).subscribe();
+
+    expect(httpMock.expectOne({ method: 'PUT', url: 'http://localhost:8080/users/1' }).request.headers.get('If-Match')).toBe('"3"');
+    expect(httpMock.expectOne({ method: 'DELETE', url: 'http://localhost:8080/users/2' }).request.headers.get('If-Match')).toBe('"5"');
+  });
 });
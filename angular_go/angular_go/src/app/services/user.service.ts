@@ -1,5 +1,5 @@
 import { Injectable } from '@angular/core';
-import { HttpClient } from '@angular/common/http';
+import { HttpClient, HttpHeaders } from '@angular/common/http';
 import { Observable } from 'rxjs';
 
 @Injectable({
@@ -20,19 +20,24 @@ export class UserService {
     return this.http.post(this.apiUrl, userData);
   }
 
-  // Update a user (PUT)
-  putUser(userId: number, userData: any): Observable<any> {
-    return this.http.put(`${this.apiUrl}/${userId}`, userData);
+  // Update a user (PUT), failing with 412 if it changed since version was read
+  putUser(userId: number, userData: any, version: number): Observable<any> {
+    return this.http.put(`${this.apiUrl}/${userId}`, userData, { headers: this.ifMatch(version) });
   }
 
-  // Partially update a user (PATCH)
-  patchUser(userId: number, partialData: any): Observable<any> {
-    return this.http.patch(`${this.apiUrl}/${userId}`, partialData);
+  // Partially update a user (PATCH), failing with 412 if it changed since version was read
+  patchUser(userId: number, partialData: any, version: number): Observable<any> {
+    return this.http.patch(`${this.apiUrl}/${userId}`, partialData, { headers: this.ifMatch(version) });
   }
 
-  // Delete a user (DELETE)
-  deleteUser(userId: number): Observable<any> {
+  // Delete a user (DELETE), failing with 412 if it changed since version was read
+  deleteUser(userId: number, version: number): Observable<any> {
     console.log("deleting the user ", userId);
-    return this.http.delete(`${this.apiUrl}/${userId}`);
+    return this.http.delete(`${this.apiUrl}/${userId}`, { headers: this.ifMatch(version) });
+  }
+
+  // The server refuses writes without a version (428), so every write names the one it read
+  private ifMatch(version: number): HttpHeaders {
+    return new HttpHeaders({ 'If-Match': `"${version}"` });
   }
 }
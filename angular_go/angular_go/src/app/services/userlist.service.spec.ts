@@ -1,5 +1,5 @@
 import { TestBed } from '@angular/core/testing';
-import { HttpClientTestingModule } from '@angular/common/http/testing'; // Import HttpClientTestingModule
+import { HttpClientTestingModule, HttpTestingController } from '@angular/common/http/testing'; // Import HttpClientTestingModule
 import { UserListService } from './userlist.service';
 
 describe('UserListService', () => {
@@ -15,4 +15,15 @@ describe('UserListService', () => {
   it('should be created', () => {
     expect(service).toBeTruthy();
   });
+
+  it('should request one page of users, sorted when asked', () => {
+    const http = TestBed.inject(HttpTestingController);
+    service.getUsers({ page: 2, size: 10, sort: 'email', order: 'desc' }).subscribe(page => {
+      expect(page.total).toBe(11);
+    });
+
+    const req = http.expectOne('http://localhost:8080/users?page=2&size=10&sort=email&order=desc');
+    req.flush({ users: [], total: 11, page: 2, size: 10 });
+    http.verify();
+  });
 });
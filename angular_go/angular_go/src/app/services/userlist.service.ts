@@ -1,6 +1,24 @@
 import { Injectable } from '@angular/core';
 import { HttpClient } from '@angular/common/http';
 import { Observable } from 'rxjs';
+import { User } from '../userlist/userlist.component';
+
+// One page of GET /users; page is 1-based and total counts every matching user
+export interface UserPage {
+  users: User[];
+  total: number;
+  page: number;
+  size: number;
+  next?: string;
+}
+
+// Paging and ordering of a user listing; sort is a column name, order is asc or desc
+export interface UserListQuery {
+  page: number;
+  size: number;
+  sort?: string;
+  order?: string;
+}
 
 @Injectable({
   providedIn: 'root',
@@ -10,8 +28,23 @@ export class UserListService {
 
   constructor(private http: HttpClient) {}
 
-  getUsers(): Observable<any> {
-    return this.http.get(this.apiUrl);
+  getUsers(query: UserListQuery): Observable<UserPage> {
+    const params: Record<string, string | number> = { page: query.page, size: query.size };
+    if (query.sort && query.order) {
+      params['sort'] = query.sort;
+      params['order'] = query.order;
+    }
+    return this.http.get<UserPage>(this.apiUrl, { params });
+  }
+
+  // Ranked full-text and fuzzy search; each result carries the user and its highlights
+  searchUsers(query: string): Observable<any> {
+    return this.http.get(`${this.apiUrl}/search`, { params: { q: query } });
+  }
+
+  // URL that downloads every user as csv, ndjson or xlsx
+  exportUrl(format: string): string {
+    return `${this.apiUrl}/export?format=${format}`;
   }
 }
 
@@ -26,7 +26,8 @@ describe('UserComponent', () => {
       last_name: 'User',
       email: 'test@example.com',
       user_status: 'active',
-      department: 'IT'
+      department: 'IT',
+      version: 2
     })),
     putUser: jasmine.createSpy('putUser').and.returnValue(of({})),
     postUser: jasmine.createSpy('postUser').and.returnValue(of({}))
@@ -1,5 +1,6 @@
 import { Component } from '@angular/core';
 import { FormControl, Validators, FormGroup } from '@angular/forms';
+import { HttpErrorResponse } from '@angular/common/http';
 import { OnInit } from '@angular/core';
 import { ActivatedRoute, Router } from '@angular/router';
 import { UserService } from '../services/user.service';
@@ -64,11 +65,11 @@ export class UserComponent implements OnInit {
       if (this.isEditMode) {
         // Update existing user
         console.log("Calling user service put with user_id:", formData.user_id);
-        this.service.putUser(formData.user_id, formData).subscribe(response => {
+        this.service.putUser(formData.user_id, formData, this.data.version).subscribe(response => {
           this.data = response;
           this.userForm.patchValue(this.data);  // Assuming the response contains updated data
           this.router.navigate(['/userlist']);
-        });
+        }, err => this.applyServerErrors(err));
       } else {
         // Add new user
         console.log("Calling user service post for new user");
@@ -78,10 +79,29 @@ export class UserComponent implements OnInit {
           this.data = response;
           this.userForm.patchValue(this.data);  // Assuming the response contains new user data
           this.router.navigate(['/userlist']);
-        });
+        }, err => this.applyServerErrors(err));
       }
     } else {
       console.log('Form is invalid');
     }
   }
+
+  // Show the field errors of a 422 response, or the taken field of a 409, next to the matching inputs
+  private applyServerErrors(err: HttpErrorResponse): void {
+    if (err.status === 409 && err.error?.field) {
+      const control = this.userForm.get(err.error.field);
+      control?.setErrors({ server: 'is already taken' });
+      control?.markAsTouched();
+      return;
+    }
+    if (err.status !== 422 || !err.error?.fields) {
+      console.log('Saving user failed', err);
+      return;
+    }
+    for (const fieldError of err.error.fields) {
+      const control = this.userForm.get(fieldError.field);
+      control?.setErrors({ server: fieldError.message });
+      control?.markAsTouched();
+    }
+  }
 }
@@ -1,6 +1,6 @@
 import { ComponentFixture, TestBed, fakeAsync, tick } from '@angular/core/testing';
 import { UserlistComponent, User } from './userlist.component';
-import { UserListService } from '../services/userlist.service';
+import { UserListService, UserPage } from '../services/userlist.service';
 import { UserService } from '../services/user.service';
 import { MatDialog } from '@angular/material/dialog';
 import { Router } from '@angular/router';
@@ -19,9 +19,10 @@ describe('UserlistComponent', () => {
   let mockDialog: jasmine.SpyObj<MatDialog>;
 
   const sampleUsers: User[] = [
-    { user_id: 1, user_name: 'jdoe', first_name: 'John', last_name: 'Doe', email: 'jdoe@example.com', user_status: 'A', department: 'Engineering' },
-    { user_id: 2, user_name: 'asmith', first_name: 'Alice', last_name: 'Smith', email: 'asmith@example.com', user_status: 'I', department: 'HR' }
+    { user_id: 1, user_name: 'jdoe', first_name: 'John', last_name: 'Doe', email: 'jdoe@example.com', user_status: 'A', department: 'Engineering', version: 1 },
+    { user_id: 2, user_name: 'asmith', first_name: 'Alice', last_name: 'Smith', email: 'asmith@example.com', user_status: 'I', department: 'HR', version: 3 }
   ];
+  const samplePage: UserPage = { users: sampleUsers, total: 30, page: 1, size: 25, next: '/users?page=2&size=25' };
 
   beforeEach(async () => {
     // Create spies for the services
@@ -50,7 +51,7 @@ describe('UserlistComponent', () => {
   beforeEach(() => {
     fixture = TestBed.createComponent(UserlistComponent);
     component = fixture.componentInstance;
-    mockUserListService.getUsers.and.returnValue(of(sampleUsers)); // Mock the user data
+    mockUserListService.getUsers.and.returnValue(of(samplePage)); // Mock the first page of users
     fixture.detectChanges(); // Trigger component lifecycle
   });
 
@@ -60,7 +61,20 @@ describe('UserlistComponent', () => {
 
   it('should load users on initialization', () => {
     component.ngOnInit();
+    expect(mockUserListService.getUsers).toHaveBeenCalledWith({ page: 1, size: 25, sort: '', order: '' });
     expect(component.dataSource.data).toEqual(sampleUsers);
+    expect(component.total).toBe(30);
+  });
+
+  it('should fetch the selected page from the server', () => {
+    component.onPage({ pageIndex: 1, pageSize: 10, length: 30 });
+    expect(mockUserListService.getUsers).toHaveBeenCalledWith({ page: 2, size: 10, sort: '', order: '' });
+  });
+
+  it('should sort on the server and go back to the first page', () => {
+    component.onPage({ pageIndex: 1, pageSize: 10, length: 30 });
+    component.sort.sortChange.emit({ active: 'last_name', direction: 'desc' });
+    expect(mockUserListService.getUsers).toHaveBeenCalledWith({ page: 1, size: 10, sort: 'last_name', order: 'desc' });
   });
 
   it('should navigate to edit user page', () => {
@@ -88,7 +102,7 @@ describe('UserlistComponent', () => {
 
     component.onDeleteUser(user);
     tick(); // Simulate async time passage
-    expect(mockUserService.deleteUser).toHaveBeenCalledWith(user.user_id); 
+    expect(mockUserService.deleteUser).toHaveBeenCalledWith(user.user_id, user.version);
     expect(mockUserListService.getUsers).toHaveBeenCalled(); // Check that loadUsers was called
   }));
 
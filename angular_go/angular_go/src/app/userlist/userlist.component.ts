@@ -1,9 +1,9 @@
 import { Component, AfterViewInit, ViewChild } from '@angular/core';
 import { UserListService } from '../services/userlist.service';
 import { UserService } from '../services/user.service';
-import { MatPaginator, MatPaginatorModule } from '@angular/material/paginator';
+import { MatPaginator, MatPaginatorModule, PageEvent } from '@angular/material/paginator';
 import { MatTableDataSource, MatTableModule } from '@angular/material/table';
-import { MatSort, MatSortModule } from '@angular/material/sort';
+import { MatSort, MatSortModule, Sort } from '@angular/material/sort';
 import { NgIf, NgFor } from '@angular/common';
 import { Router } from '@angular/router';
 import { MatButton } from '@angular/material/button';
@@ -65,13 +65,22 @@ export class UserlistComponent implements AfterViewInit {
   @ViewChild(MatPaginator) paginator!: MatPaginator;
   @ViewChild(MatSort) sort!: MatSort;  // Use MatSort instead of MatSortModule
 
+  // The server pages and sorts the users, so the table only ever holds the current page
+  total = 0;
+  pageIndex = 0;
+  pageSize = 25;
+  sortColumn = '';
+  sortDirection = '';
+
   ngAfterViewInit() {
-    this.dataSource.paginator = this.paginator;
-    this.dataSource.sort = this.sort;  // Correctly assign MatSort
+    this.sort.sortChange.subscribe((sort: Sort) => {
+      this.sortColumn = sort.active;
+      this.sortDirection = sort.direction;
+      this.pageIndex = 0;
+      this.loadUsers();
+    });
   }
 
-  public data: any;
-
   constructor(private listservice: UserListService, private userservice: UserService, private router: Router, private dialog: MatDialog) {
     console.log("calling userlist service");
   }
@@ -80,10 +89,33 @@ export class UserlistComponent implements AfterViewInit {
     this.loadUsers();
   }
   loadUsers() {
-    this.listservice.getUsers()
+    this.listservice.getUsers({
+      page: this.pageIndex + 1,
+      size: this.pageSize,
+      sort: this.sortColumn,
+      order: this.sortDirection,
+    })
     .subscribe(response => {
-      this.data = response;
-      this.dataSource.data = this.data;
+      this.dataSource.data = response.users;
+      this.total = response.total;
+    });
+  }
+  onPage(event: PageEvent) {
+    this.pageIndex = event.pageIndex;
+    this.pageSize = event.pageSize;
+    this.loadUsers();
+  }
+  // Shows the users matching query, best first, or every user again once it is cleared
+  onSearch(query: string) {
+    if (!query.trim()) {
+      this.loadUsers();
+      return;
+    }
+    this.listservice.searchUsers(query)
+    .subscribe(response => {
+      this.dataSource.data = response.results.map((hit: any) => hit.user);
+      this.total = this.dataSource.data.length;
+      this.pageIndex = 0;
     });
   }
   onEditUser(row: any): void {
@@ -94,10 +126,14 @@ export class UserlistComponent implements AfterViewInit {
   onAddUser() {
     this.router.navigate(['/user/new']);
   }
+
+  exportUrl(format: string): string {
+    return this.listservice.exportUrl(format);
+  }
   /*
   onDeleteUser(row: any, callback: (error?: any) => void): void {
     console.log("Deleting user with ID:", row.user_id);
-    this.userservice.deleteUser(row.user_id).subscribe(
+    this.userservice.deleteUser(row.user_id, row.version).subscribe(
       () => {
         console.log('User deleted successfully');
         callback(); // Invoke the callback without an error
@@ -118,7 +154,7 @@ export class UserlistComponent implements AfterViewInit {
     dialogRef.afterClosed().subscribe(result => {
       if (result) {
         // Proceed with deletion only if confirmed
-        this.userservice.deleteUser(row.user_id).subscribe(
+        this.userservice.deleteUser(row.user_id, row.version).subscribe(
           () => {
             console.log('User deleted successfully');
             this.loadUsers(); // Refresh the user list
@@ -155,4 +191,5 @@ export interface User {
   email: string;      // varchar(255)
   user_status: string;// varchar(1)
   department: string; // varchar(255) NULL
+  version: number;    // sent back as If-Match on writes
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// supportedSchemaVersion is the newest event envelope schema version this consumer understands.
+const supportedSchemaVersion = 1
+
+// eventEnvelope mirrors repository.EventEnvelope in go_userlist. Messages are keyed by user_id.
+type eventEnvelope struct {
+	EventID       string          `json:"event_id"`
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	Actor         string          `json:"actor,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+	Previous      json.RawMessage `json:"previous,omitempty"`
+}
+
+// decodeEnvelope parses a message value as an event envelope. It returns ok=false for values
+// that are not envelopes, such as messages produced before the envelope was introduced.
+func decodeEnvelope(value []byte) (env eventEnvelope, ok bool, err error) {
+	if err := json.Unmarshal(value, &env); err != nil || env.EventID == "" || env.SchemaVersion == 0 {
+		return env, false, nil
+	}
+	if env.SchemaVersion > supportedSchemaVersion {
+		return env, true, fmt.Errorf("unsupported event schema version %d", env.SchemaVersion)
+	}
+	return env, true, nil
+}
+
+// envelopeDocument converts an envelope into the MongoDB document stored for it.
+func envelopeDocument(m kafka.Message, env eventEnvelope) (bson.D, error) {
+	payload, err := jsonToBSON(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	doc := bson.D{
+		{Key: "key", Value: string(m.Key)},
+		{Key: "event_id", Value: env.EventID},
+		{Key: "type", Value: env.Type},
+		{Key: "schema_version", Value: env.SchemaVersion},
+		{Key: "occurred_at", Value: env.OccurredAt},
+		{Key: "actor", Value: env.Actor},
+		{Key: "correlation_id", Value: env.CorrelationID},
+		{Key: "payload", Value: payload},
+	}
+
+	if len(env.Previous) > 0 && string(env.Previous) != "null" {
+		previous, err := jsonToBSON(env.Previous)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous payload: %w", err)
+		}
+		doc = append(doc, bson.E{Key: "previous", Value: previous})
+	}
+
+	return append(doc, bson.E{Key: "timestamp", Value: time.Now()}), nil
+}
+
+// jsonToBSON converts a JSON object into a BSON document.
+func jsonToBSON(raw json.RawMessage) (bson.D, error) {
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON(raw, false, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/segmentio/kafka-go"
@@ -34,6 +36,11 @@ func main() {
 	go consumer(brokerAddress, "prism-user-create", client)
 	go consumer(brokerAddress, "prism-user-delete", client)
 	go consumer(brokerAddress, "prism-user-update", client)
+	go consumer(brokerAddress, "prism-user-restore", client)
+	go consumer(brokerAddress, "prism-user-purge", client)
+	go consumer(brokerAddress, "prism-department-create", client)
+	go consumer(brokerAddress, "prism-department-update", client)
+	go consumer(brokerAddress, "prism-department-delete", client)
 
 	// Allow the consumers to run for some time
 	time.Sleep(20 * time.Second)
@@ -50,9 +57,23 @@ func producer(brokerAddress, topic string) {
 	defer writer.Close()
 
 	for i := 0; i < 5; i++ {
+		userID := i + 1
+		payload, _ := json.Marshal(map[string]interface{}{
+			"user_id":   userID,
+			"user_name": fmt.Sprintf("test%02d", userID),
+		})
+		value, _ := json.Marshal(eventEnvelope{
+			EventID:       fmt.Sprintf("test-%s-%d-%d", topic, userID, time.Now().UnixNano()),
+			Type:          "test." + topic,
+			SchemaVersion: supportedSchemaVersion,
+			OccurredAt:    time.Now().UTC(),
+			Actor:         "go_mongo_kafka",
+			Payload:       payload,
+		})
+
 		msg := kafka.Message{
-			Key:   []byte(fmt.Sprintf("Key-%d", i)),
-			Value: []byte(fmt.Sprintf("This is message number %d", i)),
+			Key:   []byte(strconv.Itoa(userID)),
+			Value: value,
 		}
 
 		err := writer.WriteMessages(context.Background(), msg)
@@ -81,6 +102,11 @@ func consumer(brokerAddress, topic string, mongoClient *mongo.Client) {
 	// prism-user-create
 	// prism-user-delete
 	// prism-user-update
+	// prism-user-restore
+	// prism-user-purge
+	// prism-department-create
+	// prism-department-update
+	// prism-department-delete
 	var collection *mongo.Collection
 	if topic == "prism-user-update" {
 		collection = mongoClient.Database("mydb").Collection("user-update")
@@ -88,6 +114,16 @@ func consumer(brokerAddress, topic string, mongoClient *mongo.Client) {
 		collection = mongoClient.Database("mydb").Collection("user-new")
 	} else if topic == "prism-user-delete" {
 		collection = mongoClient.Database("mydb").Collection("user-delete")
+	} else if topic == "prism-user-restore" {
+		collection = mongoClient.Database("mydb").Collection("user-restore")
+	} else if topic == "prism-user-purge" {
+		collection = mongoClient.Database("mydb").Collection("user-purge")
+	} else if topic == "prism-department-create" {
+		collection = mongoClient.Database("mydb").Collection("department-new")
+	} else if topic == "prism-department-update" {
+		collection = mongoClient.Database("mydb").Collection("department-update")
+	} else if topic == "prism-department-delete" {
+		collection = mongoClient.Database("mydb").Collection("department-delete")
 	} else {
 		log.Fatalf("Unknown topic: %s", topic)
 	}
@@ -98,16 +134,39 @@ func consumer(brokerAddress, topic string, mongoClient *mongo.Client) {
 			log.Fatalf("could not read message %v", err)
 		}
 
-		// Write message to MongoDB
-		doc := bson.D{
-			{Key: "key", Value: string(m.Key)},
-			{Key: "value", Value: string(m.Value)},
-			{Key: "timestamp", Value: time.Now()},
+		env, isEnvelope, err := decodeEnvelope(m.Value)
+		if err != nil {
+			log.Printf("skipping message at offset %d of topic %s: %v", m.Offset, topic, err)
+			continue
 		}
 
-		_, err = collection.InsertOne(context.TODO(), doc)
-		if err != nil {
-			log.Fatalf("could not insert document: %v", err)
+		if !isEnvelope {
+			// Write message to MongoDB as-is
+			doc := bson.D{
+				{Key: "key", Value: string(m.Key)},
+				{Key: "value", Value: string(m.Value)},
+				{Key: "timestamp", Value: time.Now()},
+			}
+
+			_, err = collection.InsertOne(context.TODO(), doc)
+			if err != nil {
+				log.Fatalf("could not insert document: %v", err)
+			}
+		} else {
+			doc, err := envelopeDocument(m, env)
+			if err != nil {
+				log.Printf("skipping event %s of topic %s: %v", env.EventID, topic, err)
+				continue
+			}
+
+			// Events are delivered at least once; keying the document on event_id keeps redeliveries from duplicating it
+			_, err = collection.UpdateOne(context.TODO(),
+				bson.D{{Key: "event_id", Value: env.EventID}},
+				bson.D{{Key: "$setOnInsert", Value: doc}},
+				options.Update().SetUpsert(true))
+			if err != nil {
+				log.Fatalf("could not upsert document: %v", err)
+			}
 		}
 
 		fmt.Printf("Consumed message: key=%s value=%s from topic %s and saved to MongoDB\n", string(m.Key), string(m.Value), topic)
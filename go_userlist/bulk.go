@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go_userlist/repository"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBulkOperations is the most operations one bulk request may list.
+const maxBulkOperations = 1000
+
+// bulkRequest is the body of a bulk request: either a list of operations, or a filter and the
+// fields to patch on every user it matches. With atomic set either every operation succeeds or
+// none is applied; otherwise each is applied on its own.
+type bulkRequest struct {
+	Atomic     bool                   `json:"atomic"`
+	Operations []bulkOperation        `json:"operations"`
+	Filter     *bulkFilter            `json:"filter"`
+	Patch      map[string]interface{} `json:"patch"`
+}
+
+// bulkOperation is one entry of a bulk request. A create carries the new user; an update names
+// the user with user_id and carries its new fields; a patch names the user and carries the
+// changes; a delete only names the user. version, or the version of an update's user, guards
+// against changing a user that was modified since the client last saw it.
+type bulkOperation struct {
+	Op      string                 `json:"op"`
+	UserID  int                    `json:"user_id"`
+	Version int                    `json:"version"`
+	User    *repository.User       `json:"user"`
+	Changes map[string]interface{} `json:"changes"`
+}
+
+// bulkFilter selects the users of a filtered bulk patch, with the same meaning as the
+// department, user_status and name query parameters of GET /users.
+type bulkFilter struct {
+	Department string `json:"department"`
+	UserStatus string `json:"user_status"`
+	Name       string `json:"name"`
+}
+
+// bulkResult reports what happened to one operation, or to one matched user of a filtered
+// patch. status is the status the single-user request would have answered with; failures carry
+// the code and detail its problem response would, plus the offending field or fields.
+type bulkResult struct {
+	Index  int                     `json:"index"`
+	Op     string                  `json:"op"`
+	UserID int                     `json:"user_id,omitempty"`
+	Status int                     `json:"status"`
+	User   *repository.User        `json:"user,omitempty"`
+	Code   string                  `json:"code,omitempty"`
+	Detail string                  `json:"detail,omitempty"`
+	Field  string                  `json:"field,omitempty"`
+	Fields []repository.FieldError `json:"fields,omitempty"`
+}
+
+// bulkReport is the response to a bulk request: a result for every operation, in request order.
+type bulkReport struct {
+	Atomic    bool         `json:"atomic"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []bulkResult `json:"results"`
+}
+
+// record appends the result of the operation at index.
+func (r *bulkReport) record(index int, op string, result repository.BulkResult) {
+	item := bulkResult{Index: index, Op: op, UserID: result.UserID, User: result.User}
+	if result.Err == nil {
+		item.Status = http.StatusOK
+		if op == repository.BulkCreate {
+			item.Status = http.StatusCreated
+		}
+		r.Succeeded++
+		r.Results = append(r.Results, item)
+		return
+	}
+
+	p := problemFor(result.Err)
+	item.Status, item.Code, item.Detail = p.status, p.code, p.detail
+	if p.internal {
+		log.Printf("bulk operation %d failed: %v", index, result.Err)
+	}
+	var dupErr *repository.DuplicateUserError
+	var validationErr *repository.ValidationError
+	switch {
+	case errors.As(result.Err, &dupErr):
+		item.Field = dupErr.Field
+	case errors.As(result.Err, &validationErr):
+		item.Fields = validationErr.Fields
+	}
+	r.Failed++
+	r.Results = append(r.Results, item)
+}
+
+// bulkUsersHandler applies many creates, updates, patches and deletes in one request, or patches
+// every user matching a filter. Each change publishes the event its single-user request would.
+// The response is 200 with a result per operation unless the request itself is malformed.
+func (s *server) bulkUsersHandler(c *gin.Context) {
+	var req bulkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(badRequest("invalid_body", err.Error()))
+		return
+	}
+
+	ctx := c.Request.Context()
+	opts := repository.BulkOptions{Atomic: req.Atomic}
+	report := &bulkReport{Atomic: req.Atomic, Results: []bulkResult{}}
+
+	if req.Filter != nil || req.Patch != nil {
+		filter, err := req.filter()
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		results, err := s.repo.PatchMatchingUsers(ctx, filter, req.Patch, opts)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		for i, result := range results {
+			report.record(i, repository.BulkPatch, result)
+		}
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	switch {
+	case len(req.Operations) == 0:
+		c.Error(badRequest("invalid_bulk_request", "send a list of operations, or a filter and a patch"))
+		return
+	case len(req.Operations) > maxBulkOperations:
+		c.Error(badRequest("too_many_operations", fmt.Sprintf("a bulk request may list at most %d operations", maxBulkOperations)))
+		return
+	}
+
+	// Operations that are invalid on their own never reach the repository; in an atomic request
+	// they abort all the others.
+	results := make([]repository.BulkResult, len(req.Operations))
+	var ops []repository.BulkOperation
+	var indexes []int
+	invalid := false
+	for i, op := range req.Operations {
+		bulkOp, err := op.operation()
+		if err != nil {
+			results[i] = repository.BulkResult{UserID: op.UserID, Err: err}
+			invalid = true
+			continue
+		}
+		ops = append(ops, bulkOp)
+		indexes = append(indexes, i)
+	}
+
+	switch {
+	case invalid && req.Atomic:
+		for _, i := range indexes {
+			results[i] = repository.BulkResult{UserID: req.Operations[i].UserID, Err: repository.ErrBulkAborted}
+		}
+	case len(ops) > 0:
+		applied, err := s.repo.ApplyBulk(ctx, ops, opts)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		for j, i := range indexes {
+			results[i] = applied[j]
+		}
+	}
+
+	for i, result := range results {
+		report.record(i, req.Operations[i].Op, result)
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// filter returns the list options of a filtered patch. At least one filter is required, so that
+// a forgotten filter does not patch every user.
+func (r *bulkRequest) filter() (repository.ListOptions, error) {
+	switch {
+	case len(r.Operations) > 0:
+		return repository.ListOptions{}, badRequest("invalid_bulk_request", "send either operations or a filter and a patch, not both")
+	case r.Filter == nil || (r.Filter.Department == "" && r.Filter.UserStatus == "" && r.Filter.Name == ""):
+		return repository.ListOptions{}, badRequest("invalid_bulk_request", "the filter must set at least one of department, user_status and name")
+	case len(r.Patch) == 0:
+		return repository.ListOptions{}, badRequest("invalid_bulk_request", "a filter needs a patch to apply")
+	}
+	return repository.ListOptions{
+		Department: r.Filter.Department,
+		UserStatus: r.Filter.UserStatus,
+		NamePrefix: r.Filter.Name,
+	}, nil
+}
+
+// operation checks a bulk operation as its single-user request would and converts it for the
+// repository.
+func (op *bulkOperation) operation() (repository.BulkOperation, error) {
+	bulkOp := repository.BulkOperation{Op: op.Op, UserID: op.UserID, Version: op.Version}
+	switch op.Op {
+	case repository.BulkCreate, repository.BulkUpdate:
+		if op.User == nil {
+			return bulkOp, badRequest("invalid_bulk_operation", fmt.Sprintf("a %s needs a user", op.Op))
+		}
+		bulkOp.User = *op.User
+		if op.Op == repository.BulkUpdate {
+			if err := op.checkUserID(); err != nil {
+				return bulkOp, err
+			}
+			if op.User.User_id != 0 && op.User.User_id != op.UserID {
+				return bulkOp, badRequest("user_id_mismatch", fmt.Sprintf("user_id %d of the user does not match the operation", op.User.User_id))
+			}
+			if bulkOp.Version == repository.AnyVersion {
+				bulkOp.Version = op.User.Version
+			}
+		}
+		bulkOp.User.User_id = op.UserID
+		return bulkOp, repository.ValidateUser(&bulkOp.User)
+	case repository.BulkPatch:
+		if err := op.checkUserID(); err != nil {
+			return bulkOp, err
+		}
+		if len(op.Changes) == 0 {
+			return bulkOp, badRequest("invalid_bulk_operation", "a patch needs changes")
+		}
+		bulkOp.Changes = op.Changes
+		_, err := repository.PatchColumns(op.Changes)
+		return bulkOp, err
+	case repository.BulkDelete:
+		return bulkOp, op.checkUserID()
+	default:
+		return bulkOp, badRequest("invalid_bulk_operation", fmt.Sprintf("unknown op %q, expected create, update, patch or delete", op.Op))
+	}
+}
+
+// checkUserID reports an operation that does not name a user.
+func (op *bulkOperation) checkUserID() error {
+	if op.UserID < 1 {
+		return badRequest("invalid_user_id", fmt.Sprintf("a %s needs a positive user_id", op.Op))
+	}
+	return nil
+}
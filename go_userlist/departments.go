@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"go_userlist/repository"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// departmentID parses the department id in the path.
+func departmentID(c *gin.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		return 0, badRequest("invalid_department_id", "invalid department ID")
+	}
+	return id, nil
+}
+
+// listDepartmentsHandler returns every department, ordered by name.
+func (s *server) listDepartmentsHandler(c *gin.Context) {
+	departments, err := s.departments.ListDepartments(c.Request.Context())
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"departments": departments})
+}
+
+// getDepartmentHandler returns one department, tagged with its version for If-Match on later
+// writes.
+func (s *server) getDepartmentHandler(c *gin.Context) {
+	id, err := departmentID(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	department, err := s.departments.GetDepartmentByID(c.Request.Context(), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("ETag", etag(department.Version))
+	if c.GetHeader("If-None-Match") == etag(department.Version) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, department)
+}
+
+// createDepartmentHandler creates a department from its name and description.
+func (s *server) createDepartmentHandler(c *gin.Context) {
+	var department repository.Department
+	if err := c.ShouldBindJSON(&department); err != nil {
+		c.Error(badRequest("invalid_body", err.Error()))
+		return
+	}
+	if err := repository.ValidateDepartment(&department); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := s.departments.CreateDepartment(c.Request.Context(), &department); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("ETag", etag(department.Version))
+	c.JSON(http.StatusCreated, department)
+}
+
+// updateDepartmentHandler replaces the name and description of the department named by the
+// path. A rename moves the department's users along. A department_id in the body must match the
+// path.
+func (s *server) updateDepartmentHandler(c *gin.Context) {
+	id, err := departmentID(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var department repository.Department
+	if err := c.ShouldBindJSON(&department); err != nil {
+		c.Error(badRequest("invalid_body", err.Error()))
+		return
+	}
+	if department.Department_id != 0 && department.Department_id != id {
+		c.Error(badRequest("department_id_mismatch", fmt.Sprintf("department_id %d in the body does not match the path", department.Department_id)))
+		return
+	}
+	department.Department_id = id
+
+	// If-Match takes precedence over the version the client echoed back in the body
+	if department.Version, err = requiredVersion(c, department.Version); err != nil {
+		c.Error(err)
+		return
+	}
+	if err := repository.ValidateDepartment(&department); err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := s.departments.UpdateDepartment(c.Request.Context(), &department); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("ETag", etag(department.Version))
+	c.JSON(http.StatusOK, department)
+}
+
+// deleteDepartmentHandler deletes a department that no user, soft deleted or not, belongs to.
+func (s *server) deleteDepartmentHandler(c *gin.Context) {
+	id, err := departmentID(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	version, err := requiredVersion(c, repository.AnyVersion)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := s.departments.DeleteDepartmentByID(c.Request.Context(), id, version); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Department deleted successfully"})
+}
+
+// departmentUsersHandler lists the users of a department, with the paging, sorting and filters
+// of GET /users; a department parameter is ignored.
+func (s *server) departmentUsersHandler(c *gin.Context) {
+	id, err := departmentID(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	department, err := s.departments.GetDepartmentByID(c.Request.Context(), id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	opts.Department = department.Name
+	s.listUsers(c, opts)
+}
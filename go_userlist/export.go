@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go_userlist/repository"
+	"go_userlist/xlsx"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userExporter writes users to a download in one format.
+type userExporter interface {
+	write(user repository.User) error
+	// close writes anything still buffered and ends the file.
+	close() error
+}
+
+// exportFormat is a format GET /users/export can produce.
+type exportFormat struct {
+	contentType string
+	start       func(w io.Writer) (userExporter, error)
+}
+
+// exportFormats are the formats GET /users/export accepts in its format parameter, keyed by
+// name, which is also the extension of the downloaded file.
+var exportFormats = map[string]exportFormat{
+	"csv":    {contentType: csvContentType, start: startCSVExport},
+	"ndjson": {contentType: ndjsonContentType, start: startNDJSONExport},
+	"xlsx":   {contentType: xlsx.ContentType, start: startXLSXExport},
+}
+
+// exportUsersHandler streams every user matching the listing filters (department, user_status,
+// name, include_deleted, sort and order) as a csv, ndjson or xlsx download. Users are written as
+// they are read from the database. Errors before the first user are answered as problems; later
+// ones can only cut the download short and are logged.
+func (s *server) exportUsersHandler(c *gin.Context) {
+	name := c.DefaultQuery("format", "csv")
+	format, ok := exportFormats[name]
+	if !ok {
+		c.Error(badRequest("invalid_query", fmt.Sprintf("invalid format %q: must be csv, ndjson or xlsx", name)))
+		return
+	}
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var exporter userExporter
+	start := func() error {
+		c.Header("Content-Type", format.contentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="users-%s.%s"`, time.Now().UTC().Format("20060102"), name))
+		c.Status(http.StatusOK)
+		var err error
+		exporter, err = format.start(c.Writer)
+		return err
+	}
+
+	err = s.repo.ExportUsers(c.Request.Context(), opts, func(user repository.User) error {
+		if exporter == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return exporter.write(user)
+	})
+	if err == nil && exporter == nil {
+		err = start()
+	}
+	if err == nil {
+		err = exporter.close()
+	}
+	if err == nil {
+		return
+	}
+
+	if !c.Writer.Written() {
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Disposition")
+		c.Error(err)
+		return
+	}
+	log.Printf("%s %s failed after the download started (request %s): %v", c.Request.Method, c.Request.URL.Path, c.GetString(correlationIDHeader), err)
+	c.Abort()
+}
+
+// exportFields are the fields every export carries, in registry order.
+var exportFields = repository.Fields()
+
+// exportValues returns the user's values in registry order: numbers as ints, deleted_at as an
+// RFC 3339 string or nil, everything else as strings.
+func exportValues(user *repository.User) []interface{} {
+	values := make([]interface{}, len(exportFields))
+	for i, f := range exportFields {
+		switch v := f.Value(user).(type) {
+		case *time.Time:
+			if v != nil {
+				values[i] = v.UTC().Format(time.RFC3339)
+			}
+		default:
+			values[i] = v
+		}
+	}
+	return values
+}
+
+// exportHeader returns the json names of the exported fields, the header row of csv and xlsx exports.
+func exportHeader() []interface{} {
+	header := make([]interface{}, len(exportFields))
+	for i, f := range exportFields {
+		header[i] = f.JSONName
+	}
+	return header
+}
+
+// csvExporter writes a header row of json field names and one record per user.
+type csvExporter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func startCSVExport(w io.Writer) (userExporter, error) {
+	e := &csvExporter{w: csv.NewWriter(w)}
+	return e, e.writeRecord(exportHeader())
+}
+
+func (e *csvExporter) write(user repository.User) error {
+	return e.writeRecord(exportValues(&user))
+}
+
+func (e *csvExporter) writeRecord(values []interface{}) error {
+	e.record = e.record[:0]
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			e.record = append(e.record, "")
+		case int:
+			e.record = append(e.record, strconv.Itoa(v))
+		default:
+			e.record = append(e.record, csvCell(fmt.Sprint(v)))
+		}
+	}
+	return e.w.Write(e.record)
+}
+
+// csvFormulaPrefixes are the first characters that make spreadsheet applications evaluate a
+// cell as a formula.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvCell returns s as a cell spreadsheets show as text rather than evaluate: a value starting
+// like a formula gets a leading single quote, which csvValue strips again on import. Xlsx
+// exports need no such guard, since their cells are typed as strings.
+func csvCell(s string) string {
+	if s != "" && strings.IndexByte(csvFormulaPrefixes, s[0]) >= 0 {
+		return "'" + s
+	}
+	return s
+}
+
+func (e *csvExporter) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonExporter writes each user as the JSON object GET /users/:id returns, one per line.
+type ndjsonExporter struct {
+	enc *json.Encoder
+}
+
+func startNDJSONExport(w io.Writer) (userExporter, error) {
+	return &ndjsonExporter{enc: json.NewEncoder(w)}, nil
+}
+
+func (e *ndjsonExporter) write(user repository.User) error {
+	return e.enc.Encode(user)
+}
+
+func (e *ndjsonExporter) close() error {
+	return nil
+}
+
+// xlsxExporter writes a workbook with one sheet laid out like the csv export.
+type xlsxExporter struct {
+	w *xlsx.Writer
+}
+
+func startXLSXExport(w io.Writer) (userExporter, error) {
+	xw, err := xlsx.NewWriter(w, "Users")
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxExporter{w: xw}, xw.WriteRow(exportHeader()...)
+}
+
+func (e *xlsxExporter) write(user repository.User) error {
+	return e.w.WriteRow(exportValues(&user)...)
+}
+
+func (e *xlsxExporter) close() error {
+	return e.w.Close()
+}
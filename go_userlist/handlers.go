@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_userlist/jsonpatch"
+	"go_userlist/repository"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getUserHandler returns one user, tagged with its version for If-Match on later writes.
+// include_deleted=true also finds soft deleted users.
+func (s *server) getUserHandler(c *gin.Context) {
+	// Extract and convert the userId from the URL
+	idParam := c.Param("id")
+	userId, err := strconv.Atoi(idParam)
+	if err != nil {
+		c.Error(badRequest("invalid_user_id", "invalid user ID"))
+		return
+	}
+
+	includeDeleted, err := boolFromQuery(c, "include_deleted")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Fetch the user by ID
+	var user *repository.User
+	if includeDeleted {
+		user, err = s.repo.GetUserByIDIncludingDeleted(c.Request.Context(), userId)
+	} else {
+		user, err = s.repo.GetUserByID(c.Request.Context(), userId)
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Return the user details as JSON, tagged with its version for If-Match on later writes
+	c.Header("ETag", etag(user.Version))
+	if c.GetHeader("If-None-Match") == etag(user.Version) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// getAllUsersHandler retrieves one page of users from the repository and returns it in the response.
+// Query parameters: page, size, sort, order (asc|desc), department, user_status, name (prefix)
+// and include_deleted.
+// When a cursor parameter is present (empty for the first page) keyset paging is used instead.
+func (s *server) getAllUsersHandler(c *gin.Context) {
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	s.listUsers(c, opts)
+}
+
+// listUsers serves one page of the users matching opts, keyset paged when the request has a
+// cursor parameter.
+func (s *server) listUsers(c *gin.Context, opts repository.ListOptions) {
+	if cursor, ok := c.GetQuery("cursor"); ok {
+		s.listUsersAfterCursor(c, opts, cursor)
+		return
+	}
+
+	page, err := s.repo.ListUsers(c.Request.Context(), opts)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	response := gin.H{
+		"users": page.Users,
+		"total": page.Total,
+		"page":  page.Page,
+		"size":  page.Size,
+	}
+	if page.HasNext() {
+		response["next"] = pageLink(c, page.Page+1, page.Size)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// listUsersAfterCursor serves a keyset-paged listing; the response carries next_cursor while more rows remain.
+func (s *server) listUsersAfterCursor(c *gin.Context, opts repository.ListOptions, cursor string) {
+	page, err := s.repo.ListUsersAfter(c.Request.Context(), opts, cursor)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	response := gin.H{
+		"users": page.Users,
+		"size":  page.Size,
+	}
+	if page.NextCursor != "" {
+		response["next_cursor"] = page.NextCursor
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// searchUsersHandler answers GET /users/search?q=...&limit=... with the best matching users,
+// each with its rank and the character ranges of its fields that matched.
+func (s *server) searchUsersHandler(c *gin.Context) {
+	opts := repository.SearchOptions{Query: c.Query("q")}
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(l); err != nil {
+			c.Error(badRequest("invalid_query", fmt.Sprintf("invalid limit %q", l)))
+			return
+		}
+	}
+
+	hits, err := s.repo.SearchUsers(c.Request.Context(), opts)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":   opts.Query,
+		"results": hits,
+	})
+}
+
+// suggestUsersHandler answers GET /users/suggest?field=...&prefix=...&limit=... with the most
+// common values of a field that start with prefix, for typeahead inputs.
+func (s *server) suggestUsersHandler(c *gin.Context) {
+	opts := repository.SuggestOptions{Field: c.Query("field"), Prefix: c.Query("prefix")}
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(l); err != nil {
+			c.Error(badRequest("invalid_query", fmt.Sprintf("invalid limit %q", l)))
+			return
+		}
+	}
+
+	suggestions, err := s.repo.SuggestValues(c.Request.Context(), opts)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"field":       opts.Field,
+		"prefix":      opts.Prefix,
+		"suggestions": suggestions,
+	})
+}
+
+// listOptionsFromQuery builds repository.ListOptions from the request's query string.
+func listOptionsFromQuery(c *gin.Context) (repository.ListOptions, error) {
+	opts := repository.ListOptions{
+		SortBy:     c.Query("sort"),
+		SortDir:    c.Query("order"),
+		Department: c.Query("department"),
+		UserStatus: c.Query("user_status"),
+		NamePrefix: c.Query("name"),
+	}
+
+	var err error
+	if opts.IncludeDeleted, err = boolFromQuery(c, "include_deleted"); err != nil {
+		return opts, err
+	}
+	if p := c.Query("page"); p != "" {
+		if opts.Page, err = strconv.Atoi(p); err != nil {
+			return opts, badRequest("invalid_query", fmt.Sprintf("invalid page %q", p))
+		}
+	}
+	if s := c.Query("size"); s != "" {
+		if opts.Size, err = strconv.Atoi(s); err != nil {
+			return opts, badRequest("invalid_query", fmt.Sprintf("invalid size %q", s))
+		}
+	}
+	return opts, nil
+}
+
+// boolFromQuery parses the named boolean query parameter, which defaults to false.
+func boolFromQuery(c *gin.Context, name string) (bool, error) {
+	v := c.Query(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, badRequest("invalid_query", fmt.Sprintf("invalid %s %q", name, v))
+	}
+	return b, nil
+}
+
+// pageLink returns the current request URL with page and size replaced.
+func pageLink(c *gin.Context, page, size int) string {
+	query := c.Request.URL.Query()
+	query.Set("page", strconv.Itoa(page))
+	query.Set("size", strconv.Itoa(size))
+	return c.Request.URL.Path + "?" + query.Encode()
+}
+
+func (s *server) createUserHandler(c *gin.Context) {
+	var newUser repository.User
+	var rawRequestBody map[string]interface{}
+
+	// Bind the raw JSON to rawRequestBody
+	if err := c.ShouldBindJSON(&rawRequestBody); err != nil {
+		c.Error(badRequest("invalid_body", "invalid request body"))
+		return
+	}
+
+	// Handle User_id manually if it's present but is an empty string
+	if userID, ok := rawRequestBody["User_id"].(string); ok {
+		if userID == "" {
+			// Set User_id to -1 if it's an empty string
+			newUser.User_id = -1
+		} else {
+			// Try to convert the string to an int
+			userIDInt, err := strconv.Atoi(userID)
+			if err != nil {
+				// Set User_id to -1 if it is not a number
+				newUser.User_id = -1
+			} else {
+				newUser.User_id = userIDInt
+			}
+		}
+		delete(rawRequestBody, "User_id") // Remove User_id from the map to avoid double unmarshalling
+	} else {
+		// If User_id is missing, set it to -1
+		newUser.User_id = -1
+	}
+
+	// Marshal and Unmarshal the remaining fields to newUser struct
+	jsonData, err := json.Marshal(rawRequestBody)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if err := json.Unmarshal(jsonData, &newUser); err != nil {
+		c.Error(badRequest("invalid_body", err.Error()))
+		return
+	}
+
+	if err := repository.ValidateUser(&newUser); err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Create user in the database
+	err = s.repo.CreateUser(c.Request.Context(), &newUser)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Respond with the created user
+	c.IndentedJSON(http.StatusCreated, newUser)
+}
+
+// updateUserHandler replaces the user named by the path. A user_id in the body must match the
+// path. With upsert=true a missing user is created with that id and 201 is returned.
+func (s *server) updateUserHandler(c *gin.Context) {
+	userId, err := strconv.Atoi(c.Param("id"))
+	if err != nil || userId < 1 {
+		c.Error(badRequest("invalid_user_id", "invalid user ID"))
+		return
+	}
+	upsert, err := boolFromQuery(c, "upsert")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var updatedUser repository.User
+	// Bind the received JSON to updatedUser
+	if err := c.ShouldBindJSON(&updatedUser); err != nil {
+		c.Error(badRequest("invalid_body", err.Error()))
+		return
+	}
+	if updatedUser.User_id != 0 && updatedUser.User_id != userId {
+		c.Error(badRequest("user_id_mismatch", fmt.Sprintf("user_id %d in the body does not match the path", updatedUser.User_id)))
+		return
+	}
+	updatedUser.User_id = userId
+
+	// If-Match takes precedence over the version the client echoed back in the body
+	version, err := requiredVersion(c, updatedUser.Version)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	updatedUser.Version = version
+
+	if err := repository.ValidateUser(&updatedUser); err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Update the user in the database, creating it first if asked to
+	status := http.StatusOK
+	if upsert {
+		var created bool
+		created, err = s.repo.UpsertUser(c.Request.Context(), &updatedUser)
+		if created {
+			status = http.StatusCreated
+		}
+	} else {
+		err = s.repo.UpdateUser(c.Request.Context(), &updatedUser)
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("ETag", etag(updatedUser.Version))
+	c.IndentedJSON(status, updatedUser)
+}
+
+const (
+	// mergePatchContentType selects RFC 7396 JSON Merge Patch on PATCH /users/:id.
+	mergePatchContentType = "application/merge-patch+json"
+	// jsonPatchContentType selects RFC 6902 JSON Patch on PATCH /users/:id.
+	jsonPatchContentType = "application/json-patch+json"
+)
+
+// patchUserHandler applies a partial update. A plain application/json body is a flat map of
+// field to new value; merge-patch and json-patch bodies are applied to the stored user.
+func (s *server) patchUserHandler(c *gin.Context) {
+	var updates map[string]interface{}
+	idParam := c.Param("id")
+	userId, err := strconv.Atoi(idParam) // Convert the string ID to an integer
+	if err != nil {
+		c.Error(badRequest("invalid_user_id", "invalid user ID"))
+		return
+	}
+	version, err := requiredVersion(c, repository.AnyVersion)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	switch c.ContentType() {
+	case mergePatchContentType, jsonPatchContentType:
+		s.documentPatchUserHandler(c, userId, version)
+		return
+	}
+
+	// Bind the received JSON to updates map
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		c.Error(badRequest("invalid_body", err.Error()))
+		return
+	}
+
+	// Update the user in the database with only the provided fields
+	err = s.repo.PatchUser(c.Request.Context(), userId, version, updates)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
+}
+
+// documentPatchUserHandler applies a JSON Merge Patch or JSON Patch to the stored user. The user
+// is loaded, patched and written back in one transaction, so test operations act as preconditions.
+func (s *server) documentPatchUserHandler(c *gin.Context, userId, version int) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.Error(badRequest("invalid_body", "invalid request body"))
+		return
+	}
+
+	var apply func(doc interface{}) (interface{}, error)
+	if c.ContentType() == mergePatchContentType {
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			c.Error(badRequest("invalid_body", err.Error()))
+			return
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			c.Error(badRequest("invalid_patch_document", "merge patch must be a JSON object"))
+			return
+		}
+		apply = func(doc interface{}) (interface{}, error) { return jsonpatch.MergePatch(doc, patch), nil }
+	} else {
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		apply = patch.Apply
+	}
+
+	err = s.repo.ModifyUser(c.Request.Context(), userId, version, func(current repository.User) (map[string]interface{}, error) {
+		doc, err := userDocument(current)
+		if err != nil {
+			return nil, err
+		}
+		patched, err := apply(doc)
+		if err != nil {
+			return nil, err
+		}
+		patchedDoc, ok := patched.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: the patched user must be a JSON object", jsonpatch.ErrInvalidPatch)
+		}
+		return changedFields(doc, patchedDoc), nil
+	})
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
+}
+
+// userDocument returns the user as a decoded JSON object, the form patches are applied to.
+func userDocument(user repository.User) (map[string]interface{}, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// changedFields returns the members of patched that differ from doc; removed members map to nil.
+func changedFields(doc, patched map[string]interface{}) map[string]interface{} {
+	changes := map[string]interface{}{}
+	for name, value := range patched {
+		if old, ok := doc[name]; !ok || !reflect.DeepEqual(old, value) {
+			changes[name] = value
+		}
+	}
+	for name := range doc {
+		if _, ok := patched[name]; !ok {
+			changes[name] = nil
+		}
+	}
+	return changes
+}
+
+func (s *server) deleteUserHandler(c *gin.Context) {
+	// Extract and convert the userId from the URL
+	idParam := c.Param("id")
+	userId, err := strconv.Atoi(idParam)
+	if err != nil {
+		c.Error(badRequest("invalid_user_id", "invalid user ID"))
+		return
+	}
+
+	version, err := requiredVersion(c, repository.AnyVersion)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Delete the user by ID
+	err = s.repo.DeleteUserByID(c.Request.Context(), userId, version)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	// Return success response
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
+
+// restoreUserHandler undoes a soft delete and returns the restored user.
+func (s *server) restoreUserHandler(c *gin.Context) {
+	userId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Error(badRequest("invalid_user_id", "invalid user ID"))
+		return
+	}
+	version, err := ifMatchVersion(c, repository.AnyVersion)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	user, err := s.repo.RestoreUser(c.Request.Context(), userId, version)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("ETag", etag(user.Version))
+	c.JSON(http.StatusOK, user)
+}
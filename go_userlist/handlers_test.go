@@ -0,0 +1,1039 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go_userlist/repository"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeEvent is a change event as a real repository would publish it. ID is the id of the changed
+// user or department.
+type fakeEvent struct {
+	Type string
+	ID   int
+	Meta repository.EventMetadata
+}
+
+// fakeEventPublisher collects the events the fake repository records.
+type fakeEventPublisher struct {
+	events []fakeEvent
+}
+
+func (p *fakeEventPublisher) publish(ctx context.Context, eventType string, id int) {
+	p.events = append(p.events, fakeEvent{Type: eventType, ID: id, Meta: repository.EventMetadataFromContext(ctx)})
+}
+
+// fakeRepository stores users in memory, fails every call with err when it is set and publishes
+// an event for each successful change.
+type fakeRepository struct {
+	*repository.MemoryUserRepository
+	publisher *fakeEventPublisher
+	err       error
+}
+
+func (r *fakeRepository) CreateUser(ctx context.Context, user *repository.User) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.CreateUser(ctx, user); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventUserCreated, user.User_id)
+	return nil
+}
+
+func (r *fakeRepository) UpdateUser(ctx context.Context, user *repository.User) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventUserUpdated, user.User_id)
+	return nil
+}
+
+func (r *fakeRepository) UpsertUser(ctx context.Context, user *repository.User) (bool, error) {
+	if r.err != nil {
+		return false, r.err
+	}
+	created, err := r.MemoryUserRepository.UpsertUser(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	if created {
+		r.publisher.publish(ctx, repository.EventUserCreated, user.User_id)
+	} else {
+		r.publisher.publish(ctx, repository.EventUserUpdated, user.User_id)
+	}
+	return created, nil
+}
+
+func (r *fakeRepository) ImportUsers(ctx context.Context, users []repository.User, opts repository.ImportOptions) ([]error, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	rejected, err := r.MemoryUserRepository.ImportUsers(ctx, users, opts)
+	if err != nil || opts.DryRun {
+		return rejected, err
+	}
+	for i, u := range users {
+		if rejected[i] == nil {
+			r.publisher.publish(ctx, repository.EventUserCreated, u.User_id)
+		}
+	}
+	return rejected, nil
+}
+
+// bulkEvents is the event each kind of bulk operation publishes.
+var bulkEvents = map[string]string{
+	repository.BulkCreate: repository.EventUserCreated,
+	repository.BulkUpdate: repository.EventUserUpdated,
+	repository.BulkPatch:  repository.EventUserUpdated,
+	repository.BulkDelete: repository.EventUserDeleted,
+}
+
+func (r *fakeRepository) ApplyBulk(ctx context.Context, ops []repository.BulkOperation, opts repository.BulkOptions) ([]repository.BulkResult, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	results, err := r.MemoryUserRepository.ApplyBulk(ctx, ops, opts)
+	for i, result := range results {
+		if result.Err == nil {
+			r.publisher.publish(ctx, bulkEvents[ops[i].Op], result.UserID)
+		}
+	}
+	return results, err
+}
+
+func (r *fakeRepository) PatchMatchingUsers(ctx context.Context, filter repository.ListOptions, changes map[string]interface{}, opts repository.BulkOptions) ([]repository.BulkResult, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	results, err := r.MemoryUserRepository.PatchMatchingUsers(ctx, filter, changes, opts)
+	for _, result := range results {
+		if result.Err == nil {
+			r.publisher.publish(ctx, repository.EventUserUpdated, result.UserID)
+		}
+	}
+	return results, err
+}
+
+func (r *fakeRepository) GetUserByID(ctx context.Context, userID int) (*repository.User, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.GetUserByID(ctx, userID)
+}
+
+func (r *fakeRepository) GetUserByIDIncludingDeleted(ctx context.Context, userID int) (*repository.User, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.GetUserByIDIncludingDeleted(ctx, userID)
+}
+
+func (r *fakeRepository) PatchUser(ctx context.Context, userID int, expectedVersion int, updates map[string]interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.PatchUser(ctx, userID, expectedVersion, updates); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventUserUpdated, userID)
+	return nil
+}
+
+func (r *fakeRepository) ModifyUser(ctx context.Context, userID int, expectedVersion int, modify func(current repository.User) (map[string]interface{}, error)) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.ModifyUser(ctx, userID, expectedVersion, modify); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventUserUpdated, userID)
+	return nil
+}
+
+func (r *fakeRepository) ListUsers(ctx context.Context, opts repository.ListOptions) (*repository.UserPage, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.ListUsers(ctx, opts)
+}
+
+func (r *fakeRepository) ListUsersAfter(ctx context.Context, opts repository.ListOptions, cursor string) (*repository.UserPage, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.ListUsersAfter(ctx, opts, cursor)
+}
+
+func (r *fakeRepository) GetAllUsers(ctx context.Context) ([]repository.User, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.GetAllUsers(ctx)
+}
+
+func (r *fakeRepository) ExportUsers(ctx context.Context, opts repository.ListOptions, fn func(repository.User) error) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.MemoryUserRepository.ExportUsers(ctx, opts, fn)
+}
+
+func (r *fakeRepository) SearchUsers(ctx context.Context, opts repository.SearchOptions) ([]repository.SearchHit, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.SearchUsers(ctx, opts)
+}
+
+func (r *fakeRepository) SuggestValues(ctx context.Context, opts repository.SuggestOptions) ([]repository.Suggestion, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.SuggestValues(ctx, opts)
+}
+
+func (r *fakeRepository) DeleteUserByID(ctx context.Context, userID int, expectedVersion int) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.DeleteUserByID(ctx, userID, expectedVersion); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventUserDeleted, userID)
+	return nil
+}
+
+func (r *fakeRepository) RestoreUser(ctx context.Context, userID int, expectedVersion int) (*repository.User, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	user, err := r.MemoryUserRepository.RestoreUser(ctx, userID, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+	r.publisher.publish(ctx, repository.EventUserRestored, userID)
+	return user, nil
+}
+
+func (r *fakeRepository) CreateDepartment(ctx context.Context, department *repository.Department) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.CreateDepartment(ctx, department); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventDepartmentCreated, department.Department_id)
+	return nil
+}
+
+func (r *fakeRepository) GetDepartmentByID(ctx context.Context, departmentID int) (*repository.Department, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.GetDepartmentByID(ctx, departmentID)
+}
+
+func (r *fakeRepository) ListDepartments(ctx context.Context) ([]repository.Department, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.MemoryUserRepository.ListDepartments(ctx)
+}
+
+func (r *fakeRepository) UpdateDepartment(ctx context.Context, department *repository.Department) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.UpdateDepartment(ctx, department); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventDepartmentUpdated, department.Department_id)
+	return nil
+}
+
+func (r *fakeRepository) DeleteDepartmentByID(ctx context.Context, departmentID int, expectedVersion int) error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.MemoryUserRepository.DeleteDepartmentByID(ctx, departmentID, expectedVersion); err != nil {
+		return err
+	}
+	r.publisher.publish(ctx, repository.EventDepartmentDeleted, departmentID)
+	return nil
+}
+
+var _ = Describe("/users and /departments routes", func() {
+	var (
+		repo      *fakeRepository
+		publisher *fakeEventPublisher
+		router    *gin.Engine
+	)
+
+	BeforeEach(func() {
+		gin.SetMode(gin.TestMode)
+		publisher = &fakeEventPublisher{}
+		repo = &fakeRepository{
+			MemoryUserRepository: repository.NewMemoryUserRepository(
+				repository.User{User_name: "jdoe01", First_name: "John", Last_name: "Doe", Email: "jdoe01@example.com", User_status: "A", Department: "HR"},
+				repository.User{User_name: "asmith01", First_name: "Alice", Last_name: "Smith", Email: "asmith01@example.com", User_status: "A", Department: "Finance"},
+				repository.User{User_name: "bwhite01", First_name: "Bob", Last_name: "White", Email: "bwhite01@example.com", User_status: "I", Department: "HR"},
+			),
+			publisher: publisher,
+		}
+		// The seeded users bring HR (department 1) and Finance (2).
+		for _, name := range []string{"IT", "Legal"} {
+			Expect(repo.MemoryUserRepository.CreateDepartment(context.Background(), &repository.Department{Name: name})).To(Succeed())
+		}
+		router = newRouter(repo, withDepartments(repo))
+	})
+
+	// do sends a request through the router; body is sent as is and headers are name, value pairs.
+	do := func(method, target, body string, headers ...string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, target, reader)
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// decode returns the response body as a JSON object.
+	decode := func(w *httptest.ResponseRecorder) map[string]interface{} {
+		var body map[string]interface{}
+		ExpectWithOffset(1, json.Unmarshal(w.Body.Bytes(), &body)).To(Succeed())
+		return body
+	}
+
+	// expectProblem checks w is a problem+json response with the given status and code.
+	expectProblem := func(w *httptest.ResponseRecorder, status int, code string) map[string]interface{} {
+		ExpectWithOffset(1, w.Code).To(Equal(status))
+		ExpectWithOffset(1, w.Header().Get("Content-Type")).To(Equal(problemContentType))
+		body := decode(w)
+		ExpectWithOffset(1, body).To(HaveKeyWithValue("code", code))
+		return body
+	}
+
+	Context("GET /users", func() {
+		It("should return a filtered page with the total and a link to the next page", func() {
+			w := do(http.MethodGet, "/users?department=HR&size=1&sort=last_name", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			body := decode(w)
+			Expect(body).To(HaveKeyWithValue("total", 2.0))
+			Expect(body).To(HaveKeyWithValue("page", 1.0))
+			Expect(body).To(HaveKeyWithValue("size", 1.0))
+			Expect(body["next"]).To(Equal("/users?department=HR&page=2&size=1&sort=last_name"))
+			Expect(body["users"]).To(HaveLen(1))
+			Expect(body["users"].([]interface{})[0]).To(HaveKeyWithValue("user_name", "jdoe01"))
+		})
+
+		It("should page with cursors when a cursor parameter is present", func() {
+			w := do(http.MethodGet, "/users?cursor=&size=2", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			body := decode(w)
+			Expect(body["users"]).To(HaveLen(2))
+			Expect(body).NotTo(HaveKey("total"))
+			Expect(body["next_cursor"]).NotTo(BeEmpty())
+
+			w = do(http.MethodGet, "/users?size=2&cursor="+body["next_cursor"].(string), "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			body = decode(w)
+			Expect(body["users"]).To(HaveLen(1))
+			Expect(body).NotTo(HaveKey("next_cursor"))
+		})
+
+		It("should answer problems when a cursor page cannot be read", func() {
+			expectProblem(do(http.MethodGet, "/users?cursor=bogus", ""), http.StatusBadRequest, "invalid_list_options")
+
+			repo.err = errors.New("unexpected")
+			expectProblem(do(http.MethodGet, "/users?cursor=&size=2", ""), http.StatusInternalServerError, "internal_error")
+		})
+
+		It("should reject malformed query parameters", func() {
+			expectProblem(do(http.MethodGet, "/users?page=two", ""), http.StatusBadRequest, "invalid_query")
+			expectProblem(do(http.MethodGet, "/users?include_deleted=maybe", ""), http.StatusBadRequest, "invalid_query")
+			expectProblem(do(http.MethodGet, "/users?sort=password", ""), http.StatusBadRequest, "invalid_list_options")
+		})
+
+		It("should answer 503 when the database is unavailable", func() {
+			repo.err = &repository.DatabaseError{Kind: repository.ErrUnavailable, Err: errors.New("dial tcp: connection refused")}
+
+			body := expectProblem(do(http.MethodGet, "/users", ""), http.StatusServiceUnavailable, "unavailable")
+			Expect(body["detail"]).NotTo(ContainSubstring("dial"))
+		})
+	})
+
+	Context("GET /users/export", func() {
+		It("should stream matching users as a CSV download", func() {
+			w := do(http.MethodGet, "/users/export?department=HR&sort=last_name&order=desc", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Type")).To(Equal("text/csv"))
+			Expect(w.Header().Get("Content-Disposition")).To(MatchRegexp(`^attachment; filename="users-\d{8}\.csv"$`))
+			Expect(w.Body.String()).To(Equal("user_id,user_name,first_name,last_name,email,user_status,department,version,deleted_at\n" +
+				"3,bwhite01,Bob,White,bwhite01@example.com,I,HR,1,\n" +
+				"1,jdoe01,John,Doe,jdoe01@example.com,A,HR,1,\n"))
+		})
+
+		It("should quote CSV cells a spreadsheet would read as formulas", func() {
+			w := do(http.MethodPatch, "/users/3", `{"first_name": "=HYPERLINK(\"http://example.com\")", "last_name": "-White"}`, "If-Match", "*")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			w = do(http.MethodGet, "/users/export?department=HR&sort=user_name", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring("\n3,bwhite01,\"'=HYPERLINK(\"\"http://example.com\"\")\",'-White,bwhite01@example.com,I,HR,2,\n"))
+		})
+
+		It("should write NDJSON and XLSX", func() {
+			Expect(do(http.MethodDelete, "/users/2", "", "If-Match", "*").Code).To(Equal(http.StatusOK))
+
+			w := do(http.MethodGet, "/users/export?format=ndjson&include_deleted=true", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+			Expect(lines).To(HaveLen(3))
+			var user repository.User
+			Expect(json.Unmarshal([]byte(lines[1]), &user)).To(Succeed())
+			Expect(user.User_name).To(Equal("asmith01"))
+			Expect(user.Deleted_at).NotTo(BeNil())
+
+			w = do(http.MethodGet, "/users/export?format=xlsx", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Disposition")).To(HaveSuffix(`.xlsx"`))
+			zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			Expect(err).NotTo(HaveOccurred())
+			sheet, err := zr.Open("xl/worksheets/sheet1.xml")
+			Expect(err).NotTo(HaveOccurred())
+			data, err := io.ReadAll(sheet)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(And(ContainSubstring(">jdoe01<"), ContainSubstring(">bwhite01<"), Not(ContainSubstring(">asmith01<"))))
+		})
+
+		It("should answer problems for errors before the download starts", func() {
+			expectProblem(do(http.MethodGet, "/users/export?format=pdf", ""), http.StatusBadRequest, "invalid_query")
+			expectProblem(do(http.MethodGet, "/users/export?sort=password", ""), http.StatusBadRequest, "invalid_list_options")
+
+			repo.err = repository.ErrUnavailable
+			w := do(http.MethodGet, "/users/export", "")
+			expectProblem(w, http.StatusServiceUnavailable, "unavailable")
+			Expect(w.Header().Get("Content-Disposition")).To(BeEmpty())
+		})
+	})
+
+	Context("GET /users/search", func() {
+		It("should return ranked matches with the matching parts of each field", func() {
+			w := do(http.MethodGet, "/users/search?q=Jon+Do", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			body := decode(w)
+			Expect(body).To(HaveKeyWithValue("query", "Jon Do"))
+			Expect(body["results"]).To(HaveLen(1))
+			hit := body["results"].([]interface{})[0].(map[string]interface{})
+			Expect(hit["user"]).To(HaveKeyWithValue("user_name", "jdoe01"))
+			Expect(hit["rank"]).To(BeNumerically(">", 0))
+			Expect(hit["highlights"]).To(Equal(map[string]interface{}{
+				"first_name": []interface{}{map[string]interface{}{"start": 0.0, "end": 4.0}},
+				"last_name":  []interface{}{map[string]interface{}{"start": 0.0, "end": 2.0}},
+			}))
+
+			w = do(http.MethodGet, "/users/search?q=nobody", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(decode(w)["results"]).To(BeEmpty())
+		})
+
+		It("should reject empty queries and bad limits", func() {
+			expectProblem(do(http.MethodGet, "/users/search?q=", ""), http.StatusBadRequest, "invalid_search")
+			expectProblem(do(http.MethodGet, "/users/search?q=%40%21", ""), http.StatusBadRequest, "invalid_search")
+			expectProblem(do(http.MethodGet, "/users/search?q=doe&limit=101", ""), http.StatusBadRequest, "invalid_search")
+			expectProblem(do(http.MethodGet, "/users/search?q=doe&limit=ten", ""), http.StatusBadRequest, "invalid_query")
+		})
+	})
+
+	Context("GET /users/suggest", func() {
+		It("should return the most common values starting with the prefix", func() {
+			w := do(http.MethodGet, "/users/suggest?field=department&prefix=h", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			body := decode(w)
+			Expect(body).To(And(HaveKeyWithValue("field", "department"), HaveKeyWithValue("prefix", "h")))
+			Expect(body["suggestions"]).To(Equal([]interface{}{
+				map[string]interface{}{"value": "HR", "count": 2.0},
+			}))
+
+			w = do(http.MethodGet, "/users/suggest?field=user_name&limit=2", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(decode(w)["suggestions"]).To(HaveLen(2))
+		})
+
+		It("should reject fields without suggestions and bad limits", func() {
+			expectProblem(do(http.MethodGet, "/users/suggest?field=email&prefix=j", ""), http.StatusBadRequest, "invalid_suggest")
+			expectProblem(do(http.MethodGet, "/users/suggest?prefix=j", ""), http.StatusBadRequest, "invalid_suggest")
+			expectProblem(do(http.MethodGet, "/users/suggest?field=department&limit=51", ""), http.StatusBadRequest, "invalid_suggest")
+			expectProblem(do(http.MethodGet, "/users/suggest?field=department&limit=all", ""), http.StatusBadRequest, "invalid_query")
+		})
+	})
+
+	Context("GET /users/:id", func() {
+		It("should return the user with its version as ETag", func() {
+			w := do(http.MethodGet, "/users/1", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("ETag")).To(Equal(`"1"`))
+			Expect(decode(w)).To(Equal(map[string]interface{}{
+				"user_id": 1.0, "user_name": "jdoe01", "first_name": "John", "last_name": "Doe",
+				"email": "jdoe01@example.com", "user_status": "A", "department": "HR", "version": 1.0,
+			}))
+		})
+
+		It("should answer 304 when If-None-Match names the current version", func() {
+			w := do(http.MethodGet, "/users/1", "", "If-None-Match", `"1"`)
+			Expect(w.Code).To(Equal(http.StatusNotModified))
+			Expect(w.Body.Len()).To(BeZero())
+		})
+
+		It("should distinguish invalid ids, missing users and server errors", func() {
+			expectProblem(do(http.MethodGet, "/users/abc", ""), http.StatusBadRequest, "invalid_user_id")
+			expectProblem(do(http.MethodGet, "/users/99", ""), http.StatusNotFound, "user_not_found")
+
+			repo.err = errors.New("unexpected")
+			expectProblem(do(http.MethodGet, "/users/1", ""), http.StatusInternalServerError, "internal_error")
+		})
+
+		It("should find soft deleted users only with include_deleted", func() {
+			Expect(do(http.MethodDelete, "/users/2", "", "If-Match", "*").Code).To(Equal(http.StatusOK))
+
+			expectProblem(do(http.MethodGet, "/users/2", ""), http.StatusNotFound, "user_not_found")
+			w := do(http.MethodGet, "/users/2?include_deleted=true", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(decode(w)).To(HaveKey("deleted_at"))
+		})
+	})
+
+	Context("POST /users", func() {
+		It("should create the user and publish an event stamped with the request", func() {
+			w := do(http.MethodPost, "/users", `{"User_id": "", "user_name": "cjones01", "email": "cjones01@example.com", "user_status": "A"}`,
+				"X-Actor", "admin", correlationIDHeader, "req-1")
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(decode(w)).To(And(HaveKeyWithValue("user_id", 4.0), HaveKeyWithValue("version", 1.0)))
+
+			Expect(publisher.events).To(Equal([]fakeEvent{{
+				Type: repository.EventUserCreated,
+				ID:   4,
+				Meta: repository.EventMetadata{Actor: "admin", CorrelationID: "req-1"},
+			}}))
+		})
+
+		It("should ignore a User_id sent by the client, numeric or not", func() {
+			for _, id := range []string{`"7"`, `"abc"`} {
+				w := do(http.MethodPost, "/users", `{"User_id": `+id+`, "user_name": "u`+strings.Trim(id, `"`)+`", "email": "u`+strings.Trim(id, `"`)+`@example.com"}`)
+				Expect(w.Code).To(Equal(http.StatusCreated))
+			}
+			w := do(http.MethodPost, "/users", `{"user_name": "nouserid", "email": "nouserid@example.com"}`)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(decode(w)).To(HaveKeyWithValue("user_id", 6.0))
+		})
+
+		It("should reject malformed bodies, invalid users and duplicates", func() {
+			expectProblem(do(http.MethodPost, "/users", `{"user_name":`), http.StatusBadRequest, "invalid_body")
+			expectProblem(do(http.MethodPost, "/users", `{"user_name": 5}`), http.StatusBadRequest, "invalid_body")
+
+			body := expectProblem(do(http.MethodPost, "/users", `{"user_name": "new user", "email": "nope"}`), http.StatusUnprocessableEntity, "invalid_user")
+			Expect(body["fields"]).To(ConsistOf(
+				HaveKeyWithValue("field", "user_name"),
+				HaveKeyWithValue("field", "email"),
+			))
+
+			body = expectProblem(do(http.MethodPost, "/users", `{"user_name": "JDOE01", "email": "x@example.com"}`), http.StatusConflict, "duplicate_user")
+			Expect(body).To(HaveKeyWithValue("field", "user_name"))
+			Expect(publisher.events).To(BeEmpty())
+		})
+
+		It("should only accept departments that exist", func() {
+			body := expectProblem(do(http.MethodPost, "/users", `{"user_name": "cjones01", "email": "cjones01@example.com", "department": "Sales"}`), http.StatusUnprocessableEntity, "invalid_user")
+			Expect(body["fields"]).To(ConsistOf(And(HaveKeyWithValue("field", "department"), HaveKeyWithValue("code", "reference"))))
+		})
+	})
+
+	Context("POST /users/import", func() {
+		// results returns the status of each record in the report, in order.
+		results := func(w *httptest.ResponseRecorder) []interface{} {
+			ExpectWithOffset(1, w.Code).To(Equal(http.StatusOK))
+			var statuses []interface{}
+			for _, r := range decode(w)["results"].([]interface{}) {
+				statuses = append(statuses, r.(map[string]interface{})["status"])
+			}
+			return statuses
+		}
+
+		It("should create, skip and fail CSV records and report each by line", func() {
+			csv := "\ufeffUser_Name,email,department\n" +
+				"cjones01,cjones01@example.com,IT\n" +
+				"JDOE01,someone@example.com,IT\n" +
+				"dgreen01,not-an-email,IT\n" +
+				"cjones01,other@example.com,HR\n" +
+				"\"emiller01\", emiller01@example.com ,\n" +
+				"fbrown01,fbrown01@example.com\n"
+			w := do(http.MethodPost, "/users/import", csv, "Content-Type", "text/csv; charset=utf-8")
+			Expect(results(w)).To(Equal([]interface{}{"created", "skipped", "failed", "skipped", "created", "failed"}))
+
+			body := decode(w)
+			Expect(body).To(And(HaveKeyWithValue("created", 2.0), HaveKeyWithValue("skipped", 2.0), HaveKeyWithValue("failed", 2.0)))
+			rows := body["results"].([]interface{})
+			Expect(rows[0]).To(And(HaveKeyWithValue("line", 2.0), HaveKeyWithValue("user_id", 4.0)))
+			Expect(rows[1]).To(And(HaveKeyWithValue("code", "duplicate_user"), HaveKeyWithValue("field", "user_name")))
+			Expect(rows[2]).To(And(HaveKeyWithValue("code", "invalid_user"), HaveKey("fields")))
+			Expect(rows[5]).To(And(HaveKeyWithValue("line", 7.0), HaveKeyWithValue("code", "invalid_record")))
+
+			created, err := repo.GetUserByID(context.Background(), 5)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created.Email).To(Equal("emiller01@example.com"))
+			Expect(publisher.events).To(HaveLen(2))
+		})
+
+		It("should import NDJSON and only report on a dry run", func() {
+			ndjson := `{"user_name": "cjones01", "email": "cjones01@example.com"}` + "\n\n" +
+				`{"user_name": "dgreen01", "email": "dgreen01@example.com", "user_id": 9}` + "\n" +
+				`not json` + "\n"
+
+			w := do(http.MethodPost, "/users/import?dry_run=true", ndjson, "Content-Type", "application/x-ndjson")
+			Expect(results(w)).To(Equal([]interface{}{"created", "failed", "failed"}))
+			rows := decode(w)["results"].([]interface{})
+			Expect(rows[0]).NotTo(HaveKey("user_id"))
+			Expect(rows[1]).To(And(HaveKeyWithValue("line", 3.0), HaveKeyWithValue("fields", ContainElement(HaveKeyWithValue("code", "immutable")))))
+			Expect(rows[2]).To(HaveKeyWithValue("code", "invalid_record"))
+
+			users, err := repo.GetAllUsers(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(HaveLen(3))
+			Expect(publisher.events).To(BeEmpty())
+
+			w = do(http.MethodPost, "/users/import", ndjson, "Content-Type", "application/x-ndjson")
+			Expect(results(w)).To(Equal([]interface{}{"created", "failed", "failed"}))
+			Expect(publisher.events).To(HaveLen(1))
+		})
+
+		It("should strip the quote a CSV export puts before formula-like cells", func() {
+			w := do(http.MethodPost, "/users/import", "user_name,email,first_name\ncjones01,cjones01@example.com,'=SUM(A1)\n", "Content-Type", "text/csv")
+			Expect(results(w)).To(Equal([]interface{}{"created"}))
+
+			created, err := repo.GetUserByID(context.Background(), 4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created.First_name).To(Equal("=SUM(A1)"))
+		})
+
+		It("should fail records naming an unknown department, on a dry run too, and import the rest", func() {
+			csv := "user_name,email,department\n" +
+				"cjones01,cjones01@example.com,Research\n" +
+				"dgreen01,dgreen01@example.com,Legal\n"
+			for _, path := range []string{"/users/import?dry_run=true", "/users/import"} {
+				w := do(http.MethodPost, path, csv, "Content-Type", "text/csv")
+				Expect(results(w)).To(Equal([]interface{}{"failed", "created"}))
+				Expect(decode(w)["results"].([]interface{})[0]).To(And(
+					HaveKeyWithValue("code", "invalid_user"),
+					HaveKeyWithValue("fields", ContainElement(HaveKeyWithValue("code", "reference"))),
+				))
+			}
+			Expect(publisher.events).To(HaveLen(1))
+		})
+
+		It("should fail every record of a batch the repository rejects", func() {
+			repo.err = errors.New("connection reset")
+			w := do(http.MethodPost, "/users/import", "user_name,email\ncjones01,cjones01@example.com\n", "Content-Type", "text/csv")
+			Expect(results(w)).To(Equal([]interface{}{"failed"}))
+			Expect(decode(w)["results"]).To(ContainElement(And(
+				HaveKeyWithValue("code", "internal_error"),
+				HaveKeyWithValue("reason", "an unexpected error occurred"),
+			)))
+		})
+
+		It("should reject other media types and bad CSV headers", func() {
+			expectProblem(do(http.MethodPost, "/users/import", `{"user_name": "cjones01"}`), http.StatusUnsupportedMediaType, "unsupported_media_type")
+			expectProblem(do(http.MethodPost, "/users/import", "user_name,password\n", "Content-Type", "text/csv"), http.StatusBadRequest, "invalid_csv_header")
+			expectProblem(do(http.MethodPost, "/users/import", "email,email\n", "Content-Type", "text/csv"), http.StatusBadRequest, "invalid_csv_header")
+			expectProblem(do(http.MethodPost, "/users/import", "", "Content-Type", "text/csv"), http.StatusBadRequest, "invalid_body")
+			expectProblem(do(http.MethodPost, "/users/import?dry_run=perhaps", "", "Content-Type", "text/csv"), http.StatusBadRequest, "invalid_query")
+		})
+	})
+
+	Context("POST /users/bulk", func() {
+		// results returns the status of each operation in the report, in order.
+		results := func(w *httptest.ResponseRecorder) []interface{} {
+			ExpectWithOffset(1, w.Code).To(Equal(http.StatusOK))
+			var statuses []interface{}
+			for _, r := range decode(w)["results"].([]interface{}) {
+				statuses = append(statuses, r.(map[string]interface{})["status"])
+			}
+			return statuses
+		}
+
+		It("should apply each operation on its own and report every outcome", func() {
+			w := do(http.MethodPost, "/users/bulk", `{"operations": [
+				{"op": "create", "user": {"user_name": "cjones01", "email": "cjones01@example.com"}},
+				{"op": "update", "user_id": 1, "user": {"user_name": "jdoe01", "email": "john.doe@example.com", "department": "IT"}},
+				{"op": "patch", "user_id": 2, "version": 7, "changes": {"department": "IT"}},
+				{"op": "patch", "user_id": 2, "changes": {"department": "IT"}},
+				{"op": "delete", "user_id": 3},
+				{"op": "delete", "user_id": 99},
+				{"op": "rename", "user_id": 1}
+			]}`)
+			Expect(results(w)).To(Equal([]interface{}{201.0, 200.0, 412.0, 200.0, 200.0, 404.0, 400.0}))
+
+			body := decode(w)
+			Expect(body).To(And(HaveKeyWithValue("atomic", false), HaveKeyWithValue("succeeded", 4.0), HaveKeyWithValue("failed", 3.0)))
+			rows := body["results"].([]interface{})
+			Expect(rows[0]).To(And(HaveKeyWithValue("user_id", 4.0), HaveKeyWithValue("user", HaveKeyWithValue("version", 1.0))))
+			Expect(rows[2]).To(And(HaveKeyWithValue("index", 2.0), HaveKeyWithValue("user_id", 2.0), HaveKeyWithValue("code", "version_mismatch")))
+			Expect(rows[4]).To(HaveKeyWithValue("user", HaveKey("deleted_at")))
+			Expect(rows[6]).To(HaveKeyWithValue("code", "invalid_bulk_operation"))
+
+			Expect(publisher.events).To(HaveLen(4))
+			Expect(publisher.events[3]).To(And(HaveField("Type", repository.EventUserDeleted), HaveField("ID", 3)))
+			user, err := repo.GetUserByID(context.Background(), 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Department).To(Equal("IT"))
+		})
+
+		It("should apply nothing when one operation of an atomic request fails", func() {
+			w := do(http.MethodPost, "/users/bulk", `{"atomic": true, "operations": [
+				{"op": "delete", "user_id": 1},
+				{"op": "patch", "user_id": 2, "changes": {"email": "jdoe01@example.com"}},
+				{"op": "delete", "user_id": 3}
+			]}`)
+			Expect(results(w)).To(Equal([]interface{}{424.0, 409.0, 424.0}))
+			rows := decode(w)["results"].([]interface{})
+			Expect(rows[0]).To(And(HaveKeyWithValue("code", "bulk_aborted"), HaveKeyWithValue("user_id", 1.0)))
+			Expect(rows[1]).To(And(HaveKeyWithValue("code", "duplicate_user"), HaveKeyWithValue("field", "email")))
+
+			// An operation that is invalid on its own aborts the others before any of them runs.
+			w = do(http.MethodPost, "/users/bulk", `{"atomic": true, "operations": [
+				{"op": "delete", "user_id": 1},
+				{"op": "create", "user": {"user_name": "cjones01", "email": "not-an-email"}}
+			]}`)
+			Expect(results(w)).To(Equal([]interface{}{424.0, 422.0}))
+
+			users, err := repo.GetAllUsers(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(HaveLen(3))
+			Expect(publisher.events).To(BeEmpty())
+		})
+
+		It("should patch every user the filter matches", func() {
+			w := do(http.MethodPost, "/users/bulk", `{"atomic": true, "filter": {"department": "HR"}, "patch": {"user_status": "I"}}`)
+			Expect(results(w)).To(Equal([]interface{}{200.0, 200.0}))
+			rows := decode(w)["results"].([]interface{})
+			Expect(rows[0]).To(And(HaveKeyWithValue("op", "patch"), HaveKeyWithValue("user_id", 1.0)))
+			Expect(rows[1]).To(HaveKeyWithValue("user_id", 3.0))
+
+			user, err := repo.GetUserByID(context.Background(), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.User_status).To(Equal("I"))
+			Expect(publisher.events).To(HaveLen(2))
+
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"filter": {"department": "HR"}, "patch": {"user_id": 9}}`), http.StatusBadRequest, "invalid_patch")
+		})
+
+		It("should reject malformed requests as a whole", func() {
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"operations": []}`), http.StatusBadRequest, "invalid_bulk_request")
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"patch": {"user_status": "I"}}`), http.StatusBadRequest, "invalid_bulk_request")
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"filter": {"department": "HR"}}`), http.StatusBadRequest, "invalid_bulk_request")
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"filter": {"department": "HR"}, "patch": {"user_status": "I"}, "operations": [{"op": "delete", "user_id": 1}]}`), http.StatusBadRequest, "invalid_bulk_request")
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"operations": {}}`), http.StatusBadRequest, "invalid_body")
+
+			ops := strings.Repeat(`{"op": "delete", "user_id": 1},`, maxBulkOperations)
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"operations": [`+ops+`{"op": "delete", "user_id": 2}]}`), http.StatusBadRequest, "too_many_operations")
+
+			repo.err = errors.New("connection reset")
+			expectProblem(do(http.MethodPost, "/users/bulk", `{"operations": [{"op": "delete", "user_id": 1}]}`), http.StatusInternalServerError, "internal_error")
+		})
+	})
+
+	Context("PUT /users/:id", func() {
+		const body = `{"user_id": 1, "user_name": "jdoe01", "first_name": "Johnny", "last_name": "Doe", "email": "jdoe01@example.com", "user_status": "A", "department": "IT"}`
+
+		It("should replace the user and return the new version", func() {
+			w := do(http.MethodPut, "/users/1", body, "If-Match", `"1"`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("ETag")).To(Equal(`"2"`))
+			Expect(decode(w)).To(And(HaveKeyWithValue("first_name", "Johnny"), HaveKeyWithValue("version", 2.0)))
+			Expect(publisher.events).To(HaveLen(1))
+		})
+
+		It("should answer 412 for a stale If-Match and 400 for a malformed one", func() {
+			expectProblem(do(http.MethodPut, "/users/1", body, "If-Match", `"3"`), http.StatusPreconditionFailed, "version_mismatch")
+			expectProblem(do(http.MethodPut, "/users/1", body, "If-Match", `3`), http.StatusBadRequest, "invalid_if_match")
+			Expect(publisher.events).To(BeEmpty())
+		})
+
+		It("should answer 428 for writes carrying no version and accept one echoed in the body", func() {
+			const unversioned = `{"user_id": 1, "user_name": "jdoe01", "email": "jdoe01@example.com"}`
+			expectProblem(do(http.MethodPut, "/users/1", unversioned), http.StatusPreconditionRequired, "precondition_required")
+			expectProblem(do(http.MethodPatch, "/users/1", `{"department": "IT"}`), http.StatusPreconditionRequired, "precondition_required")
+			expectProblem(do(http.MethodDelete, "/users/1", ""), http.StatusPreconditionRequired, "precondition_required")
+			expectProblem(do(http.MethodPut, "/departments/1", `{"name": "People"}`), http.StatusPreconditionRequired, "precondition_required")
+			expectProblem(do(http.MethodDelete, "/departments/4", ""), http.StatusPreconditionRequired, "precondition_required")
+			Expect(publisher.events).To(BeEmpty())
+
+			w := do(http.MethodPut, "/users/1", `{"user_id": 1, "user_name": "jdoe01", "email": "jdoe01@example.com", "version": 1}`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("ETag")).To(Equal(`"2"`))
+		})
+
+		It("should reject invalid users and missing users", func() {
+			expectProblem(do(http.MethodPut, "/users/1", `{"user_id": 1, "user_name": "jdoe01", "email": "jdoe01@example.com", "user_status": "X"}`, "If-Match", "*"),
+				http.StatusUnprocessableEntity, "invalid_user")
+			expectProblem(do(http.MethodPut, "/users/99", `{"user_id": 99, "user_name": "ghost", "email": "ghost@example.com"}`, "If-Match", "*"),
+				http.StatusNotFound, "user_not_found")
+			expectProblem(do(http.MethodPut, "/users/1", `[]`, "If-Match", "*"), http.StatusBadRequest, "invalid_body")
+		})
+
+		It("should take the user from the path and reject a different user_id in the body", func() {
+			body := expectProblem(do(http.MethodPut, "/users/1", `{"user_id": 2, "user_name": "jdoe01", "email": "jdoe01@example.com"}`, "If-Match", "*"),
+				http.StatusBadRequest, "user_id_mismatch")
+			Expect(body["detail"]).To(ContainSubstring("user_id 2"))
+			expectProblem(do(http.MethodPut, "/users/0", `{"user_name": "jdoe01", "email": "jdoe01@example.com"}`, "If-Match", "*"), http.StatusBadRequest, "invalid_user_id")
+
+			w := do(http.MethodPut, "/users/2", `{"user_name": "asmith01", "first_name": "Alicia", "email": "asmith01@example.com"}`, "If-Match", "*")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(decode(w)).To(And(HaveKeyWithValue("user_id", 2.0), HaveKeyWithValue("first_name", "Alicia")))
+
+			other, err := repo.GetUserByID(context.Background(), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.Version).To(Equal(1))
+		})
+
+		It("should create a missing user with the path id when upserting", func() {
+			expectProblem(do(http.MethodPut, "/users/40", `{"user_name": "jdoe40", "email": "jdoe40@example.com"}`, "If-Match", "*"), http.StatusNotFound, "user_not_found")
+
+			w := do(http.MethodPut, "/users/40?upsert=true", `{"user_name": "jdoe40", "email": "jdoe40@example.com"}`, "If-Match", "*")
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(w.Header().Get("ETag")).To(Equal(`"1"`))
+			Expect(decode(w)).To(HaveKeyWithValue("user_id", 40.0))
+
+			w = do(http.MethodPut, "/users/40?upsert=true", `{"user_name": "jdoe40", "email": "jdoe40@example.com", "department": "IT"}`, "If-Match", `"1"`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("ETag")).To(Equal(`"2"`))
+			Expect(publisher.events).To(HaveLen(2))
+			Expect(publisher.events[0].Type).To(Equal(repository.EventUserCreated))
+
+			expectProblem(do(http.MethodPut, "/users/41?upsert=true", `{"user_name": "jdoe41", "email": "jdoe41@example.com"}`, "If-Match", `"1"`),
+				http.StatusPreconditionFailed, "version_mismatch")
+			expectProblem(do(http.MethodPut, "/users/41?upsert=maybe", `{}`, "If-Match", "*"), http.StatusBadRequest, "invalid_query")
+		})
+	})
+
+	Context("PATCH /users/:id", func() {
+		It("should update only the given fields", func() {
+			w := do(http.MethodPatch, "/users/1", `{"department": "Legal"}`, "If-Match", "*")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(decode(w)).To(Equal(map[string]interface{}{"message": "User updated successfully"}))
+
+			user, err := repo.GetUserByID(context.Background(), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Department).To(Equal("Legal"))
+			Expect(user.First_name).To(Equal("John"))
+		})
+
+		It("should list unknown and immutable fields", func() {
+			body := expectProblem(do(http.MethodPatch, "/users/1", `{"user_id": 2, "password": "x"}`, "If-Match", "*"), http.StatusBadRequest, "invalid_patch")
+			Expect(body["unknown_fields"]).To(Equal([]interface{}{"password"}))
+			Expect(body["immutable_fields"]).To(Equal([]interface{}{"user_id"}))
+		})
+
+		It("should apply merge patches and JSON patches", func() {
+			w := do(http.MethodPatch, "/users/1", "", "Content-Type", mergePatchContentType, "If-Match", "*")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+			req := func(contentType, patch string, headers ...string) *httptest.ResponseRecorder {
+				return do(http.MethodPatch, "/users/1", patch, append([]string{"Content-Type", contentType, "If-Match", "*"}, headers...)...)
+			}
+			Expect(req(mergePatchContentType, `{"first_name": "Johnny", "department": null}`).Code).To(Equal(http.StatusOK))
+			user, err := repo.GetUserByID(context.Background(), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.First_name).To(Equal("Johnny"))
+			Expect(user.Department).To(BeEmpty())
+
+			expectProblem(req(jsonPatchContentType, `[{"op": "test", "path": "/first_name", "value": "John"}, {"op": "replace", "path": "/department", "value": "IT"}]`),
+				http.StatusConflict, "patch_test_failed")
+			expectProblem(req(jsonPatchContentType, `[{"op": "remove", "path": "/nickname"}]`), http.StatusUnprocessableEntity, "patch_path_not_found")
+			expectProblem(req(jsonPatchContentType, `{"op": "add"}`), http.StatusBadRequest, "invalid_patch_document")
+			expectProblem(req(mergePatchContentType, `["first_name"]`), http.StatusBadRequest, "invalid_patch_document")
+			Expect(req(jsonPatchContentType, `[{"op": "replace", "path": "/department", "value": "IT"}]`, "If-Match", `"2"`).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should reject invalid ids and stale versions", func() {
+			expectProblem(do(http.MethodPatch, "/users/x", `{"department": "IT"}`, "If-Match", "*"), http.StatusBadRequest, "invalid_user_id")
+			expectProblem(do(http.MethodPatch, "/users/1", `{"department": "IT"}`, "If-Match", `"5"`), http.StatusPreconditionFailed, "version_mismatch")
+			expectProblem(do(http.MethodPatch, "/users/99", `{"department": "IT"}`, "If-Match", "*"), http.StatusNotFound, "user_not_found")
+		})
+	})
+
+	Context("DELETE /users/:id", func() {
+		It("should soft delete the user and publish an event", func() {
+			w := do(http.MethodDelete, "/users/1", "", "If-Match", `"1"`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(decode(w)).To(Equal(map[string]interface{}{"message": "User deleted successfully"}))
+			Expect(publisher.events).To(ConsistOf(HaveField("Type", repository.EventUserDeleted)))
+
+			expectProblem(do(http.MethodDelete, "/users/1", "", "If-Match", "*"), http.StatusNotFound, "user_not_found")
+		})
+
+		It("should reject invalid ids and stale versions", func() {
+			expectProblem(do(http.MethodDelete, "/users/one", "", "If-Match", "*"), http.StatusBadRequest, "invalid_user_id")
+			expectProblem(do(http.MethodDelete, "/users/1", "", "If-Match", `"2"`), http.StatusPreconditionFailed, "version_mismatch")
+		})
+	})
+
+	Context("POST /users/:id/restore", func() {
+		It("should restore a deleted user and return it with its new version", func() {
+			Expect(do(http.MethodDelete, "/users/3", "", "If-Match", "*").Code).To(Equal(http.StatusOK))
+
+			w := do(http.MethodPost, "/users/3/restore", "", "If-Match", `"2"`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("ETag")).To(Equal(`"3"`))
+			Expect(decode(w)).NotTo(HaveKey("deleted_at"))
+		})
+
+		It("should answer 409 for users that are not deleted", func() {
+			expectProblem(do(http.MethodPost, "/users/1/restore", ""), http.StatusConflict, "user_not_deleted")
+			expectProblem(do(http.MethodPost, "/users/x/restore", ""), http.StatusBadRequest, "invalid_user_id")
+		})
+
+		It("should answer 503 when the database is unavailable", func() {
+			Expect(do(http.MethodDelete, "/users/3", "", "If-Match", "*").Code).To(Equal(http.StatusOK))
+			repo.err = &repository.DatabaseError{Kind: repository.ErrUnavailable, Err: errors.New("dial tcp: connection refused")}
+
+			expectProblem(do(http.MethodPost, "/users/3/restore", ""), http.StatusServiceUnavailable, "unavailable")
+			expectProblem(do(http.MethodGet, "/users/3?include_deleted=true", ""), http.StatusServiceUnavailable, "unavailable")
+		})
+	})
+
+	Context("GET /departments", func() {
+		It("should list every department by name", func() {
+			w := do(http.MethodGet, "/departments", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var body struct{ Departments []repository.Department }
+			Expect(json.Unmarshal(w.Body.Bytes(), &body)).To(Succeed())
+			Expect(body.Departments).To(Equal([]repository.Department{
+				{Department_id: 2, Name: "Finance", Version: 1},
+				{Department_id: 1, Name: "HR", Version: 1},
+				{Department_id: 3, Name: "IT", Version: 1},
+				{Department_id: 4, Name: "Legal", Version: 1},
+			}))
+		})
+
+		It("should return one department with its ETag", func() {
+			w := do(http.MethodGet, "/departments/3", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("ETag")).To(Equal(`"1"`))
+			Expect(decode(w)).To(HaveKeyWithValue("name", "IT"))
+
+			expectProblem(do(http.MethodGet, "/departments/9", ""), http.StatusNotFound, "department_not_found")
+			expectProblem(do(http.MethodGet, "/departments/it", ""), http.StatusBadRequest, "invalid_department_id")
+		})
+	})
+
+	Context("POST /departments", func() {
+		It("should create the department and publish an event", func() {
+			w := do(http.MethodPost, "/departments", `{"name": "Sales", "description": "Field sales"}`)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(w.Header().Get("ETag")).To(Equal(`"1"`))
+			Expect(decode(w)).To(Equal(map[string]interface{}{"department_id": 5.0, "name": "Sales", "description": "Field sales", "version": 1.0}))
+			Expect(publisher.events).To(ConsistOf(And(HaveField("Type", repository.EventDepartmentCreated), HaveField("ID", 5))))
+
+			Expect(do(http.MethodPost, "/users", `{"user_name": "cjones01", "email": "cjones01@example.com", "department": "Sales"}`).Code).To(Equal(http.StatusCreated))
+		})
+
+		It("should reject invalid departments and names taken regardless of case", func() {
+			body := expectProblem(do(http.MethodPost, "/departments", `{"name": " "}`), http.StatusUnprocessableEntity, "invalid_department")
+			Expect(body["fields"]).To(ConsistOf(HaveKeyWithValue("field", "name")))
+			expectProblem(do(http.MethodPost, "/departments", `{"name": "hr"}`), http.StatusConflict, "duplicate_department")
+			Expect(publisher.events).To(BeEmpty())
+		})
+	})
+
+	Context("PUT /departments/:id", func() {
+		It("should rename the department for its users", func() {
+			w := do(http.MethodPut, "/departments/1", `{"name": "People", "description": "Hiring and payroll"}`, "If-Match", `"1"`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("ETag")).To(Equal(`"2"`))
+			Expect(publisher.events).To(ConsistOf(And(HaveField("Type", repository.EventDepartmentUpdated), HaveField("ID", 1))))
+
+			w = do(http.MethodGet, "/users?department=People", "")
+			Expect(decode(w)).To(HaveKeyWithValue("total", 2.0))
+			w = do(http.MethodGet, "/users/1", "")
+			Expect(w.Header().Get("ETag")).To(Equal(`"2"`))
+		})
+
+		It("should reject stale versions, mismatched ids and taken names", func() {
+			expectProblem(do(http.MethodPut, "/departments/1", `{"name": "People"}`, "If-Match", `"2"`), http.StatusPreconditionFailed, "version_mismatch")
+			expectProblem(do(http.MethodPut, "/departments/1", `{"department_id": 2, "name": "People"}`, "If-Match", "*"), http.StatusBadRequest, "department_id_mismatch")
+			expectProblem(do(http.MethodPut, "/departments/1", `{"name": "finance"}`, "If-Match", "*"), http.StatusConflict, "duplicate_department")
+			expectProblem(do(http.MethodPut, "/departments/9", `{"name": "People"}`, "If-Match", "*"), http.StatusNotFound, "department_not_found")
+		})
+	})
+
+	Context("DELETE /departments/:id", func() {
+		It("should delete an empty department and publish an event", func() {
+			w := do(http.MethodDelete, "/departments/4", "", "If-Match", `"1"`)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(publisher.events).To(ConsistOf(And(HaveField("Type", repository.EventDepartmentDeleted), HaveField("ID", 4))))
+
+			expectProblem(do(http.MethodGet, "/departments/4", ""), http.StatusNotFound, "department_not_found")
+		})
+
+		It("should refuse to delete a department users belong to", func() {
+			Expect(do(http.MethodDelete, "/users/1", "", "If-Match", "*").Code).To(Equal(http.StatusOK))
+			Expect(do(http.MethodDelete, "/users/3", "", "If-Match", "*").Code).To(Equal(http.StatusOK))
+
+			body := expectProblem(do(http.MethodDelete, "/departments/1", "", "If-Match", "*"), http.StatusConflict, "department_in_use")
+			Expect(body["detail"]).To(ContainSubstring("2 users"))
+		})
+	})
+
+	Context("GET /departments/:id/users", func() {
+		It("should page through the department's users like GET /users", func() {
+			w := do(http.MethodGet, "/departments/1/users?sort=first_name&size=1&department=Finance", "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			body := decode(w)
+			Expect(body).To(HaveKeyWithValue("total", 2.0))
+			Expect(body["users"]).To(ConsistOf(HaveKeyWithValue("first_name", "Bob")))
+			Expect(body).To(HaveKeyWithValue("next", "/departments/1/users?department=Finance&page=2&size=1&sort=first_name"))
+
+			expectProblem(do(http.MethodGet, "/departments/9/users", ""), http.StatusNotFound, "department_not_found")
+		})
+	})
+
+	Context("/departments errors", func() {
+		It("should answer 503 on every route when the database is unavailable", func() {
+			repo.err = &repository.DatabaseError{Kind: repository.ErrUnavailable, Err: errors.New("dial tcp: connection refused")}
+
+			expectProblem(do(http.MethodGet, "/departments", ""), http.StatusServiceUnavailable, "unavailable")
+			expectProblem(do(http.MethodPost, "/departments", `{"name": "Research"}`), http.StatusServiceUnavailable, "unavailable")
+			expectProblem(do(http.MethodGet, "/departments/1", ""), http.StatusServiceUnavailable, "unavailable")
+			expectProblem(do(http.MethodPut, "/departments/1", `{"name": "People"}`, "If-Match", `"1"`), http.StatusServiceUnavailable, "unavailable")
+			expectProblem(do(http.MethodDelete, "/departments/4", "", "If-Match", `"1"`), http.StatusServiceUnavailable, "unavailable")
+			expectProblem(do(http.MethodGet, "/departments/1/users", ""), http.StatusServiceUnavailable, "unavailable")
+			Expect(publisher.events).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_userlist/repository"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// csvContentType selects a CSV import with a header row of json field names.
+	csvContentType = "text/csv"
+	// ndjsonContentType selects an import of one JSON user object per line.
+	ndjsonContentType = "application/x-ndjson"
+
+	// importBatchSize is how many users one repository transaction imports.
+	importBatchSize = 500
+	// maxImportLineSize is the longest NDJSON line accepted.
+	maxImportLineSize = 1 << 20
+)
+
+// Statuses of an importResult.
+const (
+	importCreated = "created"
+	importSkipped = "skipped"
+	importFailed  = "failed"
+)
+
+// importRow is one record read from an import file: the user it describes, or why it could not
+// be read. line is where the record starts in the file; last is set when the file cannot be read
+// past the record.
+type importRow struct {
+	line int
+	user *repository.User
+	err  error
+	last bool
+}
+
+// importResult reports what happened to one record. Skipped and failed records carry the code
+// and reason a problem response for the same error would, plus the offending field or fields.
+type importResult struct {
+	Line   int                     `json:"line"`
+	Status string                  `json:"status"`
+	UserID int                     `json:"user_id,omitempty"`
+	Code   string                  `json:"code,omitempty"`
+	Reason string                  `json:"reason,omitempty"`
+	Field  string                  `json:"field,omitempty"`
+	Fields []repository.FieldError `json:"fields,omitempty"`
+}
+
+// importReport is the response to an import: a result for every record, in file order.
+type importReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Created int            `json:"created"`
+	Skipped int            `json:"skipped"`
+	Failed  int            `json:"failed"`
+	Results []importResult `json:"results"`
+}
+
+// record sets the outcome of result i; err is nil for a created user.
+func (r *importReport) record(i int, status string, err error) {
+	result := &r.Results[i]
+	result.Status = status
+	switch status {
+	case importCreated:
+		r.Created++
+		return
+	case importSkipped:
+		r.Skipped++
+	default:
+		r.Failed++
+	}
+
+	p := problemFor(err)
+	result.Code, result.Reason = p.code, p.detail
+	if p.internal {
+		log.Printf("import of line %d failed: %v", result.Line, err)
+	}
+	var dupErr *repository.DuplicateUserError
+	var validationErr *repository.ValidationError
+	switch {
+	case errors.As(err, &dupErr):
+		result.Field = dupErr.Field
+	case errors.As(err, &validationErr):
+		result.Fields = validationErr.Fields
+	}
+}
+
+// importUsersHandler creates users from a CSV or NDJSON body. Every record is validated; valid
+// users are created in batches of importBatchSize, each in its own transaction. Users naming an
+// unknown department fail, and users whose user_name or email is taken are skipped. With
+// dry_run=true nothing is written. The response reports each record, so a partly failed import
+// can be fixed and sent again.
+func (s *server) importUsersHandler(c *gin.Context) {
+	dryRun, err := boolFromQuery(c, "dry_run")
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	var next func() (importRow, bool)
+	switch c.ContentType() {
+	case csvContentType:
+		next, err = csvRows(c.Request.Body)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	case ndjsonContentType:
+		next = ndjsonRows(c.Request.Body)
+	default:
+		c.Error(&requestError{
+			status: http.StatusUnsupportedMediaType,
+			code:   "unsupported_media_type",
+			detail: fmt.Sprintf("imports must be sent as %s or %s", csvContentType, ndjsonContentType),
+		})
+		return
+	}
+
+	report := &importReport{DryRun: dryRun, Results: []importResult{}}
+	var batch []repository.User
+	var batchResults []int
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		rejected, err := s.repo.ImportUsers(c.Request.Context(), batch, repository.ImportOptions{DryRun: dryRun})
+		for j, i := range batchResults {
+			var dupErr *repository.DuplicateUserError
+			switch {
+			case err != nil:
+				report.record(i, importFailed, err)
+			case errors.As(rejected[j], &dupErr):
+				report.record(i, importSkipped, rejected[j])
+			case rejected[j] != nil:
+				report.record(i, importFailed, rejected[j])
+			default:
+				report.Results[i].UserID = batch[j].User_id
+				report.record(i, importCreated, nil)
+			}
+		}
+		batch, batchResults = nil, nil
+	}
+
+	for {
+		row, ok := next()
+		if !ok {
+			break
+		}
+
+		report.Results = append(report.Results, importResult{Line: row.line})
+		if row.err == nil {
+			row.err = repository.ValidateUser(row.user)
+		}
+		if row.err != nil {
+			report.record(len(report.Results)-1, importFailed, row.err)
+			if row.last {
+				break
+			}
+			continue
+		}
+
+		batch = append(batch, *row.user)
+		batchResults = append(batchResults, len(report.Results)-1)
+		// A dry run writes nothing, so it checks the whole file at once to also catch
+		// duplicates between records that would have landed in different batches.
+		if !dryRun && len(batch) == importBatchSize {
+			flush()
+		}
+	}
+	flush()
+
+	c.JSON(http.StatusOK, report)
+}
+
+// csvRows reads the header of a CSV import and returns a function that reads its records one at
+// a time and reports false after the last. The header names the json field of each column.
+func csvRows(body io.Reader) (func() (importRow, bool), error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, badRequest("invalid_body", "the CSV file is empty")
+	}
+	if err != nil {
+		return nil, badRequest("invalid_body", err.Error())
+	}
+	columns := make(map[string]interface{}, len(header))
+	for i, name := range header {
+		// Spreadsheet exports often start with a byte order mark.
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := columns[name]; ok {
+			return nil, badRequest("invalid_csv_header", fmt.Sprintf("column %q appears more than once", name))
+		}
+		header[i] = name
+		columns[name] = nil
+	}
+	if _, err := repository.UserFromFields(columns); err != nil {
+		return nil, badRequest("invalid_csv_header", err.Error())
+	}
+
+	return func() (importRow, bool) {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return importRow{}, false
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if errors.Is(parseErr.Err, csv.ErrFieldCount) {
+				detail := fmt.Sprintf("expected %d fields, got %d", len(header), len(record))
+				return importRow{line: parseErr.StartLine, err: badRequest("invalid_record", detail)}, true
+			}
+			// Quoting errors leave the reader out of step with the records.
+			return importRow{line: parseErr.StartLine, err: badRequest("invalid_record", parseErr.Err.Error()), last: true}, true
+		}
+		if err != nil {
+			return importRow{err: badRequest("invalid_body", err.Error()), last: true}, true
+		}
+
+		line, _ := reader.FieldPos(0)
+		values := make(map[string]interface{}, len(record))
+		for i, v := range record {
+			values[header[i]] = csvValue(strings.TrimSpace(v))
+		}
+		user, err := repository.UserFromFields(values)
+		return importRow{line: line, user: user, err: err}, true
+	}, nil
+}
+
+// csvValue undoes csvCell, so a csv export can be imported again unchanged.
+func csvValue(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.IndexByte(csvFormulaPrefixes, s[1]) >= 0 {
+		return s[1:]
+	}
+	return s
+}
+
+// ndjsonRows returns a function that reads the JSON object on each non-blank line of an NDJSON
+// import and reports false after the last.
+func ndjsonRows(body io.Reader) func() (importRow, bool) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxImportLineSize)
+	line := 0
+
+	return func() (importRow, bool) {
+		for scanner.Scan() {
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+
+			var values map[string]interface{}
+			if err := json.Unmarshal(text, &values); err != nil {
+				return importRow{line: line, err: badRequest("invalid_record", err.Error())}, true
+			}
+			user, err := repository.UserFromFields(values)
+			return importRow{line: line, user: user, err: err}, true
+		}
+		if err := scanner.Err(); err != nil {
+			return importRow{line: line + 1, err: badRequest("invalid_record", err.Error()), last: true}, true
+		}
+		return importRow{}, false
+	}
+}
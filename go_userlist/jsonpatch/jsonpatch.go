@@ -0,0 +1,329 @@
+// Package jsonpatch applies RFC 7396 JSON Merge Patch and RFC 6902 JSON Patch documents to
+// decoded JSON values (the map[string]interface{} / []interface{} trees encoding/json produces).
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidPatch is returned for malformed patch documents and operations.
+	ErrInvalidPatch = errors.New("invalid patch document")
+	// ErrPathNotFound is returned when an operation refers to a location that does not exist.
+	ErrPathNotFound = errors.New("path not found")
+	// ErrTestFailed is returned when a test operation does not match the document.
+	ErrTestFailed = errors.New("test operation failed")
+)
+
+// MergePatch applies an RFC 7396 merge patch to doc and returns the result. doc is not modified.
+// Members of patch set to null are removed; objects are merged recursively; anything else
+// replaces the target value.
+func MergePatch(doc, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = map[string]interface{}{}
+	}
+
+	result := make(map[string]interface{}, len(target))
+	for k, v := range target {
+		result[k] = v
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = MergePatch(result[k], v)
+		}
+	}
+	return result
+}
+
+// Operation is one RFC 6902 patch operation.
+type Operation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from,omitempty"`
+	Value *json.RawMessage `json:"value,omitempty"`
+}
+
+// Patch is an RFC 6902 JSON Patch document.
+type Patch []Operation
+
+// DecodePatch parses an RFC 6902 JSON Patch document.
+func DecodePatch(data []byte) (Patch, error) {
+	var p Patch
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	return p, nil
+}
+
+// Apply applies the operations in order to a copy of doc and returns the result. If any
+// operation fails, the error is returned and doc is left untouched.
+func (p Patch) Apply(doc interface{}) (interface{}, error) {
+	doc = deepCopy(doc)
+	for i, op := range p {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// value decodes the operation's value member.
+func (op Operation) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, fmt.Errorf("%w: missing value", ErrInvalidPatch)
+	}
+	var v interface{}
+	if err := json.Unmarshal(*op.Value, &v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	return v, nil
+}
+
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case "replace":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		if doc, _, err = remove(doc, path); err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if op.Op == "move" {
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, fmt.Errorf("%w: cannot move a value into one of its children", ErrInvalidPatch)
+			}
+			doc, v, err = remove(doc, from)
+		} else {
+			v, err = get(doc, from)
+			v = deepCopy(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "test":
+		want, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		got, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(got, want) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: pointer %q must start with /", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array index token; "-" (one past the end) is allowed when appending.
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrPathNotFound, token)
+	}
+	max := length - 1
+	if appending {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("%w: array index %d out of range", ErrPathNotFound, i)
+	}
+	return i, nil
+}
+
+// get returns the value at path.
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q", ErrPathNotFound, token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrPathNotFound, token)
+		}
+	}
+	return doc, nil
+}
+
+// add sets the value at path, inserting into arrays, and returns the (possibly new) root.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = value
+		return replaceParent(doc, path[:len(path)-1], node)
+	default:
+		return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrPathNotFound, last)
+	}
+}
+
+// remove deletes the value at path and returns the (possibly new) root and the removed value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		v, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: member %q", ErrPathNotFound, last)
+		}
+		delete(node, last)
+		return doc, v, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := node[i]
+		node = append(node[:i:i], node[i+1:]...)
+		doc, err = replaceParent(doc, path[:len(path)-1], node)
+		return doc, v, err
+	default:
+		return nil, nil, fmt.Errorf("%w: %q is not inside an object or array", ErrPathNotFound, last)
+	}
+}
+
+// replaceParent stores a resized array back at path, since slices cannot grow in place.
+func replaceParent(doc interface{}, path []string, array []interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return array, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = array
+	case []interface{}:
+		i, _ := arrayIndex(last, len(node), false)
+		node[i] = array
+	}
+	return doc, nil
+}
+
+// deepCopy copies maps and slices so a failed patch never leaves a half-applied document.
+func deepCopy(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(node))
+		for k, e := range node {
+			c[k] = deepCopy(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(node))
+		for i, e := range node {
+			c[i] = deepCopy(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
@@ -0,0 +1,94 @@
+package jsonpatch_test
+
+import (
+	"encoding/json"
+	"go_userlist/jsonpatch"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func decode(s string) interface{} {
+	var v interface{}
+	Expect(json.Unmarshal([]byte(s), &v)).To(Succeed())
+	return v
+}
+
+var _ = Describe("jsonpatch", func() {
+	Context("MergePatch", func() {
+		It("should replace, remove and merge members as in RFC 7396", func() {
+			doc := decode(`{"a":"b","c":{"d":"e","f":"g"},"user_id":1}`)
+			patch := decode(`{"a":"z","c":{"f":null,"h":"i"}}`)
+
+			Expect(jsonpatch.MergePatch(doc, patch)).To(Equal(decode(`{"a":"z","c":{"d":"e","h":"i"},"user_id":1}`)))
+			Expect(doc).To(Equal(decode(`{"a":"b","c":{"d":"e","f":"g"},"user_id":1}`)))
+		})
+
+		It("should replace the whole document when the patch is not an object", func() {
+			Expect(jsonpatch.MergePatch(decode(`{"a":"b"}`), decode(`["c"]`))).To(Equal(decode(`["c"]`)))
+		})
+	})
+
+	Context("Patch", func() {
+		apply := func(doc, patch string) (interface{}, error) {
+			p, err := jsonpatch.DecodePatch([]byte(patch))
+			Expect(err).NotTo(HaveOccurred())
+			return p.Apply(decode(doc))
+		}
+
+		It("should apply add, remove, replace, move and copy in order", func() {
+			result, err := apply(`{"user_name":"jdoe","department":"IT","tags":["a","c"]}`, `[
+				{"op":"replace","path":"/department","value":"HR"},
+				{"op":"add","path":"/tags/1","value":"b"},
+				{"op":"add","path":"/tags/-","value":"d"},
+				{"op":"remove","path":"/tags/0"},
+				{"op":"copy","from":"/user_name","path":"/first_name"},
+				{"op":"move","from":"/first_name","path":"/last_name"}
+			]`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(decode(`{"user_name":"jdoe","last_name":"jdoe","department":"HR","tags":["b","c","d"]}`)))
+		})
+
+		It("should unescape ~0 and ~1 in pointers", func() {
+			result, err := apply(`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1},{"op":"remove","path":"/m~0n"}]`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(decode(`{"a/b":1}`)))
+		})
+
+		It("should fail the whole patch when a test operation does not match", func() {
+			doc := decode(`{"user_status":"A"}`)
+			p, err := jsonpatch.DecodePatch([]byte(`[{"op":"replace","path":"/user_status","value":"I"},{"op":"test","path":"/user_status","value":"A"}]`))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = p.Apply(doc)
+			Expect(err).To(MatchError(jsonpatch.ErrTestFailed))
+			Expect(doc).To(Equal(decode(`{"user_status":"A"}`)))
+		})
+
+		It("should report missing paths and malformed operations", func() {
+			_, err := apply(`{"a":1}`, `[{"op":"remove","path":"/b"}]`)
+			Expect(err).To(MatchError(jsonpatch.ErrPathNotFound))
+
+			_, err = apply(`{"a":[1]}`, `[{"op":"add","path":"/a/5","value":2}]`)
+			Expect(err).To(MatchError(jsonpatch.ErrPathNotFound))
+
+			_, err = apply(`{"a":1}`, `[{"op":"replace","path":"/a"}]`)
+			Expect(err).To(MatchError(jsonpatch.ErrInvalidPatch))
+
+			_, err = apply(`{"a":1}`, `[{"op":"frobnicate","path":"/a"}]`)
+			Expect(err).To(MatchError(jsonpatch.ErrInvalidPatch))
+
+			_, err = apply(`{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`)
+			Expect(err).To(MatchError(jsonpatch.ErrInvalidPatch))
+
+			_, err = jsonpatch.DecodePatch([]byte(`{"op":"add"}`))
+			Expect(err).To(MatchError(jsonpatch.ErrInvalidPatch))
+		})
+	})
+})
+
+func TestJSONPatch(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "JSON Patch Suite")
+}
@@ -1,209 +1,135 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"go_userlist/repository"
+	"log"
 	"net/http"
-	"strconv"
-
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	// Initialize the repository
-	userRepo, err := repository.NewPostgresUserRepository(nil)
-	if err != nil {
-		fmt.Println("Error initializing repository:", err)
-	}
-	defer userRepo.Close()
-
-	// Initialize Gin router
-	r := gin.Default()
-
-	// Enable CORS middleware
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:4200"}, // Your frontend URL
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-	}))
-
-	// Define routes
-	r.GET("/users", func(c *gin.Context) { getAllUsersHandler(c, *userRepo) }) // Pass userRepo which implements UserRepository
-	r.GET("/users/:id", func(c *gin.Context) {
-		// Extract and convert the userId from the URL
-		idParam := c.Param("id")
-		userId, err := strconv.Atoi(idParam)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
-			return
-		}
-
-		// Fetch the user by ID
-		user, err := userRepo.GetUserByID(userId)
-		if err != nil {
-			if err == repository.ErrUserNotFound {
-				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			}
-			return
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		// Return the user details as JSON
-		c.JSON(http.StatusOK, user)
-	})
-	r.POST("/users", func(c *gin.Context) { createUserHandler(c, *userRepo) })     // Pass userRepo
-	r.PUT("/users/:id", func(c *gin.Context) { updateUserHandler(c, *userRepo) })  // Pass userRepo
-	r.PATCH("/users/:id", func(c *gin.Context) { patchUserHandler(c, *userRepo) }) // Pass userRepo
-	r.DELETE("/users/:id", func(c *gin.Context) { deleteUserHandler(c, *userRepo) })
-	// Start the server
-	r.Run("localhost:8080")
-}
-
-// getAllUsersHandler retrieves all users from the repository and returns them in the response.
-func getAllUsersHandler(c *gin.Context, userRepo repository.PostgresUserRepository) {
-	users, err := userRepo.GetAllUsers()
+	backend, err := repository.BackendFromEnv()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to fetch users"})
-		return
+		log.Fatalf("Error reading repository configuration: %v", err)
 	}
 
-	c.JSON(http.StatusOK, users)
-}
-
-func createUserHandler(c *gin.Context, userRepo repository.PostgresUserRepository) {
-	var newUser repository.User
-	var rawRequestBody map[string]interface{}
-
-	// Bind the raw JSON to rawRequestBody and log it
-	if err := c.ShouldBindJSON(&rawRequestBody); err != nil {
-		fmt.Println("Error binding raw request body:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
-	}
-
-	fmt.Println("Received request body:", rawRequestBody)
-
-	// Handle User_id manually if it's present but is an empty string
-	if userID, ok := rawRequestBody["User_id"].(string); ok {
-		if userID == "" {
-			// Set User_id to -1 if it's an empty string
-			fmt.Println("User_id is an empty string, setting to -1")
-			newUser.User_id = -1
-		} else {
-			// Try to convert the string to an int
-			userIDInt, err := strconv.Atoi(userID)
-			if err != nil {
-				fmt.Println("Invalid User_id format, setting to -1:", err)
-				newUser.User_id = -1
-			} else {
-				newUser.User_id = userIDInt
-			}
-		}
-		delete(rawRequestBody, "User_id") // Remove User_id from the map to avoid double unmarshalling
+	// Initialize the repository; the in-memory backend serves demo users without a database.
+	// Both backends also store the departments users belong to.
+	var userRepo repository.UserRepository
+	var departments repository.DepartmentRepository
+	wait := func() {}
+	if backend == repository.BackendMemory {
+		fmt.Println("Serving demo users from memory, changes are lost when the server stops")
+		memoryRepo := repository.NewMemoryUserRepository(demoUsers...)
+		userRepo, departments = memoryRepo, memoryRepo
 	} else {
-		// If User_id is missing, set it to -1
-		fmt.Println("User_id is missing, setting to -1")
-		newUser.User_id = -1
+		var postgresRepo *repository.PostgresUserRepository
+		postgresRepo, wait = startPostgres(ctx)
+		userRepo, departments = postgresRepo, postgresRepo
 	}
+	defer userRepo.Close()
 
-	// Marshal and Unmarshal the remaining fields to newUser struct
-	jsonData, err := json.Marshal(rawRequestBody)
+	// Cache typeahead suggestions; user and department changes made through this server clear
+	// the cache
+	suggestTTL, err := repository.SuggestCacheTTLFromEnv()
 	if err != nil {
-		fmt.Println("Error marshalling raw request body:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to marshal request body"})
-		return
+		log.Fatalf("Error reading suggestion cache configuration: %v", err)
 	}
+	suggestCache := repository.NewSuggestCache(userRepo, suggestTTL)
+	userRepo, departments = suggestCache, suggestCache.Departments(departments)
 
-	if err := json.Unmarshal(jsonData, &newUser); err != nil {
-		fmt.Println("Error unmarshalling into newUser:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to unmarshal into user object"})
-		return
-	}
-
-	// Print the newUser object to ensure it's been populated correctly
-	fmt.Printf("User object after unmarshalling: %+v\n", newUser)
-
-	// Create user in the database
-	err = userRepo.CreateUser(&newUser)
+	timeout, err := requestTimeoutFromEnv()
 	if err != nil {
-		fmt.Println("Error creating user in the database:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		log.Fatalf("Error reading request timeout: %v", err)
 	}
 
-	// Debugging info after successful database write
-	fmt.Println("User created successfully:", newUser)
-
-	// Respond with the created user
-	c.IndentedJSON(http.StatusCreated, newUser)
+	// Start the server
+	r := newRouter(userRepo, withDepartments(departments), withRequestTimeout(timeout))
+	srv := &http.Server{Addr: "localhost:8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, then drain requests before stopping the background work
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Println("Error shutting down server:", err)
+	}
+	wait()
 }
 
-func updateUserHandler(c *gin.Context, userRepo repository.PostgresUserRepository) {
-	var updatedUser repository.User
-	// Bind the received JSON to updatedUser
-	if err := c.BindJSON(&updatedUser); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-	fmt.Println(updatedUser)
-	fmt.Println(c.Params)
-	// Update the user in the database
-	err := userRepo.UpdateUser(&updatedUser)
+// startPostgres connects the Postgres repository and starts the outbox relay and the purger in the
+// background. wait blocks until both have stopped after ctx is cancelled, so the relay can finish
+// its batch, and then closes the Kafka producer to flush anything still buffered.
+func startPostgres(ctx context.Context) (userRepo *repository.PostgresUserRepository, wait func()) {
+	// Create the Kafka producer shared by everything that publishes user change events
+	var repoOpts []repository.Option
+	kafkaConfig, err := repository.KafkaConfigFromEnv()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		log.Fatalf("Error reading Kafka configuration: %v", err)
 	}
-
-	c.IndentedJSON(http.StatusOK, updatedUser)
-}
-
-func patchUserHandler(c *gin.Context, userRepo repository.PostgresUserRepository) {
-	var updates map[string]interface{}
-	idParam := c.Param("id")
-	userId, err := strconv.Atoi(idParam) // Convert the string ID to an integer
-
-	// Bind the received JSON to updates map
-	if err := c.BindJSON(&updates); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	producer, err := repository.NewKafkaProducer(kafkaConfig)
+	if err != nil {
+		fmt.Println("Error creating Kafka producer, events will stay in the outbox:", err)
+	} else {
+		repoOpts = append(repoOpts, repository.WithPublisher(producer))
 	}
 
-	// Update the user in the database with only the provided fields
-	err = userRepo.PatchUser(userId, updates)
+	// Initialize the repository
+	userRepo, err = repository.NewPostgresUserRepository(nil, repoOpts...)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		log.Fatalf("Error initializing repository: %v", err)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
-}
-
-func deleteUserHandler(c *gin.Context, userRepo repository.PostgresUserRepository) {
-	fmt.Println("deleting user")
-	// Extract and convert the userId from the URL
-	idParam := c.Param("id")
-	userId, err := strconv.Atoi(idParam)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
-		return
+	// Relay user change events from the outbox table to Kafka in the background
+	relayDone := make(chan struct{})
+	if producer != nil {
+		go func() {
+			defer close(relayDone)
+			userRepo.NewOutboxRelay().Run(ctx)
+		}()
+	} else {
+		close(relayDone)
 	}
 
-	// Delete the user by ID
-	err = userRepo.DeleteUserByID(userId)
+	// Purge users that have stayed soft deleted for longer than the retention period
+	retention, err := repository.PurgeRetentionFromEnv()
 	if err != nil {
-		if err == repository.ErrUserNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		log.Fatalf("Error reading purge configuration: %v", err)
+	}
+	purgeDone := make(chan struct{})
+	go func() {
+		defer close(purgeDone)
+		userRepo.NewPurger(retention).Run(ctx)
+	}()
+
+	return userRepo, func() {
+		<-relayDone
+		<-purgeDone
+		if producer != nil {
+			producer.Close()
 		}
-		return
 	}
+}
 
-	// Return success response
-	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+// demoUsers seed the in-memory backend, matching the first rows of populate_users.sql. Their
+// departments are created along with them.
+var demoUsers = []repository.User{
+	{User_name: "jdoe01", First_name: "John", Last_name: "Doe", Email: "jdoe01@example.com", User_status: "A", Department: "HR"},
+	{User_name: "asmith01", First_name: "Alice", Last_name: "Smith", Email: "asmith01@example.com", User_status: "A", Department: "Finance"},
+	{User_name: "bwhite01", First_name: "Bob", Last_name: "White", Email: "bwhite01@example.com", User_status: "I", Department: "Engineering"},
+	{User_name: "cjones01", First_name: "Charlie", Last_name: "Jones", Email: "cjones01@example.com", User_status: "A", Department: "Marketing"},
 }
@@ -0,0 +1,3 @@
+-- Optimistic concurrency: every write bumps version, and writes that carry If-Match only
+-- apply while the row is still at the version the client read.
+ALTER TABLE public.users ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,4 @@
+-- Soft delete: DELETE /users/:id sets deleted_at and the purge job removes rows once they are
+-- older than USER_PURGE_RETENTION.
+ALTER TABLE public.users ADD COLUMN deleted_at TIMESTAMPTZ;
+CREATE INDEX users_deleted_at_idx ON public.users (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,6 @@
+-- user_name and email are unique regardless of case. The index names are mapped to fields in
+-- repository/constraints.go. Creating them fails if duplicates already exist; find them with
+--   SELECT lower(email), count(*) FROM public.users GROUP BY 1 HAVING count(*) > 1;
+-- (and likewise for user_name) and resolve them first.
+CREATE UNIQUE INDEX users_user_name_key ON public.users (lower(user_name));
+CREATE UNIQUE INDEX users_email_key ON public.users (lower(email));
@@ -0,0 +1,6 @@
+-- GET /users/search matches the searchable fields of a user joined into one document, with
+-- full-text prefix queries and pg_trgm word similarity for typos. The expression must stay
+-- identical to searchDocument in repository/search.go, or the planner cannot use these indexes.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX users_search_fts_idx ON public.users USING gin (to_tsvector('simple', coalesce(user_name, '') || ' ' || coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' || coalesce(email, '') || ' ' || coalesce(department, '')));
+CREATE INDEX users_search_trgm_idx ON public.users USING gin ((coalesce(user_name, '') || ' ' || coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' || coalesce(email, '') || ' ' || coalesce(department, '')) gin_trgm_ops);
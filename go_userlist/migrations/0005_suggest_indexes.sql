@@ -0,0 +1,4 @@
+-- GET /users/suggest looks up live users by a case-insensitive prefix of department or user_name.
+-- text_pattern_ops lets LIKE 'prefix%' use the indexes whatever the database collation.
+CREATE INDEX users_department_prefix_idx ON public.users (lower(department) text_pattern_ops) WHERE deleted_at IS NULL;
+CREATE INDEX users_user_name_prefix_idx ON public.users (lower(user_name) text_pattern_ops) WHERE deleted_at IS NULL;
@@ -0,0 +1,37 @@
+-- Departments become rows of their own, and users.department references one by name, so every
+-- user's department exists and renaming a department renames it for its users.
+CREATE TABLE public.departments (
+    department_id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    description VARCHAR(1000) NOT NULL DEFAULT '',
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+-- Names are unique regardless of case. The index names are mapped to errors in
+-- repository/constraints.go.
+CREATE UNIQUE INDEX departments_lower_name_key ON public.departments (lower(name));
+
+-- Normalise the free-form values first: trim them, store no department as NULL rather than '',
+-- and merge spellings that differ only in case into the one most users have (the first
+-- alphabetically on a tie). Spellings such as 'IT' and 'I.T.' stay separate departments; merge
+-- them afterwards by moving their users with POST /users/bulk and deleting the empty one.
+UPDATE public.users SET department = NULLIF(btrim(department), '')
+WHERE department IS DISTINCT FROM NULLIF(btrim(department), '');
+
+UPDATE public.users u SET department = canonical.name
+FROM (
+    SELECT DISTINCT ON (lower(department)) lower(department) AS key, department AS name
+    FROM public.users
+    WHERE department IS NOT NULL
+    GROUP BY department
+    ORDER BY lower(department), count(*) DESC, department
+) canonical
+WHERE lower(u.department) = canonical.key AND u.department <> canonical.name;
+
+INSERT INTO public.departments (name)
+SELECT DISTINCT department FROM public.users WHERE department IS NOT NULL ORDER BY department;
+
+-- A department with users, soft deleted ones included, cannot be deleted. Renames cascade; the
+-- repository bumps the version of every user they touch and records a user.updated event.
+ALTER TABLE public.users ADD CONSTRAINT users_department_fkey
+    FOREIGN KEY (department) REFERENCES public.departments (name) ON UPDATE CASCADE;
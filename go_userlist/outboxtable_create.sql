@@ -0,0 +1,10 @@
+CREATE TABLE user_outbox (
+    outbox_id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    message_key VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX user_outbox_pending_idx ON user_outbox (outbox_id) WHERE sent_at IS NULL;
@@ -1,3 +1,6 @@
+INSERT INTO departments (name) VALUES
+('Engineering'), ('Finance'), ('HR'), ('IT'), ('Legal'), ('Marketing'), ('Operations'), ('Sales');
+
 INSERT INTO users (user_name, first_name, last_name, email, user_status, department) VALUES
 ('jdoe01', 'John', 'Doe', 'jdoe01@example.com', 'A', 'HR'),
 ('asmith01', 'Alice', 'Smith', 'asmith01@example.com', 'A', 'Finance'),
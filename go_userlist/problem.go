@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go_userlist/jsonpatch"
+	"go_userlist/repository"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// problemContentType is the media type of RFC 7807 error responses.
+const problemContentType = "application/problem+json"
+
+// requestError is an error detected by a handler before the repository is involved, such as
+// a malformed id or header.
+type requestError struct {
+	status int
+	code   string
+	detail string
+}
+
+func (e *requestError) Error() string {
+	return e.detail
+}
+
+// badRequest returns a 400 requestError with the given code and detail.
+func badRequest(code, detail string) error {
+	return &requestError{status: http.StatusBadRequest, code: code, detail: detail}
+}
+
+// problem is the status, code and client-facing detail an error is rendered with, plus any
+// extension members that describe it further. internal is set when the detail replaces the
+// error's own message, which then belongs in the logs.
+type problem struct {
+	status     int
+	code       string
+	detail     string
+	extensions gin.H
+	internal   bool
+}
+
+// databaseErrorDetails are the details of database errors the driver reported as a conflict or
+// an invalid value, by status.
+var databaseErrorDetails = map[int]string{
+	http.StatusConflict:   "the request conflicts with a concurrent change, try again",
+	http.StatusBadRequest: "the database rejected a value in the request",
+}
+
+// problemFor maps an error to its problem. Database errors and errors of the unavailable,
+// timeout and unknown categories get a generic detail so that driver messages never reach the
+// client.
+func problemFor(err error) problem {
+	var reqErr *requestError
+	var validationErr *repository.ValidationError
+	var patchErr *repository.PatchError
+	var dupErr *repository.DuplicateUserError
+
+	p := problem{code: repository.ErrorCode(err), detail: err.Error()}
+	switch {
+	case errors.As(err, &reqErr):
+		p.status, p.code = reqErr.status, reqErr.code
+	case errors.As(err, &validationErr):
+		p.status = http.StatusUnprocessableEntity
+		p.extensions = gin.H{"fields": validationErr.Fields}
+	case errors.As(err, &patchErr):
+		p.status = http.StatusBadRequest
+		p.extensions = gin.H{
+			"unknown_fields":   patchErr.Unknown,
+			"immutable_fields": patchErr.Immutable,
+			"invalid_fields":   patchErr.Invalid,
+		}
+	case errors.As(err, &dupErr):
+		p.status = http.StatusConflict
+		p.extensions = gin.H{"field": dupErr.Field}
+	case errors.Is(err, repository.ErrVersionMismatch):
+		p.status = http.StatusPreconditionFailed
+		p.detail = "user was modified by another request, reload and try again"
+	case errors.Is(err, repository.ErrDepartmentVersionMismatch):
+		p.status = http.StatusPreconditionFailed
+		p.detail = "department was modified by another request, reload and try again"
+	case errors.Is(err, repository.ErrBulkAborted):
+		p.status = http.StatusFailedDependency
+	case errors.Is(err, jsonpatch.ErrTestFailed):
+		p.status, p.code = http.StatusConflict, "patch_test_failed"
+	case errors.Is(err, jsonpatch.ErrPathNotFound):
+		p.status, p.code = http.StatusUnprocessableEntity, "patch_path_not_found"
+	case errors.Is(err, jsonpatch.ErrInvalidPatch):
+		p.status, p.code = http.StatusBadRequest, "invalid_patch_document"
+	case errors.Is(err, repository.ErrNotFound):
+		p.status = http.StatusNotFound
+	case errors.Is(err, repository.ErrConflict):
+		p.status = http.StatusConflict
+	case errors.Is(err, repository.ErrValidation):
+		p.status = http.StatusBadRequest
+	case errors.Is(err, repository.ErrUnavailable):
+		p.status, p.detail, p.internal = http.StatusServiceUnavailable, "the service is temporarily unavailable, try again later", true
+	case errors.Is(err, repository.ErrTimeout):
+		p.status, p.detail, p.internal = http.StatusGatewayTimeout, "the request took too long, try again later", true
+	default:
+		p.status, p.detail, p.internal = http.StatusInternalServerError, "an unexpected error occurred", true
+	}
+
+	var dbErr *repository.DatabaseError
+	if !p.internal && errors.As(err, &dbErr) {
+		p.detail, p.internal = databaseErrorDetails[p.status], true
+		if p.detail == "" {
+			p.detail = "the database rejected the request"
+		}
+	}
+	return p
+}
+
+// problemDetails renders the last error a handler recorded with c.Error as an RFC 7807
+// application/problem+json response, unless the handler already wrote a response.
+func problemDetails() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		err := c.Errors.Last().Err
+		p := problemFor(err)
+		if p.internal {
+			log.Printf("%s %s failed (request %s): %v", c.Request.Method, c.Request.URL.Path, c.GetString(correlationIDHeader), err)
+		}
+
+		body := gin.H{
+			"type":       "about:blank",
+			"title":      http.StatusText(p.status),
+			"status":     p.status,
+			"detail":     p.detail,
+			"instance":   c.Request.URL.Path,
+			"code":       p.code,
+			"request_id": c.GetString(correlationIDHeader),
+		}
+		for k, v := range p.extensions {
+			body[k] = v
+		}
+
+		data, err := json.Marshal(body)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Data(p.status, problemContentType, data)
+	}
+}
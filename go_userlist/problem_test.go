@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_userlist/repository"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("problemDetails", func() {
+	serve := func(err error) (*httptest.ResponseRecorder, map[string]interface{}) {
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.Use(correlationID(), problemDetails())
+		r.GET("/users/:id", func(c *gin.Context) { c.Error(err) })
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/users/7", nil)
+		req.Header.Set(correlationIDHeader, "req-1")
+		r.ServeHTTP(w, req)
+
+		var body map[string]interface{}
+		Expect(json.Unmarshal(w.Body.Bytes(), &body)).To(Succeed())
+		return w, body
+	}
+
+	It("should render repository errors as problem+json with a stable code and the request id", func() {
+		w, body := serve(repository.ErrUserNotFound)
+
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+		Expect(w.Header().Get("Content-Type")).To(Equal(problemContentType))
+		Expect(body).To(Equal(map[string]interface{}{
+			"type":       "about:blank",
+			"title":      "Not Found",
+			"status":     404.0,
+			"detail":     "user not found",
+			"instance":   "/users/7",
+			"code":       "user_not_found",
+			"request_id": "req-1",
+		}))
+	})
+
+	It("should carry the offending fields of validation and conflict errors", func() {
+		w, body := serve(&repository.ValidationError{Fields: []repository.FieldError{
+			{Field: "email", Code: repository.CodeFormat, Message: "must be a valid email address"},
+		}})
+		Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(body).To(HaveKeyWithValue("code", "invalid_user"))
+		Expect(body["fields"]).To(HaveLen(1))
+
+		w, body = serve(fmt.Errorf("saving: %w", &repository.DuplicateUserError{Field: "email"}))
+		Expect(w.Code).To(Equal(http.StatusConflict))
+		Expect(body).To(HaveKeyWithValue("code", "duplicate_user"))
+		Expect(body).To(HaveKeyWithValue("field", "email"))
+
+		w, _ = serve(repository.ErrVersionMismatch)
+		Expect(w.Code).To(Equal(http.StatusPreconditionFailed))
+	})
+
+	It("should not leak driver messages", func() {
+		w, body := serve(&repository.DatabaseError{Kind: repository.ErrUnavailable, Err: &pq.Error{Message: "password authentication failed for user \"postgres\""}})
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(HaveKeyWithValue("code", "unavailable"))
+		Expect(body["detail"]).NotTo(ContainSubstring("postgres"))
+
+		w, body = serve(&repository.DatabaseError{Kind: repository.ErrValidation, Err: &pq.Error{Code: "22001", Message: "value too long for type character varying(255)"}})
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(body).To(HaveKeyWithValue("code", "validation_failed"))
+		Expect(body["detail"]).NotTo(ContainSubstring("character varying"))
+
+		w, body = serve(fmt.Errorf("updating user: %w", &repository.DatabaseError{Kind: repository.ErrConflict, Err: &pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update"}}))
+		Expect(w.Code).To(Equal(http.StatusConflict))
+		Expect(body).To(HaveKeyWithValue("code", "conflict"))
+		Expect(body["detail"]).NotTo(ContainSubstring("serialize"))
+
+		w, body = serve(errors.New(`pq: relation "public.users" does not exist`))
+		Expect(w.Code).To(Equal(http.StatusInternalServerError))
+		Expect(body).To(HaveKeyWithValue("code", "internal_error"))
+		Expect(body["detail"]).NotTo(ContainSubstring("relation"))
+	})
+
+	It("should use the status and code of request errors", func() {
+		w, body := serve(badRequest("invalid_if_match", `invalid If-Match header "x"`))
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(body).To(HaveKeyWithValue("code", "invalid_if_match"))
+	})
+})
@@ -0,0 +1,320 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Kinds of BulkOperation.
+const (
+	BulkCreate = "create"
+	BulkUpdate = "update"
+	BulkPatch  = "patch"
+	BulkDelete = "delete"
+)
+
+// ErrBulkAborted is the result of every operation of an atomic bulk request other than the one
+// that failed: it was rolled back, or never ran.
+var ErrBulkAborted = newError(ErrConflict, "bulk_aborted", "not applied because another operation of the request failed")
+
+// ErrInvalidBulkOperation is returned for a BulkOperation with an unknown Op.
+var ErrInvalidBulkOperation = newError(ErrValidation, "invalid_bulk_operation", "invalid bulk operation")
+
+// BulkOperation is one change of a bulk request. UserID and Version name the user an update,
+// patch or delete applies to and the version the caller last saw (AnyVersion to skip the check);
+// a create ignores both.
+type BulkOperation struct {
+	Op      string
+	UserID  int
+	Version int
+	// User holds the fields of the user to create, or the new fields of the user to update.
+	User User
+	// Changes holds the fields a patch sets, keyed by json name as for PatchUser.
+	Changes map[string]interface{}
+}
+
+// BulkResult is the outcome of one operation: the user as the operation left it, or the error it
+// failed with. UserID is the id of the user it applied to, which a failed create has none of.
+type BulkResult struct {
+	UserID int
+	User   *User
+	Err    error
+}
+
+// newBulkResults returns results for ops that know only the ids the operations name.
+func newBulkResults(ops []BulkOperation) []BulkResult {
+	results := make([]BulkResult, len(ops))
+	for i, op := range ops {
+		if op.Op != BulkCreate {
+			results[i].UserID = op.UserID
+		}
+	}
+	return results
+}
+
+// BulkOptions controls how a bulk request is applied.
+type BulkOptions struct {
+	// Atomic applies every operation in one transaction, so that either all of them succeed or
+	// none does. Otherwise each runs in its own transaction and a failure affects only its own
+	// result.
+	Atomic bool
+}
+
+// ApplyBulk applies ops in order and returns a result for each. Every operation records the
+// same outbox event its single-user counterpart does. When an atomic request fails, the failed
+// operation carries its error and every other one ErrBulkAborted. The error return is for
+// failures that no single operation caused, such as a commit that fails.
+func (r *PostgresUserRepository) ApplyBulk(ctx context.Context, ops []BulkOperation, opts BulkOptions) ([]BulkResult, error) {
+	return r.applyBulk(ctx, opts, func(dbtx) ([]BulkOperation, error) {
+		return ops, nil
+	})
+}
+
+// PatchMatchingUsers sets changes on every user that passes the filters in filter, in user_id
+// order, as ApplyBulk would with one patch per user. Page, Size, sorting and IncludeDeleted are
+// ignored. An atomic request locks the matching rows before patching them.
+func (r *PostgresUserRepository) PatchMatchingUsers(ctx context.Context, filter ListOptions, changes map[string]interface{}, opts BulkOptions) ([]BulkResult, error) {
+	filter, err := bulkFilter(filter, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	sb := applyListFilters(r.psql.Select("user_id").From("public.users"), filter).OrderBy("user_id")
+	if opts.Atomic {
+		sb = sb.Suffix("FOR UPDATE")
+	}
+	query, args, err := sb.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.applyBulk(ctx, opts, func(q dbtx) ([]BulkOperation, error) {
+		rows, err := q.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var ops []BulkOperation
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			ops = append(ops, BulkOperation{Op: BulkPatch, UserID: id, Version: AnyVersion, Changes: changes})
+		}
+		return ops, rows.Err()
+	})
+}
+
+// bulkFilter checks the changes of a PatchMatchingUsers call and normalizes its filter.
+func bulkFilter(filter ListOptions, changes map[string]interface{}) (ListOptions, error) {
+	if _, err := PatchColumns(changes); err != nil {
+		return ListOptions{}, err
+	}
+	filter.Page, filter.Size = 0, 0
+	filter.SortBy, filter.SortDir = "", ""
+	filter.IncludeDeleted = false
+	return filter.Normalize()
+}
+
+// applyBulk applies the operations list returns. An atomic request calls list inside its
+// transaction, so that rows list reads with FOR UPDATE stay locked until the commit.
+func (r *PostgresUserRepository) applyBulk(ctx context.Context, opts BulkOptions, list func(q dbtx) ([]BulkOperation, error)) ([]BulkResult, error) {
+	if !opts.Atomic {
+		ops, err := list(r.db)
+		if err != nil {
+			return nil, wrapDBError(err)
+		}
+		results := newBulkResults(ops)
+		for i, op := range ops {
+			var user *User
+			err := r.withTx(ctx, func(tx *sql.Tx) error {
+				var err error
+				user, err = r.applyInTx(ctx, tx, op)
+				return err
+			})
+			results[i].setOutcome(user, err)
+		}
+		return results, nil
+	}
+
+	var ops []BulkOperation
+	var results []BulkResult
+	failed := -1
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		ops, err = list(tx)
+		if err != nil {
+			return err
+		}
+		results = newBulkResults(ops)
+		for i, op := range ops {
+			user, err := r.applyInTx(ctx, tx, op)
+			if err != nil {
+				failed = i
+				return err
+			}
+			results[i].setOutcome(user, nil)
+		}
+		return nil
+	})
+	if failed >= 0 {
+		return abortBulk(ops, failed, err), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// applyInTx applies one operation inside tx and returns the user as it left it.
+func (r *PostgresUserRepository) applyInTx(ctx context.Context, tx *sql.Tx, op BulkOperation) (*User, error) {
+	switch op.Op {
+	case BulkCreate:
+		user := op.User
+		user.Deleted_at = nil
+		if err := r.createInTx(ctx, tx, &user); err != nil {
+			return nil, err
+		}
+		return &user, nil
+	case BulkUpdate:
+		user := op.User
+		user.User_id, user.Version, user.Deleted_at = op.UserID, op.Version, nil
+		if err := r.updateInTx(ctx, tx, &user); err != nil {
+			return nil, err
+		}
+		return &user, nil
+	case BulkPatch:
+		columns, err := PatchColumns(op.Changes)
+		if err != nil {
+			return nil, err
+		}
+		return r.patchInTx(ctx, tx, op.UserID, op.Version, columns)
+	case BulkDelete:
+		return r.deleteInTx(ctx, tx, op.UserID, op.Version)
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidBulkOperation, op.Op)
+	}
+}
+
+// setOutcome records the user an operation returned, or the error it failed with.
+func (r *BulkResult) setOutcome(user *User, err error) {
+	if err != nil {
+		r.Err = err
+		return
+	}
+	r.User, r.UserID = user, user.User_id
+}
+
+// abortBulk turns the results of a failed atomic request into err for the operation that failed
+// and ErrBulkAborted for all others. Users created before the failure were rolled back, so their
+// ids go too.
+func abortBulk(ops []BulkOperation, failed int, err error) []BulkResult {
+	results := newBulkResults(ops)
+	for i := range results {
+		results[i].Err = ErrBulkAborted
+	}
+	results[failed].Err = err
+	return results
+}
+
+// ApplyBulk applies ops with the same rules and results as PostgresUserRepository.ApplyBulk.
+// An atomic request that fails puts back the users as they were before it started.
+func (r *MemoryUserRepository) ApplyBulk(ctx context.Context, ops []BulkOperation, opts BulkOptions) ([]BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.applyBulkLocked(ops, opts), nil
+}
+
+// PatchMatchingUsers sets changes on every matching user, as
+// PostgresUserRepository.PatchMatchingUsers does.
+func (r *MemoryUserRepository) PatchMatchingUsers(ctx context.Context, filter ListOptions, changes map[string]interface{}, opts BulkOptions) ([]BulkResult, error) {
+	filter, err := bulkFilter(filter, changes)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ops []BulkOperation
+	for _, u := range r.matching(filter) {
+		ops = append(ops, BulkOperation{Op: BulkPatch, UserID: u.User_id, Version: AnyVersion, Changes: changes})
+	}
+	return r.applyBulkLocked(ops, opts), nil
+}
+
+// applyBulkLocked applies ops in order. An atomic request works on a copy of the users, which
+// only replaces them once every operation succeeded. The caller holds r.mu.
+func (r *MemoryUserRepository) applyBulkLocked(ops []BulkOperation, opts BulkOptions) []BulkResult {
+	users, nextID := r.users, r.nextID
+	if opts.Atomic {
+		r.users = make(map[int]*User, len(users))
+		for id, u := range users {
+			copied := *u
+			r.users[id] = &copied
+		}
+	}
+
+	results := newBulkResults(ops)
+	for i, op := range ops {
+		user, err := r.applyLocked(op)
+		if err != nil && opts.Atomic {
+			r.users, r.nextID = users, nextID
+			return abortBulk(ops, i, err)
+		}
+		results[i].setOutcome(user, err)
+	}
+	return results
+}
+
+// applyLocked applies one operation and returns a copy of the user as it left it. The caller
+// holds r.mu.
+func (r *MemoryUserRepository) applyLocked(op BulkOperation) (*User, error) {
+	var stored *User
+	switch op.Op {
+	case BulkCreate:
+		user := op.User
+		if err := r.createLocked(&user); err != nil {
+			return nil, err
+		}
+		stored = r.users[user.User_id]
+	case BulkUpdate:
+		user := op.User
+		user.User_id, user.Version = op.UserID, op.Version
+		if err := r.updateLocked(&user); err != nil {
+			return nil, err
+		}
+		stored = r.users[user.User_id]
+	case BulkPatch:
+		columns, err := PatchColumns(op.Changes)
+		if err != nil {
+			return nil, err
+		}
+		if stored, err = r.lookup(op.UserID, false); err != nil {
+			return nil, err
+		}
+		if err := checkVersion(stored, op.Version); err != nil {
+			return nil, err
+		}
+		if err := r.patchLocked(stored, columns); err != nil {
+			return nil, err
+		}
+	case BulkDelete:
+		var err error
+		if stored, err = r.deleteLocked(op.UserID, op.Version); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidBulkOperation, op.Op)
+	}
+	user := *stored
+	return &user, nil
+}
@@ -0,0 +1,34 @@
+package repository_test
+
+import (
+	"database/sql"
+	"go_userlist/repository"
+	"go_userlist/repository/repositorytest"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = repositorytest.DescribeConformance("MemoryUserRepository", func() repository.UserRepository {
+	return repository.NewMemoryUserRepository()
+})
+
+// The Postgres run needs a throwaway database with usertable_create.sql and
+// outboxtable_create.sql applied; every spec starts by truncating the tables.
+var _ = repositorytest.DescribeConformance("PostgresUserRepository", func() repository.UserRepository {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	Expect(err).NotTo(HaveOccurred())
+	_, err = db.Exec("TRUNCATE public.users, public.departments, public.user_outbox RESTART IDENTITY")
+	Expect(err).NotTo(HaveOccurred())
+
+	repo, err := repository.NewPostgresUserRepository(db)
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(repo.Close)
+	return repo
+})
@@ -0,0 +1,45 @@
+package repository
+
+// ErrDuplicateUser is returned (wrapped in a *DuplicateUserError) when a user_name or email is
+// already taken by another user, compared case-insensitively.
+var ErrDuplicateUser = newError(ErrConflict, "duplicate_user", "user already exists")
+
+// SQLSTATEs Postgres reports for constraint violations.
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+// uniqueConstraintFields maps the unique indexes on public.users to the json field they guard.
+var uniqueConstraintFields = map[string]string{
+	"users_user_name_key": "user_name",
+	"users_email_key":     "email",
+}
+
+// departmentNameConstraints are the unique constraint and index on public.departments.name.
+var departmentNameConstraints = map[string]bool{
+	"departments_name_key":       true,
+	"departments_lower_name_key": true,
+}
+
+// departmentReference is the foreign key from public.users.department to public.departments.
+const departmentReference = "users_department_fkey"
+
+// errUnknownDepartment is returned when a user names a department that does not exist.
+func errUnknownDepartment() error {
+	return &ValidationError{Fields: []FieldError{{Field: "department", Code: CodeReference, Message: "must name an existing department"}}}
+}
+
+// DuplicateUserError names the field whose value another user already has.
+type DuplicateUserError struct {
+	Field string `json:"field"`
+}
+
+func (e *DuplicateUserError) Error() string {
+	return ErrDuplicateUser.Error() + ": " + e.Field + " is already taken"
+}
+
+// Unwrap lets errors.Is match ErrDuplicateUser.
+func (e *DuplicateUserError) Unwrap() error {
+	return ErrDuplicateUser
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// cursor is the decoded form of the opaque keyset cursor handed to clients.
+// It records the ordering it was issued for and the sort key of the last row returned,
+// so the next page can resume strictly after that row regardless of inserts or deletes.
+type cursor struct {
+	SortBy  string `json:"s"`
+	SortDir string `json:"d"`
+	Key     string `json:"k,omitempty"`
+	UserID  int    `json:"id"`
+}
+
+// encodeCursor returns the opaque string form of c.
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses an opaque cursor and checks it was issued for the ordering in opts.
+func decodeCursor(s string, opts ListOptions) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("%w: malformed cursor", ErrInvalidListOptions)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%w: malformed cursor", ErrInvalidListOptions)
+	}
+	if c.SortBy != opts.SortBy || c.SortDir != opts.SortDir {
+		return c, fmt.Errorf("%w: cursor was issued for a different sort order", ErrInvalidListOptions)
+	}
+	return c, nil
+}
+
+// cursorAfter returns the cursor pointing just past user for the ordering in opts.
+func cursorAfter(user User, opts ListOptions) string {
+	c := cursor{SortBy: opts.SortBy, SortDir: opts.SortDir, UserID: user.User_id}
+	if opts.SortBy != "user_id" {
+		c.Key = sortKey(user, opts.SortBy)
+	}
+	return encodeCursor(c)
+}
+
+// sortKey returns the value of the sortable column for user as a string.
+func sortKey(user User, column string) string {
+	if f, ok := lookupColumn(column); ok {
+		return fmt.Sprint(f.get(&user))
+	}
+	return ""
+}
@@ -0,0 +1,426 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Masterminds/squirrel"
+)
+
+// Department is a department users belong to. Users reference it by name, so renaming a
+// department moves its users along.
+type Department struct {
+	Department_id int    `json:"department_id"`
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	Version       int    `json:"version"` // incremented on every change, used for optimistic concurrency
+}
+
+// DepartmentRepository stores departments. Every method stops waiting on the database once ctx
+// is done and returns its error.
+type DepartmentRepository interface {
+	CreateDepartment(ctx context.Context, department *Department) error
+	GetDepartmentByID(ctx context.Context, departmentID int) (*Department, error)
+	ListDepartments(ctx context.Context) ([]Department, error)
+	UpdateDepartment(ctx context.Context, department *Department) error
+	DeleteDepartmentByID(ctx context.Context, departmentID int, expectedVersion int) error
+}
+
+// Ensure PostgresUserRepository implements DepartmentRepository
+var _ DepartmentRepository = &PostgresUserRepository{}
+
+// Department errors, matched with errors.Is.
+var (
+	ErrDepartmentNotFound        = newError(ErrNotFound, "department_not_found", "department not found")
+	ErrDuplicateDepartment       = newError(ErrConflict, "duplicate_department", "a department with this name already exists")
+	ErrDepartmentInUse           = newError(ErrConflict, "department_in_use", "department still has users")
+	ErrDepartmentVersionMismatch = newError(ErrConflict, "version_mismatch", "department version mismatch")
+)
+
+const (
+	// MaxDepartmentNameLength matches the VARCHAR limit of departments.name and users.department.
+	MaxDepartmentNameLength = 255
+	// MaxDepartmentDescriptionLength matches the VARCHAR limit of departments.description.
+	MaxDepartmentDescriptionLength = 1000
+)
+
+// ValidateDepartment checks the name and description of department and reports all failures
+// together in a *ValidationError with the code "invalid_department".
+func ValidateDepartment(department *Department) error {
+	verr := &ValidationError{Code: "invalid_department"}
+	fail := func(field, code, message string) {
+		verr.Fields = append(verr.Fields, FieldError{Field: field, Code: code, Message: message})
+	}
+
+	switch name := department.Name; {
+	case strings.TrimSpace(name) == "":
+		fail("name", CodeRequired, "must not be empty")
+	case utf8.RuneCountInString(name) > MaxDepartmentNameLength:
+		fail("name", CodeMaxLength, fmt.Sprintf("must be at most %d characters", MaxDepartmentNameLength))
+	case strings.TrimSpace(name) != name:
+		fail("name", CodeFormat, "must not start or end with spaces")
+	}
+	if utf8.RuneCountInString(department.Description) > MaxDepartmentDescriptionLength {
+		fail("description", CodeMaxLength, fmt.Sprintf("must be at most %d characters", MaxDepartmentDescriptionLength))
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// checkDepartmentVersion returns ErrDepartmentVersionMismatch unless current is at the expected
+// version.
+func checkDepartmentVersion(current *Department, expectedVersion int) error {
+	if expectedVersion != AnyVersion && current.Version != expectedVersion {
+		return ErrDepartmentVersionMismatch
+	}
+	return nil
+}
+
+// departmentColumns are the columns of public.departments in the order scanDepartment expects.
+var departmentColumns = []string{"department_id", "name", "description", "version"}
+
+// scanDepartment reads one row selected with departmentColumns into a Department.
+func scanDepartment(row rowScanner) (Department, error) {
+	var d Department
+	err := row.Scan(&d.Department_id, &d.Name, &d.Description, &d.Version)
+	return d, err
+}
+
+// CreateDepartment inserts a new department, sets the id and version the database assigned and
+// records a create event in the outbox.
+func (r *PostgresUserRepository) CreateDepartment(ctx context.Context, department *Department) error {
+	query, args, err := r.psql.Insert("public.departments").
+		Columns("name", "description").
+		Values(department.Name, department.Description).
+		Suffix("RETURNING department_id, version").ToSql()
+	if err != nil {
+		return err
+	}
+
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&department.Department_id, &department.Version); err != nil {
+			return err
+		}
+		return r.enqueueEvent(ctx, tx, EventDepartmentCreated, department.Department_id, department, nil)
+	})
+}
+
+// GetDepartmentByID fetches a department by its ID.
+func (r *PostgresUserRepository) GetDepartmentByID(ctx context.Context, departmentID int) (*Department, error) {
+	return r.queryDepartment(ctx, r.db, r.selectDepartmentByID(departmentID))
+}
+
+// selectDepartmentByID selects the department with the given ID.
+func (r *PostgresUserRepository) selectDepartmentByID(departmentID int) squirrel.SelectBuilder {
+	return r.psql.Select(departmentColumns...).
+		From("public.departments").
+		Where(squirrel.Eq{"department_id": departmentID})
+}
+
+// queryDepartment runs a single-row department query, translating no rows into
+// ErrDepartmentNotFound.
+func (r *PostgresUserRepository) queryDepartment(ctx context.Context, q dbtx, sb squirrel.SelectBuilder) (*Department, error) {
+	query, args, err := sb.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	department, err := scanDepartment(q.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrDepartmentNotFound
+		}
+		return nil, wrapDBError(err)
+	}
+	return &department, nil
+}
+
+// ListDepartments fetches every department, ordered by name.
+func (r *PostgresUserRepository) ListDepartments(ctx context.Context) ([]Department, error) {
+	query, args, err := r.psql.Select(departmentColumns...).
+		From("public.departments").
+		OrderBy("name", "department_id").ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapDBError(err)
+	}
+	defer rows.Close()
+
+	departments := []Department{}
+	for rows.Next() {
+		department, err := scanDepartment(rows)
+		if err != nil {
+			return nil, wrapDBError(err)
+		}
+		departments = append(departments, department)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	return departments, nil
+}
+
+// UpdateDepartment replaces the name and description of a department and records an update
+// event in the outbox. department.Version is the version the caller last saw (AnyVersion to
+// overwrite unconditionally); on success it is set to the new version. A rename cascades to the
+// department's users, soft deleted ones included: each gets a new version and a user.updated
+// event, as if it had been patched.
+func (r *PostgresUserRepository) UpdateDepartment(ctx context.Context, department *Department) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := r.queryDepartment(ctx, tx, r.selectDepartmentByID(department.Department_id).Suffix("FOR UPDATE"))
+		if err != nil {
+			return err
+		}
+		if err := checkDepartmentVersion(before, department.Version); err != nil {
+			return err
+		}
+
+		query, args, err := r.psql.Update("public.departments").
+			Set("name", department.Name).
+			Set("description", department.Description).
+			Set("version", squirrel.Expr("version + 1")).
+			Where(squirrel.Eq{"department_id": department.Department_id}).
+			Suffix("RETURNING version").ToSql()
+		if err != nil {
+			return err
+		}
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&department.Version); err != nil {
+			return err
+		}
+
+		if department.Name != before.Name {
+			if err := r.renameMembers(ctx, tx, before.Name, department.Name); err != nil {
+				return err
+			}
+		}
+		if department.Name == before.Name && department.Description == before.Description {
+			return nil
+		}
+		return r.enqueueEvent(ctx, tx, EventDepartmentUpdated, department.Department_id, department, before)
+	})
+}
+
+// renameMembers bumps the version of every user a department rename cascaded to and records
+// their update events.
+func (r *PostgresUserRepository) renameMembers(ctx context.Context, tx *sql.Tx, oldName, newName string) error {
+	query, args, err := r.psql.Update("public.users").
+		Set("version", squirrel.Expr("version + 1")).
+		Where(squirrel.Eq{"department": newName}).
+		Suffix("RETURNING " + strings.Join(userColumns, ", ")).ToSql()
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	var members []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		members = append(members, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// As in PurgeDeletedUsers, the outbox inserts wait until the rows are drained.
+	for i := range members {
+		before := members[i]
+		before.Department, before.Version = oldName, before.Version-1
+		if err := r.enqueueUpdate(ctx, tx, &before, &members[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDepartmentByID deletes a department and records a delete event in the outbox. It fails
+// with ErrDepartmentInUse while any user, soft deleted or not, belongs to the department.
+// expectedVersion guards against deleting a department that changed since the caller last saw it.
+func (r *PostgresUserRepository) DeleteDepartmentByID(ctx context.Context, departmentID int, expectedVersion int) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		// Locking the row also holds off users being added to it until the delete commits.
+		department, err := r.queryDepartment(ctx, tx, r.selectDepartmentByID(departmentID).Suffix("FOR UPDATE"))
+		if err != nil {
+			return err
+		}
+		if err := checkDepartmentVersion(department, expectedVersion); err != nil {
+			return err
+		}
+
+		countQuery, countArgs, err := r.psql.Select("count(*)").
+			From("public.users").
+			Where(squirrel.Eq{"department": department.Name}).ToSql()
+		if err != nil {
+			return err
+		}
+		var members int
+		if err := tx.QueryRowContext(ctx, countQuery, countArgs...).Scan(&members); err != nil {
+			return err
+		}
+		if members > 0 {
+			return fmt.Errorf("%w: %d users, soft deleted ones included, belong to it", ErrDepartmentInUse, members)
+		}
+
+		query, args, err := r.psql.Delete("public.departments").
+			Where(squirrel.Eq{"department_id": departmentID}).ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		return r.enqueueEvent(ctx, tx, EventDepartmentDeleted, department.Department_id, department, nil)
+	})
+}
+
+// CreateDepartment stores a new department, assigning its id and version.
+func (r *MemoryUserRepository) CreateDepartment(ctx context.Context, department *Department) error {
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing := r.lookupDepartmentByName(department.Name); existing != nil {
+		return ErrDuplicateDepartment
+	}
+	created := *department
+	created.Department_id = r.nextDepartmentID
+	created.Version = 1
+	r.nextDepartmentID++
+	r.departments[created.Department_id] = &created
+
+	department.Department_id, department.Version = created.Department_id, created.Version
+	return nil
+}
+
+// GetDepartmentByID returns the department with the given id.
+func (r *MemoryUserRepository) GetDepartmentByID(ctx context.Context, departmentID int) (*Department, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored, ok := r.departments[departmentID]
+	if !ok {
+		return nil, ErrDepartmentNotFound
+	}
+	department := *stored
+	return &department, nil
+}
+
+// ListDepartments returns every department, ordered by name.
+func (r *MemoryUserRepository) ListDepartments(ctx context.Context) ([]Department, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	departments := []Department{}
+	for _, d := range r.departments {
+		departments = append(departments, *d)
+	}
+	sort.Slice(departments, func(i, j int) bool {
+		if departments[i].Name != departments[j].Name {
+			return departments[i].Name < departments[j].Name
+		}
+		return departments[i].Department_id < departments[j].Department_id
+	})
+	return departments, nil
+}
+
+// UpdateDepartment replaces the name and description of a department, renaming it for its users
+// as PostgresUserRepository.UpdateDepartment does.
+func (r *MemoryUserRepository) UpdateDepartment(ctx context.Context, department *Department) error {
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.departments[department.Department_id]
+	if !ok {
+		return ErrDepartmentNotFound
+	}
+	if err := checkDepartmentVersion(stored, department.Version); err != nil {
+		return err
+	}
+	if existing := r.lookupDepartmentByName(department.Name); existing != nil && existing != stored {
+		return ErrDuplicateDepartment
+	}
+
+	if department.Name != stored.Name {
+		for _, u := range r.users {
+			if u.Department == stored.Name {
+				u.Department = department.Name
+				u.Version++
+			}
+		}
+	}
+	stored.Name = department.Name
+	stored.Description = department.Description
+	stored.Version++
+
+	department.Version = stored.Version
+	return nil
+}
+
+// DeleteDepartmentByID deletes a department that no user, soft deleted or not, belongs to.
+func (r *MemoryUserRepository) DeleteDepartmentByID(ctx context.Context, departmentID int, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.departments[departmentID]
+	if !ok {
+		return ErrDepartmentNotFound
+	}
+	if err := checkDepartmentVersion(stored, expectedVersion); err != nil {
+		return err
+	}
+
+	members := 0
+	for _, u := range r.users {
+		if u.Department == stored.Name {
+			members++
+		}
+	}
+	if members > 0 {
+		return fmt.Errorf("%w: %d users, soft deleted ones included, belong to it", ErrDepartmentInUse, members)
+	}
+	delete(r.departments, departmentID)
+	return nil
+}
+
+// lookupDepartmentByName returns the stored department whose name equals name regardless of
+// case, or nil. The caller holds r.mu.
+func (r *MemoryUserRepository) lookupDepartmentByName(name string) *Department {
+	for _, d := range r.departments {
+		if strings.EqualFold(d.Name, name) {
+			return d
+		}
+	}
+	return nil
+}
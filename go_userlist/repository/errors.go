@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// Error categories. Every error the repository returns on purpose matches one of these with
+// errors.Is, so callers can react to the category without knowing each specific error.
+var (
+	// ErrNotFound means the requested user or department does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means the request clashes with the current state of the data.
+	ErrConflict = errors.New("conflict")
+	// ErrValidation means the request itself is invalid.
+	ErrValidation = errors.New("validation failed")
+	// ErrUnavailable means the database or another dependency cannot be reached.
+	ErrUnavailable = errors.New("service unavailable")
+	// ErrTimeout means the operation did not finish in time.
+	ErrTimeout = errors.New("timeout")
+)
+
+// Error is a specific repository error with a stable, machine-readable code. Its category is
+// matched by errors.Is through Unwrap.
+type Error struct {
+	Code    string
+	Message string
+	Kind    error
+}
+
+// newError returns a specific error of the given category.
+func newError(kind error, code, message string) error {
+	return &Error{Code: code, Message: message, Kind: kind}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error's category.
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// ErrorCode returns the error's stable code.
+func (e *Error) ErrorCode() string {
+	return e.Code
+}
+
+// categoryCodes are the codes of errors that only carry a category.
+var categoryCodes = []struct {
+	kind error
+	code string
+}{
+	{ErrNotFound, "not_found"},
+	{ErrConflict, "conflict"},
+	{ErrValidation, "validation_failed"},
+	{ErrUnavailable, "unavailable"},
+	{ErrTimeout, "timeout"},
+}
+
+// ErrorCode returns the stable code of err: the code of the most specific repository error in
+// its chain, the code of its category, or "internal_error" for unexpected errors.
+func ErrorCode(err error) string {
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	for _, c := range categoryCodes {
+		if errors.Is(err, c.kind) {
+			return c.code
+		}
+	}
+	return "internal_error"
+}
+
+// DatabaseError is a driver error classified into one of the categories. Error includes the
+// driver's message, which is meant for logs rather than clients.
+type DatabaseError struct {
+	Kind error
+	Err  error
+}
+
+func (e *DatabaseError) Error() string {
+	return "database " + e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns both the category and the driver error.
+func (e *DatabaseError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// wrapDBError classifies a driver error: unique violations on the users table become a
+// *DuplicateUserError, those on department names ErrDuplicateDepartment, users naming a missing
+// department a *ValidationError and other recognised failures a *DatabaseError. Errors that
+// already have a category, and errors it does not recognise, are returned unchanged.
+func wrapDBError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, c := range categoryCodes {
+		if errors.Is(err, c.kind) {
+			return err
+		}
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == uniqueViolation && departmentNameConstraints[pqErr.Constraint]:
+			return ErrDuplicateDepartment
+		case pqErr.Code == uniqueViolation && uniqueConstraintFields[pqErr.Constraint] != "":
+			return &DuplicateUserError{Field: uniqueConstraintFields[pqErr.Constraint]}
+		case pqErr.Code == foreignKeyViolation && pqErr.Constraint == departmentReference:
+			return errUnknownDepartment()
+		}
+	}
+	if kind := dbErrorKind(err); kind != nil {
+		return &DatabaseError{Kind: kind, Err: err}
+	}
+	return err
+}
+
+// dbErrorKind returns the category of a driver error, or nil if it is not recognised.
+func dbErrorKind(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "23502", "23514": // not_null_violation, check_violation
+			return ErrValidation
+		case "40001", "40P01": // serialization_failure, deadlock_detected
+			return ErrConflict
+		case "57014": // query_canceled, raised by statement_timeout
+			return ErrTimeout
+		case "57P01", "57P02", "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+			return ErrUnavailable
+		}
+		switch pqErr.Code.Class() {
+		case "22": // data_exception
+			return ErrValidation
+		case "23": // integrity_constraint_violation
+			return ErrConflict
+		case "08", "53": // connection_exception, insufficient_resources
+			return ErrUnavailable
+		}
+		return nil
+	}
+
+	// A cancelled context usually means the client went away before the query finished.
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ErrTimeout
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return ErrUnavailable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrTimeout
+		}
+		return ErrUnavailable
+	}
+	return nil
+}
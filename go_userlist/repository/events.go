@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// EventSchemaVersion is the version of EventEnvelope written by this service. It is bumped
+// whenever the envelope or a payload changes in a way consumers must know about.
+const EventSchemaVersion = 1
+
+// Event types carried in EventEnvelope.Type.
+const (
+	EventUserCreated  = "user.created"
+	EventUserUpdated  = "user.updated"
+	EventUserDeleted  = "user.deleted"
+	EventUserRestored = "user.restored"
+	EventUserPurged   = "user.purged"
+
+	EventDepartmentCreated = "department.created"
+	EventDepartmentUpdated = "department.updated"
+	EventDepartmentDeleted = "department.deleted"
+)
+
+// eventTopics maps each event type to the Kafka topic it is published on.
+var eventTopics = map[string]string{
+	EventUserCreated:  TopicUserCreate,
+	EventUserUpdated:  TopicUserUpdate,
+	EventUserDeleted:  TopicUserDelete,
+	EventUserRestored: TopicUserRestore,
+	EventUserPurged:   TopicUserPurge,
+
+	EventDepartmentCreated: TopicDepartmentCreate,
+	EventDepartmentUpdated: TopicDepartmentUpdate,
+	EventDepartmentDeleted: TopicDepartmentDelete,
+}
+
+// EventEnvelope wraps every message published on the prism-user-* and prism-department-*
+// topics. Messages are keyed by the decimal user_id, or department_id, so all events for one user
+// or department land on one partition, in order.
+//
+//	user.created       payload: the created User
+//	user.updated       payload: UserUpdate with the changed fields; previous: the User before the update
+//	user.deleted       payload: the soft deleted User, with deleted_at set
+//	user.restored      payload: the restored User
+//	user.purged        payload: the User as it was when permanently removed
+//	department.created payload: the created Department
+//	department.updated payload: the Department after the update; previous: the Department before it
+//	department.deleted payload: the Department as it was when deleted
+type EventEnvelope struct {
+	EventID       string      `json:"event_id"`
+	Type          string      `json:"type"`
+	SchemaVersion int         `json:"schema_version"`
+	OccurredAt    time.Time   `json:"occurred_at"`
+	Actor         string      `json:"actor,omitempty"`
+	CorrelationID string      `json:"correlation_id,omitempty"`
+	Payload       interface{} `json:"payload"`
+	Previous      interface{} `json:"previous,omitempty"`
+}
+
+// EventMetadata identifies who caused a change and which request it belongs to.
+type EventMetadata struct {
+	Actor         string
+	CorrelationID string
+}
+
+// eventMetadataKey is the context key EventMetadata is stored under.
+type eventMetadataKey struct{}
+
+// WithEventMetadata returns a copy of ctx carrying meta, which the repository stamps on every
+// event it records on behalf of ctx.
+func WithEventMetadata(ctx context.Context, meta EventMetadata) context.Context {
+	return context.WithValue(ctx, eventMetadataKey{}, meta)
+}
+
+// EventMetadataFromContext returns the EventMetadata attached to ctx, or the zero value if there is none.
+func EventMetadataFromContext(ctx context.Context) EventMetadata {
+	meta, _ := ctx.Value(eventMetadataKey{}).(EventMetadata)
+	return meta
+}
+
+// newEventEnvelope returns an envelope with a fresh event id for an event of the given type.
+func newEventEnvelope(eventType string, meta EventMetadata, payload, previous interface{}) EventEnvelope {
+	return EventEnvelope{
+		EventID:       NewEventID(),
+		Type:          eventType,
+		SchemaVersion: EventSchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		Actor:         meta.Actor,
+		CorrelationID: meta.CorrelationID,
+		Payload:       payload,
+		Previous:      previous,
+	}
+}
+
+// NewEventID returns a random (version 4) UUID.
+func NewEventID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("error generating event id: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// FieldChange holds the value of one user field before and after an update.
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// UserUpdate is the payload of a prism-user-update event: the id of the updated user
+// and the before/after values of the fields that actually changed, keyed by json name.
+type UserUpdate struct {
+	User_id int                    `json:"user_id"`
+	Changes map[string]FieldChange `json:"changes"`
+}
+
+// diffUsers returns the fields whose values differ between before and after, keyed by json name.
+func diffUsers(before, after *User) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	for _, f := range userFields {
+		if f.Immutable {
+			continue
+		}
+		b, a := f.get(before), f.get(after)
+		if !reflect.DeepEqual(b, a) {
+			changes[f.JSONName] = FieldChange{Before: b, After: a}
+		}
+	}
+	return changes
+}
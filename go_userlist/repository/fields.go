@@ -0,0 +1,228 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidPatch is returned (wrapped in a *PatchError) when a partial update names unknown or
+// immutable fields or carries values of the wrong type.
+var ErrInvalidPatch = newError(ErrValidation, "invalid_patch", "invalid patch")
+
+// Field describes one attribute of a User: its json name, the column it is stored in and the
+// constraints a value must satisfy. userFields is the single registry the rest of the package
+// consults when it needs to go from json names to columns or values.
+type Field struct {
+	JSONName    string
+	Column      string
+	Immutable   bool // maintained by the database, never patched
+	Sortable    bool
+	Searchable  bool // part of the document SearchUsers matches
+	Suggestable bool // offered by SuggestValues
+	MaxLength   int  // maximum length in characters, matching the VARCHAR limit
+	Required    bool
+
+	// Declarative constraints on non-empty values, checked by validate.
+	Format      string         // a named format such as FormatEmail
+	Pattern     *regexp.Regexp // the value must match in full
+	PatternHint string         // what Pattern allows, reported when it does not match
+	OneOf       []string       // the allowed values
+
+	get func(u *User) interface{}
+	set func(u *User, v string) // nil for immutable fields
+}
+
+// userFields lists every User field in column order.
+var userFields = []Field{
+	{JSONName: "user_id", Column: "user_id", Immutable: true, Sortable: true,
+		get: func(u *User) interface{} { return u.User_id }},
+	{JSONName: "user_name", Column: "user_name", Sortable: true, Searchable: true, Suggestable: true, MaxLength: 50, Required: true,
+		Pattern: userNamePattern, PatternHint: "letters, digits, '.', '_' and '-'",
+		get: func(u *User) interface{} { return u.User_name },
+		set: func(u *User, v string) { u.User_name = v }},
+	{JSONName: "first_name", Column: "first_name", Sortable: true, Searchable: true, MaxLength: 255,
+		get: func(u *User) interface{} { return u.First_name },
+		set: func(u *User, v string) { u.First_name = v }},
+	{JSONName: "last_name", Column: "last_name", Sortable: true, Searchable: true, MaxLength: 255,
+		get: func(u *User) interface{} { return u.Last_name },
+		set: func(u *User, v string) { u.Last_name = v }},
+	{JSONName: "email", Column: "email", Sortable: true, Searchable: true, MaxLength: 255, Required: true, Format: FormatEmail,
+		get: func(u *User) interface{} { return u.Email },
+		set: func(u *User, v string) { u.Email = v }},
+	{JSONName: "user_status", Column: "user_status", Sortable: true, MaxLength: 1, OneOf: UserStatuses,
+		get: func(u *User) interface{} { return u.User_status },
+		set: func(u *User, v string) { u.User_status = v }},
+	{JSONName: "department", Column: "department", Sortable: true, Searchable: true, Suggestable: true, MaxLength: 255,
+		get: func(u *User) interface{} { return u.Department },
+		set: func(u *User, v string) { u.Department = v }},
+	{JSONName: "version", Column: "version", Immutable: true,
+		get: func(u *User) interface{} { return u.Version }},
+	{JSONName: "deleted_at", Column: "deleted_at", Immutable: true,
+		get: func(u *User) interface{} { return u.Deleted_at }},
+}
+
+// fieldColumns returns the columns of all registered fields in order.
+func fieldColumns() []string {
+	columns := make([]string, len(userFields))
+	for i, f := range userFields {
+		columns[i] = f.Column
+	}
+	return columns
+}
+
+// Fields returns every registered field in column order.
+func Fields() []Field {
+	return append([]Field(nil), userFields...)
+}
+
+// Value returns the field's value on user.
+func (f Field) Value(u *User) interface{} {
+	return f.get(u)
+}
+
+// LookupField returns the registered field with the given json name.
+func LookupField(jsonName string) (Field, bool) {
+	for _, f := range userFields {
+		if f.JSONName == jsonName {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// lookupColumn returns the registered field stored in the given column.
+func lookupColumn(column string) (Field, bool) {
+	for _, f := range userFields {
+		if f.Column == column {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// coerce converts a decoded JSON value to the Go type of the field and checks its constraints.
+// All patchable fields are strings; null clears a field that is not required.
+func (f Field) coerce(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		if f.Required {
+			return nil, errors.New("must not be null")
+		}
+		return "", nil
+	case string:
+		if ferr := f.validate(v); ferr != nil {
+			return nil, ferr
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("must be a string, got %T", value)
+	}
+}
+
+// PatchError lists everything wrong with a partial update.
+type PatchError struct {
+	Unknown   []string          `json:"unknown_fields,omitempty"`
+	Immutable []string          `json:"immutable_fields,omitempty"`
+	Invalid   map[string]string `json:"invalid_fields,omitempty"`
+	Empty     bool              `json:"-"`
+}
+
+func (e *PatchError) Error() string {
+	var parts []string
+	if e.Empty {
+		parts = append(parts, "no fields to update")
+	}
+	if len(e.Unknown) > 0 {
+		parts = append(parts, "unknown fields: "+strings.Join(e.Unknown, ", "))
+	}
+	if len(e.Immutable) > 0 {
+		parts = append(parts, "immutable fields: "+strings.Join(e.Immutable, ", "))
+	}
+	if len(e.Invalid) > 0 {
+		names := make([]string, 0, len(e.Invalid))
+		for name := range e.Invalid {
+			names = append(names, name+" "+e.Invalid[name])
+		}
+		sort.Strings(names)
+		parts = append(parts, "invalid fields: "+strings.Join(names, "; "))
+	}
+	return ErrInvalidPatch.Error() + ": " + strings.Join(parts, "; ")
+}
+
+// Unwrap lets errors.Is match ErrInvalidPatch.
+func (e *PatchError) Unwrap() error {
+	return ErrInvalidPatch
+}
+
+// PatchColumns validates a partial update keyed by json field names and returns the values
+// keyed by column, converted to the field types. Unknown or immutable fields and bad values
+// are reported together in a *PatchError.
+func PatchColumns(updates map[string]interface{}) (map[string]interface{}, error) {
+	perr := &PatchError{Empty: len(updates) == 0}
+	columns := make(map[string]interface{}, len(updates))
+
+	for name, value := range updates {
+		field, ok := LookupField(name)
+		switch {
+		case !ok:
+			perr.Unknown = append(perr.Unknown, name)
+		case field.Immutable:
+			perr.Immutable = append(perr.Immutable, name)
+		default:
+			v, err := field.coerce(value)
+			if err != nil {
+				if perr.Invalid == nil {
+					perr.Invalid = map[string]string{}
+				}
+				perr.Invalid[name] = err.Error()
+				continue
+			}
+			columns[field.Column] = v
+		}
+	}
+
+	if perr.Empty || len(perr.Unknown) > 0 || len(perr.Immutable) > 0 || len(perr.Invalid) > 0 {
+		sort.Strings(perr.Unknown)
+		sort.Strings(perr.Immutable)
+		return nil, perr
+	}
+	return columns, nil
+}
+
+// UserFromFields builds a new user from values keyed by json field name, such as one record of
+// an import file. Unknown, immutable and non-string fields are reported together in a
+// *ValidationError; null leaves a field empty. The values themselves are checked by ValidateUser.
+func UserFromFields(values map[string]interface{}) (*User, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	user := &User{}
+	verr := &ValidationError{}
+	for _, name := range names {
+		field, ok := LookupField(name)
+		switch {
+		case !ok:
+			verr.Fields = append(verr.Fields, FieldError{Field: name, Code: CodeUnknown, Message: "is not a user field"})
+		case field.Immutable:
+			verr.Fields = append(verr.Fields, FieldError{Field: name, Code: CodeImmutable, Message: "is assigned by the server"})
+		default:
+			switch v := values[name].(type) {
+			case nil:
+			case string:
+				field.set(user, v)
+			default:
+				verr.Fields = append(verr.Fields, FieldError{Field: name, Code: CodeType, Message: "must be a string"})
+			}
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+	return user, nil
+}
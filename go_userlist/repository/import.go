@@ -0,0 +1,283 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+// ImportOptions controls a bulk import.
+type ImportOptions struct {
+	// DryRun checks the users for duplicates and unknown departments without creating any of
+	// them.
+	DryRun bool
+}
+
+// importColumns are the columns a bulk import writes; the database assigns the rest.
+var importColumns = []string{"user_name", "first_name", "last_name", "email", "user_status", "department"}
+
+// markUnknownDepartments sets rejected[i] to the *ValidationError of each user naming a
+// department that is not in departments. Users without a department are always accepted.
+func markUnknownDepartments(users []User, rejected []error, departments map[string]bool) {
+	for i, u := range users {
+		if u.Department != "" && !departments[u.Department] {
+			rejected[i] = errUnknownDepartment()
+		}
+	}
+}
+
+// markDuplicates sets rejected[i] to a *DuplicateUserError for each user not rejected yet whose
+// user_name or email is in the taken sets or used by an earlier accepted user of the slice. The
+// sets hold lower-cased values and gain those of every accepted user.
+func markDuplicates(users []User, rejected []error, takenNames, takenEmails map[string]bool) {
+	for i, u := range users {
+		if rejected[i] != nil {
+			continue
+		}
+		name, email := strings.ToLower(u.User_name), strings.ToLower(u.Email)
+		switch {
+		case takenNames[name]:
+			rejected[i] = &DuplicateUserError{Field: "user_name"}
+		case takenEmails[email]:
+			rejected[i] = &DuplicateUserError{Field: "email"}
+		default:
+			takenNames[name], takenEmails[email] = true, true
+		}
+	}
+}
+
+// importDepartments returns the distinct departments the users name.
+func importDepartments(users []User) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, u := range users {
+		if u.Department != "" && !seen[u.Department] {
+			seen[u.Department] = true
+			names = append(names, u.Department)
+		}
+	}
+	return names
+}
+
+// ImportUsers creates many users in one transaction, streaming them to the database with COPY,
+// and records a create event for each of them in the outbox. Users naming a department that does
+// not exist are rejected with a *ValidationError, and users whose user_name or email is already
+// taken, by an existing user or an earlier accepted one in users, with a *DuplicateUserError:
+// rejected[i] is the error users[i] was rejected for, or nil when it was created and its User_id
+// and Version were set. Any other error aborts the whole import. The caller validates the users.
+func (r *PostgresUserRepository) ImportUsers(ctx context.Context, users []User, opts ImportOptions) ([]error, error) {
+	names := make([]string, len(users))
+	emails := make([]string, len(users))
+	for i, u := range users {
+		names[i], emails[i] = strings.ToLower(u.User_name), strings.ToLower(u.Email)
+	}
+
+	takenQuery, takenArgs, err := r.psql.Select("lower(user_name)", "lower(email)").
+		From("public.users").
+		Where(squirrel.Or{
+			squirrel.Expr("lower(user_name) = ANY(?)", pq.Array(names)),
+			squirrel.Expr("lower(email) = ANY(?)", pq.Array(emails)),
+		}).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	departmentNames := importDepartments(users)
+	departmentQuery := r.psql.Select("name").
+		From("public.departments").
+		Where(squirrel.Expr("name = ANY(?)", pq.Array(departmentNames)))
+	if !opts.DryRun {
+		// Keep the departments from being renamed or deleted before the COPY.
+		departmentQuery = departmentQuery.Suffix("FOR KEY SHARE")
+	}
+	departmentSQL, departmentArgs, err := departmentQuery.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rejected := make([]error, len(users))
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		departments := map[string]bool{}
+		if len(departmentNames) > 0 {
+			rows, err := tx.QueryContext(ctx, departmentSQL, departmentArgs...)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var name string
+				if err := rows.Scan(&name); err != nil {
+					rows.Close()
+					return err
+				}
+				departments[name] = true
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+
+		takenNames, takenEmails := map[string]bool{}, map[string]bool{}
+		rows, err := tx.QueryContext(ctx, takenQuery, takenArgs...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name, email string
+			if err := rows.Scan(&name, &email); err != nil {
+				rows.Close()
+				return err
+			}
+			takenNames[name], takenEmails[email] = true, true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		markUnknownDepartments(users, rejected, departments)
+		markDuplicates(users, rejected, takenNames, takenEmails)
+		if opts.DryRun {
+			return nil
+		}
+		return r.copyUsers(ctx, tx, users, rejected)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rejected, nil
+}
+
+// copyUsers writes the users that were not rejected with COPY, reads back the ids and versions
+// the database assigned and records their create events. The users table is not locked, so
+// another writer may take a user_name or email after ImportUsers checked them. That fails the
+// whole COPY, which therefore runs under a savepoint: on a unique violation the batch is written
+// again by insertUsers, which only skips the users that conflict.
+func (r *PostgresUserRepository) copyUsers(ctx context.Context, tx *sql.Tx, users []User, rejected []error) error {
+	created := map[string]int{}
+	var names []string
+	for i, u := range users {
+		if rejected[i] == nil {
+			name := strings.ToLower(u.User_name)
+			created[name] = i
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT import_copy"); err != nil {
+		return err
+	}
+	err := copyIn(ctx, tx, users, rejected)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_copy"); err != nil {
+			return err
+		}
+		if err := r.insertUsers(ctx, tx, users, rejected); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		query, args, err := r.psql.Select(userColumns...).
+			From("public.users").
+			Where(squirrel.Expr("lower(user_name) = ANY(?)", pq.Array(names))).ToSql()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			stored, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if i, ok := created[strings.ToLower(stored.User_name)]; ok {
+				users[i].User_id, users[i].Version, users[i].Deleted_at = stored.User_id, stored.Version, nil
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	// As in PurgeDeletedUsers, the outbox inserts wait until the rows are drained.
+	for i := range users {
+		if rejected[i] == nil {
+			if err := r.enqueueEvent(ctx, tx, EventUserCreated, users[i].User_id, &users[i], nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyIn streams the users that were not rejected to public.users with COPY.
+func copyIn(ctx context.Context, tx *sql.Tx, users []User, rejected []error) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema("public", "users", importColumns...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, u := range users {
+		if rejected[i] != nil {
+			continue
+		}
+		if _, err := stmt.ExecContext(ctx, u.User_name, u.First_name, u.Last_name, u.Email, u.User_status, departmentValue(u.Department)); err != nil {
+			return err
+		}
+	}
+	// An Exec without arguments flushes the buffered rows and ends the COPY.
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// insertUsers inserts the users that were not rejected one at a time, setting the User_id and
+// Version of each. A user whose user_name or email was taken since the check is skipped and
+// rejected with a *DuplicateUserError.
+func (r *PostgresUserRepository) insertUsers(ctx context.Context, tx *sql.Tx, users []User, rejected []error) error {
+	for i, u := range users {
+		if rejected[i] != nil {
+			continue
+		}
+		query, args, err := r.psql.Insert("public.users").
+			Columns(importColumns...).
+			Values(u.User_name, u.First_name, u.Last_name, u.Email, u.User_status, departmentValue(u.Department)).
+			Suffix("ON CONFLICT DO NOTHING RETURNING user_id, version").ToSql()
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&users[i].User_id, &users[i].Version)
+		if err == nil {
+			users[i].Deleted_at = nil
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		var nameTaken bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM public.users WHERE lower(user_name) = $1)",
+			strings.ToLower(u.User_name)).Scan(&nameTaken)
+		if err != nil {
+			return err
+		}
+		if nameTaken {
+			rejected[i] = &DuplicateUserError{Field: "user_name"}
+		} else {
+			rejected[i] = &DuplicateUserError{Field: "email"}
+		}
+	}
+	return nil
+}
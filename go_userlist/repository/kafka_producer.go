@@ -0,0 +1,298 @@
+package repository
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// ErrProducerClosed is returned when publishing through a KafkaProducer that has been closed.
+var ErrProducerClosed = newError(ErrUnavailable, "producer_closed", "kafka producer is closed")
+
+// KafkaConfig holds the connection and batching settings of a KafkaProducer.
+type KafkaConfig struct {
+	Brokers  []string
+	ClientID string
+
+	TLS           bool
+	TLSCAFile     string
+	TLSSkipVerify bool
+
+	SASLMechanism string // PLAIN; empty disables SASL
+	SASLUser      string
+	SASLPassword  string
+
+	RequiredAcks sarama.RequiredAcks
+	Compression  sarama.CompressionCodec
+
+	FlushMessages  int           // messages buffered before a batch is sent
+	FlushFrequency time.Duration // maximum time a message waits for its batch
+}
+
+// DefaultKafkaConfig returns the settings used for anything not overridden by the environment.
+func DefaultKafkaConfig() KafkaConfig {
+	return KafkaConfig{
+		Brokers:        []string{"localhost:9092"},
+		ClientID:       "go_userlist",
+		RequiredAcks:   sarama.WaitForAll,
+		Compression:    sarama.CompressionNone,
+		FlushMessages:  100,
+		FlushFrequency: 50 * time.Millisecond,
+	}
+}
+
+// KafkaConfigFromEnv builds a KafkaConfig from the KAFKA_* environment variables
+// (loading .env if present), falling back to DefaultKafkaConfig for unset values.
+//
+//	KAFKA_BROKERS          comma separated host:port list
+//	KAFKA_CLIENT_ID        client id reported to the brokers
+//	KAFKA_TLS              true to connect over TLS
+//	KAFKA_TLS_CA_FILE      PEM bundle used to verify the brokers
+//	KAFKA_TLS_SKIP_VERIFY  true to skip broker certificate verification
+//	KAFKA_SASL_MECHANISM   PLAIN
+//	KAFKA_SASL_USER        SASL user name
+//	KAFKA_SASL_PASSWORD    SASL password
+//	KAFKA_ACKS             all, leader or none
+//	KAFKA_COMPRESSION      none, gzip, snappy, lz4 or zstd
+//	KAFKA_BATCH_MESSAGES   messages per batch
+//	KAFKA_BATCH_FREQUENCY  maximum batching delay, e.g. 50ms
+func KafkaConfigFromEnv() (KafkaConfig, error) {
+	loadDotEnv()
+	cfg := DefaultKafkaConfig()
+
+	if v := os.Getenv("KAFKA_BROKERS"); v != "" {
+		cfg.Brokers = nil
+		for _, broker := range strings.Split(v, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				cfg.Brokers = append(cfg.Brokers, broker)
+			}
+		}
+	}
+	if v := os.Getenv("KAFKA_CLIENT_ID"); v != "" {
+		cfg.ClientID = v
+	}
+
+	var err error
+	if cfg.TLS, err = envBool("KAFKA_TLS", cfg.TLS); err != nil {
+		return cfg, err
+	}
+	cfg.TLSCAFile = os.Getenv("KAFKA_TLS_CA_FILE")
+	if cfg.TLSSkipVerify, err = envBool("KAFKA_TLS_SKIP_VERIFY", cfg.TLSSkipVerify); err != nil {
+		return cfg, err
+	}
+
+	cfg.SASLMechanism = strings.ToUpper(os.Getenv("KAFKA_SASL_MECHANISM"))
+	cfg.SASLUser = os.Getenv("KAFKA_SASL_USER")
+	cfg.SASLPassword = os.Getenv("KAFKA_SASL_PASSWORD")
+
+	switch strings.ToLower(os.Getenv("KAFKA_ACKS")) {
+	case "", "all", "-1":
+		cfg.RequiredAcks = sarama.WaitForAll
+	case "leader", "1":
+		cfg.RequiredAcks = sarama.WaitForLocal
+	case "none", "0":
+		cfg.RequiredAcks = sarama.NoResponse
+	default:
+		return cfg, fmt.Errorf("invalid KAFKA_ACKS %q", os.Getenv("KAFKA_ACKS"))
+	}
+
+	if v := os.Getenv("KAFKA_COMPRESSION"); v != "" {
+		if err := cfg.Compression.UnmarshalText([]byte(strings.ToLower(v))); err != nil {
+			return cfg, fmt.Errorf("invalid KAFKA_COMPRESSION: %w", err)
+		}
+	}
+
+	if v := os.Getenv("KAFKA_BATCH_MESSAGES"); v != "" {
+		if cfg.FlushMessages, err = strconv.Atoi(v); err != nil {
+			return cfg, fmt.Errorf("invalid KAFKA_BATCH_MESSAGES %q", v)
+		}
+	}
+	if v := os.Getenv("KAFKA_BATCH_FREQUENCY"); v != "" {
+		if cfg.FlushFrequency, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("invalid KAFKA_BATCH_FREQUENCY %q", v)
+		}
+	}
+
+	return cfg, nil
+}
+
+// envBool parses a boolean environment variable, returning def when it is unset.
+func envBool(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return b, nil
+}
+
+// saramaConfig translates cfg into a sarama producer configuration.
+func (cfg KafkaConfig) saramaConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = cfg.ClientID
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.RequiredAcks = cfg.RequiredAcks
+	config.Producer.Compression = cfg.Compression
+	config.Producer.Flush.Messages = cfg.FlushMessages
+	config.Producer.Flush.Frequency = cfg.FlushFrequency
+	// Events are keyed per user; hash the key so one user's events stay on one partition.
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+
+	// The idempotent producer avoids duplicates on retry but needs acks from all replicas
+	// and a single in-flight request per broker to keep ordering.
+	if cfg.RequiredAcks == sarama.WaitForAll {
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+
+	if cfg.TLS {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}
+		if cfg.TLSCAFile != "" {
+			pem, err := os.ReadFile(cfg.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading Kafka CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", cfg.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	switch cfg.SASLMechanism {
+	case "":
+	case sarama.SASLTypePlaintext:
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		config.Net.SASL.User = cfg.SASLUser
+		config.Net.SASL.Password = cfg.SASLPassword
+	default:
+		return nil, fmt.Errorf("unsupported Kafka SASL mechanism %q", cfg.SASLMechanism)
+	}
+
+	return config, config.Validate()
+}
+
+// KafkaProducer is a long-lived, shared Kafka producer. Messages are batched by an
+// underlying sarama.AsyncProducer and each delivery is reported through a callback.
+// It is safe for concurrent use.
+type KafkaProducer struct {
+	producer sarama.AsyncProducer
+
+	mu      sync.RWMutex
+	closed  bool
+	results sync.WaitGroup
+}
+
+// Ensure KafkaProducer implements AsyncPublisher
+var _ AsyncPublisher = &KafkaProducer{}
+
+// NewKafkaProducer connects to the brokers in cfg and starts delivering results.
+func NewKafkaProducer(cfg KafkaConfig) (*KafkaProducer, error) {
+	config, err := cfg.saramaConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kafka configuration: %w", err)
+	}
+
+	producer, err := sarama.NewAsyncProducer(cfg.Brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Kafka producer: %w", err)
+	}
+
+	p := &KafkaProducer{producer: producer}
+	p.results.Add(2)
+	go func() {
+		defer p.results.Done()
+		for msg := range producer.Successes() {
+			deliver(msg, nil)
+		}
+	}()
+	go func() {
+		defer p.results.Done()
+		for perr := range producer.Errors() {
+			deliver(perr.Msg, fmt.Errorf("error producing to Kafka: %w", perr.Err))
+		}
+	}()
+
+	return p, nil
+}
+
+// deliver invokes the delivery callback stored in the message metadata, if any.
+func deliver(msg *sarama.ProducerMessage, err error) {
+	if done, ok := msg.Metadata.(func(error)); ok && done != nil {
+		done(err)
+	}
+}
+
+// PublishAsync queues a message for the next batch and returns immediately, unless the
+// producer's input is full, in which case it waits for room or for ctx to be done. done, if not
+// nil, is called exactly once with the delivery result, or with ctx's error if the message was
+// never queued.
+func (p *KafkaProducer) PublishAsync(ctx context.Context, topic, key string, value []byte, done func(error)) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		if done != nil {
+			done(ErrProducerClosed)
+		}
+		return
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic:    topic,
+		Key:      sarama.StringEncoder(key),
+		Value:    sarama.ByteEncoder(value),
+		Metadata: done,
+	}
+	select {
+	case p.producer.Input() <- msg:
+	case <-ctx.Done():
+		if done != nil {
+			done(ctx.Err())
+		}
+	}
+}
+
+// Publish queues a message and waits until it has been acknowledged by the brokers or ctx is
+// done. A message already queued when ctx is done may still be delivered.
+func (p *KafkaProducer) Publish(ctx context.Context, topic, key string, value []byte) error {
+	result := make(chan error, 1)
+	p.PublishAsync(ctx, topic, key, value, func(err error) { result <- err })
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes buffered messages, waits for their delivery callbacks and shuts the producer down.
+func (p *KafkaProducer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	p.producer.AsyncClose()
+	p.results.Wait()
+	return nil
+}
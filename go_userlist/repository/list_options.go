@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultPageSize is used when a listing request does not specify a size.
+	DefaultPageSize = 25
+	// MaxPageSize caps the number of users returned by a single page.
+	MaxPageSize = 200
+)
+
+// Sort directions accepted by ListOptions.SortDir.
+const (
+	SortAsc  = "asc"
+	SortDesc = "desc"
+)
+
+// ErrInvalidListOptions is returned when paging, sorting or filter options are not usable.
+var ErrInvalidListOptions = newError(ErrValidation, "invalid_list_options", "invalid list options")
+
+// ListOptions controls paging, ordering and filtering when listing users.
+type ListOptions struct {
+	Page       int    // 1-based page number
+	Size       int    // rows per page
+	SortBy     string // column to order by, defaults to user_id
+	SortDir    string // asc or desc, defaults to asc
+	Department string // exact department match
+	UserStatus string // exact user_status match
+	NamePrefix string // case-insensitive prefix of user_name, first_name or last_name
+
+	IncludeDeleted bool // also list soft deleted users
+}
+
+// UserPage is one page of a user listing together with the total number of matching users.
+type UserPage struct {
+	Users []User `json:"users"`
+	Total int    `json:"total"`
+	Page  int    `json:"page"`
+	Size  int    `json:"size"`
+
+	// NextCursor is set by ListUsersAfter when more rows follow this page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// HasNext reports whether another page follows this one.
+func (p *UserPage) HasNext() bool {
+	return p.Page*p.Size < p.Total
+}
+
+// Normalize fills in defaults and validates the options.
+func (o ListOptions) Normalize() (ListOptions, error) {
+	if o.Page == 0 {
+		o.Page = 1
+	}
+	if o.Size == 0 {
+		o.Size = DefaultPageSize
+	}
+	if o.Page < 1 {
+		return o, fmt.Errorf("%w: page must be at least 1", ErrInvalidListOptions)
+	}
+	if o.Size < 1 || o.Size > MaxPageSize {
+		return o, fmt.Errorf("%w: size must be between 1 and %d", ErrInvalidListOptions, MaxPageSize)
+	}
+
+	if o.SortBy == "" {
+		o.SortBy = "user_id"
+	}
+	if f, ok := lookupColumn(o.SortBy); !ok || !f.Sortable {
+		return o, fmt.Errorf("%w: cannot sort by %q", ErrInvalidListOptions, o.SortBy)
+	}
+
+	o.SortDir = strings.ToLower(o.SortDir)
+	if o.SortDir == "" {
+		o.SortDir = SortAsc
+	}
+	if o.SortDir != SortAsc && o.SortDir != SortDesc {
+		return o, fmt.Errorf("%w: sort direction must be %q or %q", ErrInvalidListOptions, SortAsc, SortDesc)
+	}
+
+	return o, nil
+}
+
+// offset returns the number of rows to skip for the requested page.
+func (o ListOptions) offset() int {
+	return (o.Page - 1) * o.Size
+}
+
+// orderBy returns the ORDER BY terms, using user_id as a tie-breaker so pages are stable.
+func (o ListOptions) orderBy() []string {
+	if o.SortBy == "user_id" {
+		return []string{"user_id " + o.SortDir}
+	}
+	return []string{o.SortBy + " " + o.SortDir, "user_id " + o.SortDir}
+}
+
+// keysetColumn returns the expression compared against a cursor's sort key. Text columns are
+// nullable, so NULLs are folded to the empty string to keep row comparisons total.
+func (o ListOptions) keysetColumn() string {
+	if o.SortBy == "user_id" {
+		return "user_id"
+	}
+	return "COALESCE(" + o.SortBy + ", '')"
+}
+
+// escapeLike escapes the LIKE wildcards in s so it can be used as a literal prefix.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
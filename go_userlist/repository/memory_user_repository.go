@@ -0,0 +1,572 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repository backends selectable with USER_REPOSITORY.
+const (
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+)
+
+// BackendFromEnv returns the repository backend named in USER_REPOSITORY (loading .env if
+// present), or BackendPostgres when it is unset.
+func BackendFromEnv() (string, error) {
+	loadDotEnv()
+	switch v := strings.ToLower(os.Getenv("USER_REPOSITORY")); v {
+	case "", BackendPostgres:
+		return BackendPostgres, nil
+	case BackendMemory:
+		return BackendMemory, nil
+	default:
+		return "", fmt.Errorf("invalid USER_REPOSITORY %q: must be %q or %q", v, BackendPostgres, BackendMemory)
+	}
+}
+
+// MemoryUserRepository is a UserRepository and DepartmentRepository that keeps users and
+// departments in memory, for tests and demos that run without a database. It follows the Postgres
+// repository's semantics: versions, soft delete, case-insensitive uniqueness of user_name, email
+// and department names, users referencing existing departments, filtering, paging and the errors
+// returned. Text columns are ordered byte-wise rather than by the database collation, and no
+// change events are recorded. It is safe for concurrent use.
+type MemoryUserRepository struct {
+	mu     sync.RWMutex
+	users  map[int]*User
+	nextID int
+
+	departments      map[int]*Department
+	nextDepartmentID int
+}
+
+// Ensure MemoryUserRepository implements UserRepository and DepartmentRepository
+var (
+	_ UserRepository       = &MemoryUserRepository{}
+	_ DepartmentRepository = &MemoryUserRepository{}
+)
+
+// NewMemoryUserRepository returns an in-memory repository holding the given users. Users without
+// an id are numbered after the highest given id, and every user starts at version 1. The
+// departments the users name are created for them, in order of first appearance.
+func NewMemoryUserRepository(users ...User) *MemoryUserRepository {
+	r := &MemoryUserRepository{users: map[int]*User{}, nextID: 1, departments: map[int]*Department{}, nextDepartmentID: 1}
+	for _, u := range users {
+		if u.Department != "" && r.lookupDepartmentByName(u.Department) == nil {
+			r.departments[r.nextDepartmentID] = &Department{Department_id: r.nextDepartmentID, Name: u.Department, Version: 1}
+			r.nextDepartmentID++
+		}
+	}
+	for _, u := range users {
+		if u.User_id >= r.nextID {
+			r.nextID = u.User_id + 1
+		}
+	}
+	for _, u := range users {
+		if u.User_id == 0 {
+			u.User_id = r.nextID
+			r.nextID++
+		}
+		u.Version = 1
+		r.users[u.User_id] = &u
+	}
+	return r
+}
+
+// Close does nothing; it exists to satisfy UserRepository.
+func (r *MemoryUserRepository) Close() error {
+	return nil
+}
+
+// CreateUser stores a new user, assigning its id and version.
+func (r *MemoryUserRepository) CreateUser(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.createLocked(user)
+}
+
+// createLocked stores a new user and sets its id and version. The caller holds r.mu.
+func (r *MemoryUserRepository) createLocked(user *User) error {
+	created := *user
+	created.User_id = 0
+	if err := r.checkConstraints(&created); err != nil {
+		return err
+	}
+	created.User_id = r.nextID
+	created.Version = 1
+	created.Deleted_at = nil
+	r.nextID++
+	r.users[created.User_id] = &created
+
+	user.User_id, user.Version = created.User_id, created.Version
+	return nil
+}
+
+// UpdateUser replaces the user's fields. user.Version is the version the caller last saw
+// (AnyVersion to overwrite unconditionally); on success it is set to the new version.
+func (r *MemoryUserRepository) UpdateUser(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.updateLocked(user)
+}
+
+// updateLocked replaces the fields of a stored user. The caller holds r.mu.
+func (r *MemoryUserRepository) updateLocked(user *User) error {
+	stored, err := r.lookup(user.User_id, false)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(stored, user.Version); err != nil {
+		return err
+	}
+
+	updated := *stored
+	updated.User_name = user.User_name
+	updated.First_name = user.First_name
+	updated.Last_name = user.Last_name
+	updated.Email = user.Email
+	updated.User_status = user.User_status
+	updated.Department = user.Department
+	if err := r.checkConstraints(&updated); err != nil {
+		return err
+	}
+	updated.Version++
+	*stored = updated
+
+	user.Version = updated.Version
+	return nil
+}
+
+// UpsertUser creates the user with the given User_id if no user has that id, and otherwise
+// updates it as UpdateUser does, with the same rules as PostgresUserRepository.UpsertUser.
+func (r *MemoryUserRepository) UpsertUser(ctx context.Context, user *User) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.users[user.User_id]; exists {
+		return false, r.updateLocked(user)
+	}
+	if user.Version != AnyVersion {
+		return false, ErrVersionMismatch
+	}
+
+	created := *user
+	if err := r.checkConstraints(&created); err != nil {
+		return false, err
+	}
+	created.Version = 1
+	created.Deleted_at = nil
+	r.users[created.User_id] = &created
+	if created.User_id >= r.nextID {
+		r.nextID = created.User_id + 1
+	}
+
+	user.Version, user.Deleted_at = created.Version, nil
+	return true, nil
+}
+
+// ImportUsers creates the users that name an existing department, if any, and do not reuse a
+// taken user_name or email, with the same rules and results as PostgresUserRepository.ImportUsers.
+func (r *MemoryUserRepository) ImportUsers(ctx context.Context, users []User, opts ImportOptions) ([]error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	takenNames, takenEmails := map[string]bool{}, map[string]bool{}
+	for _, u := range r.users {
+		takenNames[strings.ToLower(u.User_name)] = true
+		takenEmails[strings.ToLower(u.Email)] = true
+	}
+	departments := map[string]bool{}
+	for _, d := range r.departments {
+		departments[d.Name] = true
+	}
+	rejected := make([]error, len(users))
+	markUnknownDepartments(users, rejected, departments)
+	markDuplicates(users, rejected, takenNames, takenEmails)
+	if opts.DryRun {
+		return rejected, nil
+	}
+
+	for i := range users {
+		if rejected[i] != nil {
+			continue
+		}
+		created := users[i]
+		created.User_id = r.nextID
+		created.Version = 1
+		created.Deleted_at = nil
+		r.nextID++
+		r.users[created.User_id] = &created
+		users[i] = created
+	}
+	return rejected, nil
+}
+
+// GetUserByID returns the user with the given id unless it is soft deleted.
+func (r *MemoryUserRepository) GetUserByID(ctx context.Context, userID int) (*User, error) {
+	return r.get(ctx, userID, false)
+}
+
+// GetUserByIDIncludingDeleted returns the user with the given id even if it is soft deleted.
+func (r *MemoryUserRepository) GetUserByIDIncludingDeleted(ctx context.Context, userID int) (*User, error) {
+	return r.get(ctx, userID, true)
+}
+
+// get returns a copy of the user with the given id.
+func (r *MemoryUserRepository) get(ctx context.Context, userID int, includeDeleted bool) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored, err := r.lookup(userID, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	user := *stored
+	return &user, nil
+}
+
+// PatchUser updates the given fields of a user; updates are validated as by PatchColumns.
+func (r *MemoryUserRepository) PatchUser(ctx context.Context, userID int, expectedVersion int, updates map[string]interface{}) error {
+	columns, err := PatchColumns(updates)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, err := r.lookup(userID, false)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(stored, expectedVersion); err != nil {
+		return err
+	}
+	return r.patchLocked(stored, columns)
+}
+
+// ModifyUser calls modify with the current user and applies the updates it returns, as
+// PostgresUserRepository.ModifyUser does. The repository stays locked while modify runs, so
+// modify must not call back into the repository.
+func (r *MemoryUserRepository) ModifyUser(ctx context.Context, userID int, expectedVersion int, modify func(current User) (map[string]interface{}, error)) error {
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, err := r.lookup(userID, false)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(stored, expectedVersion); err != nil {
+		return err
+	}
+
+	updates, err := modify(*stored)
+	if err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	columns, err := PatchColumns(updates)
+	if err != nil {
+		return err
+	}
+	return r.patchLocked(stored, columns)
+}
+
+// patchLocked sets the given columns on a stored user and bumps its version.
+func (r *MemoryUserRepository) patchLocked(stored *User, columns map[string]interface{}) error {
+	updated := *stored
+	for column, value := range columns {
+		f, _ := lookupColumn(column)
+		f.set(&updated, value.(string))
+	}
+	if err := r.checkConstraints(&updated); err != nil {
+		return err
+	}
+	updated.Version++
+	*stored = updated
+	return nil
+}
+
+// GetAllUsers returns every user that is not soft deleted, ordered by id.
+func (r *MemoryUserRepository) GetAllUsers(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	opts, _ := ListOptions{}.Normalize()
+	return r.matching(opts), nil
+}
+
+// ListUsers returns one page of users matching the filters in opts, ordered as requested.
+func (r *MemoryUserRepository) ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	opts, err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := r.matching(opts)
+	page := &UserPage{Users: []User{}, Total: len(users), Page: opts.Page, Size: opts.Size}
+	if start := opts.offset(); start < len(users) {
+		end := start + opts.Size
+		if end > len(users) {
+			end = len(users)
+		}
+		page.Users = append(page.Users, users[start:end]...)
+	}
+	return page, nil
+}
+
+// ListUsersAfter returns up to opts.Size users ordered as requested, starting strictly after the
+// row identified by cursor (or from the beginning when cursor is empty).
+func (r *MemoryUserRepository) ListUsersAfter(ctx context.Context, opts ListOptions, cursor string) (*UserPage, error) {
+	opts, err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	var after *User
+	if cursor != "" {
+		c, err := decodeCursor(cursor, opts)
+		if err != nil {
+			return nil, err
+		}
+		after = &User{User_id: c.UserID}
+		if opts.SortBy != "user_id" {
+			f, _ := lookupColumn(opts.SortBy)
+			f.set(after, c.Key)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	page := &UserPage{Users: []User{}, Size: opts.Size}
+	for _, u := range r.matching(opts) {
+		if after != nil && !opts.less(after, &u) {
+			continue
+		}
+		if len(page.Users) == opts.Size {
+			page.NextCursor = cursorAfter(page.Users[opts.Size-1], opts)
+			break
+		}
+		page.Users = append(page.Users, u)
+	}
+	return page, nil
+}
+
+// ExportUsers calls fn for every user matching the filters in opts, in the requested order.
+// Page and Size are ignored. The matching users are copied first, so fn runs without holding
+// the lock and may be slow.
+func (r *MemoryUserRepository) ExportUsers(ctx context.Context, opts ListOptions, fn func(User) error) error {
+	opts.Page, opts.Size = 0, 0
+	opts, err := opts.Normalize()
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.RLock()
+	users := r.matching(opts)
+	r.mu.RUnlock()
+
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return wrapDBError(err)
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matching returns copies of the users that pass the filters in opts, in the order opts asks for.
+func (r *MemoryUserRepository) matching(opts ListOptions) []User {
+	prefix := strings.ToLower(opts.NamePrefix)
+	var users []User
+	for _, u := range r.users {
+		switch {
+		case opts.Department != "" && u.Department != opts.Department,
+			opts.UserStatus != "" && u.User_status != opts.UserStatus,
+			u.Deleted_at != nil && !opts.IncludeDeleted:
+			continue
+		}
+		if prefix != "" &&
+			!strings.HasPrefix(strings.ToLower(u.User_name), prefix) &&
+			!strings.HasPrefix(strings.ToLower(u.First_name), prefix) &&
+			!strings.HasPrefix(strings.ToLower(u.Last_name), prefix) {
+			continue
+		}
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return opts.less(&users[i], &users[j]) })
+	return users
+}
+
+// less reports whether a sorts before b in the order opts asks for, breaking ties on user_id.
+func (o ListOptions) less(a, b *User) bool {
+	if o.SortBy != "user_id" {
+		if ka, kb := sortKey(*a, o.SortBy), sortKey(*b, o.SortBy); ka != kb {
+			return (ka < kb) == (o.SortDir == SortAsc)
+		}
+	}
+	return (a.User_id < b.User_id) == (o.SortDir == SortAsc)
+}
+
+// RestoreUser clears deleted_at on a soft deleted user and returns it, or ErrUserNotDeleted if
+// the user is not deleted.
+func (r *MemoryUserRepository) RestoreUser(ctx context.Context, userID int, expectedVersion int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, err := r.lookup(userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Deleted_at == nil {
+		return nil, ErrUserNotDeleted
+	}
+	if err := checkVersion(stored, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	stored.Deleted_at = nil
+	stored.Version++
+	user := *stored
+	return &user, nil
+}
+
+// PurgeDeletedUsers removes the users soft deleted before deletedBefore and returns how many
+// were removed.
+func (r *MemoryUserRepository) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	purged := 0
+	for id, u := range r.users {
+		if u.Deleted_at != nil && u.Deleted_at.Before(deletedBefore) {
+			delete(r.users, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// DeleteUserByID soft deletes a user; RestoreUser can undo this until the user is purged.
+func (r *MemoryUserRepository) DeleteUserByID(ctx context.Context, userID int, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return wrapDBError(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.deleteLocked(userID, expectedVersion)
+	return err
+}
+
+// deleteLocked soft deletes a stored user and returns it. The caller holds r.mu.
+func (r *MemoryUserRepository) deleteLocked(userID int, expectedVersion int) (*User, error) {
+	stored, err := r.lookup(userID, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(stored, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	stored.Deleted_at = &now
+	stored.Version++
+	return stored, nil
+}
+
+// lookup returns the stored user with the given id, or ErrUserNotFound. The caller holds r.mu.
+func (r *MemoryUserRepository) lookup(userID int, includeDeleted bool) (*User, error) {
+	u, ok := r.users[userID]
+	if !ok || (u.Deleted_at != nil && !includeDeleted) {
+		return nil, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// checkConstraints returns the error the constraints on public.users would raise for user, as
+// checkUnique and checkDepartment do. The caller holds r.mu.
+func (r *MemoryUserRepository) checkConstraints(user *User) error {
+	if err := r.checkUnique(user); err != nil {
+		return err
+	}
+	return r.checkDepartment(user)
+}
+
+// checkDepartment returns a *ValidationError if user names a department that does not exist,
+// mirroring the users_department_fkey foreign key. The caller holds r.mu.
+func (r *MemoryUserRepository) checkDepartment(user *User) error {
+	if user.Department == "" {
+		return nil
+	}
+	// Names are unique regardless of case, but a reference has to match exactly.
+	if d := r.lookupDepartmentByName(user.Department); d == nil || d.Name != user.Department {
+		return errUnknownDepartment()
+	}
+	return nil
+}
+
+// checkUnique returns a *DuplicateUserError if another user, soft deleted or not, has the same
+// user_name or email regardless of case, mirroring the users_user_name_key and users_email_key
+// indexes. The caller holds r.mu.
+func (r *MemoryUserRepository) checkUnique(user *User) error {
+	for id, u := range r.users {
+		if id == user.User_id {
+			continue
+		}
+		if strings.EqualFold(u.User_name, user.User_name) {
+			return &DuplicateUserError{Field: "user_name"}
+		}
+		if strings.EqualFold(u.Email, user.Email) {
+			return &DuplicateUserError{Field: "email"}
+		}
+	}
+	return nil
+}
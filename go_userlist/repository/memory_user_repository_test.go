@@ -0,0 +1,165 @@
+package repository_test
+
+import (
+	"context"
+	"go_userlist/repository"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryUserRepository", func() {
+	var (
+		repo *repository.MemoryUserRepository
+		ctx  = context.Background()
+	)
+
+	BeforeEach(func() {
+		repo = repository.NewMemoryUserRepository(
+			repository.User{User_name: "jdoe01", First_name: "John", Last_name: "Doe", Email: "jdoe01@example.com", User_status: "A", Department: "HR"},
+			repository.User{User_name: "asmith01", First_name: "Alice", Last_name: "Smith", Email: "asmith01@example.com", User_status: "A", Department: "Finance"},
+			repository.User{User_name: "bwhite01", First_name: "Bob", Last_name: "White", Email: "bwhite01@example.com", User_status: "I", Department: "HR"},
+		)
+	})
+
+	It("should number seeded and created users and start them at version 1", func() {
+		user := &repository.User{User_id: 99, User_name: "cjones01", Email: "cjones01@example.com"}
+		Expect(repo.CreateUser(ctx, user)).To(Succeed())
+		Expect(user.User_id).To(Equal(4))
+		Expect(user.Version).To(Equal(1))
+
+		stored, err := repo.GetUserByID(ctx, 4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored.User_name).To(Equal("cjones01"))
+
+		_, err = repo.GetUserByID(ctx, 99)
+		Expect(err).To(Equal(repository.ErrUserNotFound))
+	})
+
+	It("should bump the version on every change and reject stale versions", func() {
+		Expect(repo.PatchUser(ctx, 1, 1, map[string]interface{}{"department": "Finance"})).To(Succeed())
+		Expect(repo.PatchUser(ctx, 1, 1, map[string]interface{}{"department": "HR"})).To(MatchError(repository.ErrVersionMismatch))
+
+		user, err := repo.GetUserByID(ctx, 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(user.Department).To(Equal("Finance"))
+		Expect(user.Version).To(Equal(2))
+
+		user.First_name = "Johnny"
+		Expect(repo.UpdateUser(ctx, user)).To(Succeed())
+		Expect(user.Version).To(Equal(3))
+
+		err = repo.PatchUser(ctx, 1, repository.AnyVersion, map[string]interface{}{"version": 9})
+		Expect(err).To(MatchError(repository.ErrInvalidPatch))
+	})
+
+	It("should create the departments the seeded users belong to", func() {
+		departments, err := repo.ListDepartments(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(departments).To(Equal([]repository.Department{
+			{Department_id: 2, Name: "Finance", Version: 1},
+			{Department_id: 1, Name: "HR", Version: 1},
+		}))
+	})
+
+	It("should enforce case-insensitive uniqueness of user_name and email", func() {
+		err := repo.CreateUser(ctx, &repository.User{User_name: "JDOE01", Email: "someone@example.com"})
+		Expect(err).To(Equal(&repository.DuplicateUserError{Field: "user_name"}))
+
+		err = repo.PatchUser(ctx, 2, repository.AnyVersion, map[string]interface{}{"email": "JDoe01@Example.com"})
+		Expect(err).To(Equal(&repository.DuplicateUserError{Field: "email"}))
+
+		Expect(repo.PatchUser(ctx, 1, repository.AnyVersion, map[string]interface{}{"user_name": "JDoe01"})).To(Succeed())
+	})
+
+	It("should filter, order and page like the Postgres repository", func() {
+		page, err := repo.ListUsers(ctx, repository.ListOptions{Department: "HR", SortBy: "first_name", SortDir: "desc", Size: 1})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page.Total).To(Equal(2))
+		Expect(page.Users).To(HaveLen(1))
+		Expect(page.Users[0].First_name).To(Equal("John"))
+		Expect(page.HasNext()).To(BeTrue())
+
+		page, err = repo.ListUsers(ctx, repository.ListOptions{NamePrefix: "SMI"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page.Users).To(HaveLen(1))
+		Expect(page.Users[0].User_name).To(Equal("asmith01"))
+
+		_, err = repo.ListUsers(ctx, repository.ListOptions{SortBy: "password"})
+		Expect(err).To(MatchError(repository.ErrInvalidListOptions))
+	})
+
+	It("should walk pages using the returned cursor", func() {
+		opts := repository.ListOptions{Size: 2, SortBy: "last_name"}
+		first, err := repo.ListUsersAfter(ctx, opts, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first.Users).To(HaveLen(2))
+		Expect(first.Users[0].Last_name).To(Equal("Doe"))
+		Expect(first.NextCursor).NotTo(BeEmpty())
+
+		second, err := repo.ListUsersAfter(ctx, opts, first.NextCursor)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second.Users).To(HaveLen(1))
+		Expect(second.Users[0].Last_name).To(Equal("White"))
+		Expect(second.NextCursor).To(BeEmpty())
+
+		_, err = repo.ListUsersAfter(ctx, repository.ListOptions{Size: 2, SortBy: "email"}, first.NextCursor)
+		Expect(err).To(MatchError(repository.ErrInvalidListOptions))
+	})
+
+	It("should soft delete, restore and purge users", func() {
+		Expect(repo.DeleteUserByID(ctx, 2, 2)).To(MatchError(repository.ErrVersionMismatch))
+		Expect(repo.DeleteUserByID(ctx, 2, 1)).To(Succeed())
+
+		_, err := repo.GetUserByID(ctx, 2)
+		Expect(err).To(Equal(repository.ErrUserNotFound))
+		deleted, err := repo.GetUserByIDIncludingDeleted(ctx, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted.Deleted_at).NotTo(BeNil())
+
+		users, err := repo.GetAllUsers(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(users).To(HaveLen(2))
+
+		restored, err := repo.RestoreUser(ctx, 2, deleted.Version)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored.Deleted_at).To(BeNil())
+		Expect(restored.Version).To(Equal(3))
+		_, err = repo.RestoreUser(ctx, 2, repository.AnyVersion)
+		Expect(err).To(Equal(repository.ErrUserNotDeleted))
+
+		Expect(repo.DeleteUserByID(ctx, 3, repository.AnyVersion)).To(Succeed())
+		n, err := repo.PurgeDeletedUsers(ctx, time.Now().Add(-time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(0))
+		n, err = repo.PurgeDeletedUsers(ctx, time.Now().Add(time.Second))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(1))
+		_, err = repo.GetUserByIDIncludingDeleted(ctx, 3)
+		Expect(err).To(Equal(repository.ErrUserNotFound))
+	})
+
+	It("should fail with a timeout once the context is done", func() {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := repo.GetUserByID(cancelled, 1)
+		Expect(err).To(MatchError(repository.ErrTimeout))
+	})
+
+	It("should be selected by USER_REPOSITORY", func() {
+		DeferCleanup(os.Unsetenv, "USER_REPOSITORY")
+
+		os.Setenv("USER_REPOSITORY", "Memory")
+		Expect(repository.BackendFromEnv()).To(Equal(repository.BackendMemory))
+
+		os.Unsetenv("USER_REPOSITORY")
+		Expect(repository.BackendFromEnv()).To(Equal(repository.BackendPostgres))
+
+		os.Setenv("USER_REPOSITORY", "mongo")
+		_, err := repository.BackendFromEnv()
+		Expect(err).To(HaveOccurred())
+	})
+})
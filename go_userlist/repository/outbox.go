@@ -0,0 +1,297 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+)
+
+// Kafka topics user change events are published to.
+const (
+	TopicUserCreate  = "prism-user-create"
+	TopicUserUpdate  = "prism-user-update"
+	TopicUserDelete  = "prism-user-delete"
+	TopicUserRestore = "prism-user-restore"
+	TopicUserPurge   = "prism-user-purge"
+)
+
+// Kafka topics department change events are published to.
+const (
+	TopicDepartmentCreate = "prism-department-create"
+	TopicDepartmentUpdate = "prism-department-update"
+	TopicDepartmentDelete = "prism-department-delete"
+)
+
+const (
+	// DefaultOutboxBatchSize is the number of pending outbox rows relayed per round trip.
+	DefaultOutboxBatchSize = 100
+	// DefaultOutboxPollInterval is how long the relay waits before polling an empty outbox again.
+	DefaultOutboxPollInterval = time.Second
+
+	// outboxRelayLock is the transaction-level advisory lock a relay holds while it publishes.
+	outboxRelayLock int64 = 0x7573_6572_6f75_7462 // "useroutb"
+)
+
+// Publisher delivers an already serialized event to a Kafka topic. Publish gives up waiting
+// for the delivery once ctx is done.
+type Publisher interface {
+	Publish(ctx context.Context, topic, key string, value []byte) error
+}
+
+// AsyncPublisher is a Publisher that can also queue a message without waiting for it to be
+// delivered; done is called once with the delivery result.
+type AsyncPublisher interface {
+	Publisher
+	PublishAsync(ctx context.Context, topic, key string, value []byte, done func(error))
+}
+
+// PublisherFunc adapts an ordinary function to the Publisher interface.
+type PublisherFunc func(ctx context.Context, topic, key string, value []byte) error
+
+// Publish calls f(ctx, topic, key, value).
+func (f PublisherFunc) Publish(ctx context.Context, topic, key string, value []byte) error {
+	return f(ctx, topic, key, value)
+}
+
+// dbtx is the subset of *sql.DB and *sql.Tx the repository issues statements through.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// withTx runs fn inside a database transaction, committing when fn succeeds and rolling back otherwise.
+// The transaction is rolled back if ctx is done before it commits. Driver errors are classified
+// with wrapDBError.
+func (r *PostgresUserRepository) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapDBError(err)
+	}
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("error rolling back transaction: %v", rbErr)
+		}
+		return wrapDBError(err)
+	}
+
+	return wrapDBError(tx.Commit())
+}
+
+// enqueueEvent records a change event for the user or department with the given id in the outbox
+// as part of the caller's transaction. The relay publishes it once the transaction has committed.
+// The envelope carries the EventMetadata attached to ctx with WithEventMetadata.
+func (r *PostgresUserRepository) enqueueEvent(ctx context.Context, tx dbtx, eventType string, id int, payload, previous interface{}) error {
+	data, err := json.Marshal(newEventEnvelope(eventType, EventMetadataFromContext(ctx), payload, previous))
+	if err != nil {
+		return fmt.Errorf("error serializing event data: %w", err)
+	}
+
+	query, args, err := r.psql.Insert("public.user_outbox").
+		Columns("topic", "message_key", "payload").
+		Values(eventTopics[eventType], strconv.Itoa(id), data).ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// outboxMessage is one pending row of public.user_outbox.
+type outboxMessage struct {
+	id      int64
+	topic   string
+	key     string
+	payload []byte
+}
+
+// OutboxRelay publishes pending rows of the user outbox to Kafka and marks them sent.
+type OutboxRelay struct {
+	db        *sql.DB
+	psql      squirrel.StatementBuilderType
+	publisher Publisher
+	interval  time.Duration
+	batchSize int
+}
+
+// NewOutboxRelay creates a relay that drains the repository's outbox through the publisher
+// the repository was created with (see WithPublisher).
+func (r *PostgresUserRepository) NewOutboxRelay() *OutboxRelay {
+	return &OutboxRelay{
+		db:        r.db,
+		psql:      r.psql,
+		publisher: r.publisher,
+		interval:  DefaultOutboxPollInterval,
+		batchSize: DefaultOutboxBatchSize,
+	}
+}
+
+// Run relays pending outbox rows until ctx is cancelled. A full batch is followed immediately
+// by the next one; otherwise the relay sleeps for its poll interval.
+func (o *OutboxRelay) Run(ctx context.Context) {
+	for {
+		sent, err := o.RelayPending(ctx)
+		if err != nil {
+			log.Printf("error relaying outbox: %v", err)
+		}
+
+		if err != nil || sent < o.batchSize {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(o.interval):
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// RelayPending publishes one batch of pending outbox rows, in insertion order for each key, and
+// marks the published rows sent. Only one relay publishes at a time, across every server instance, so
+// events with the same key are never in flight from two relays at once; a relay that finds
+// another one busy publishes nothing and returns 0. Only delivered rows are marked sent, and a
+// row is only published once the earlier rows with its key were delivered, so a failed row and
+// the later rows with its key are retried in order on the next round.
+func (o *OutboxRelay) RelayPending(ctx context.Context) (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The lock is released when the transaction ends.
+	var locked bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", outboxRelayLock).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	query, args, err := o.psql.Select("outbox_id", "topic", "message_key", "payload").
+		From("public.user_outbox").
+		Where(squirrel.Eq{"sent_at": nil}).
+		OrderBy("outbox_id").
+		Limit(uint64(o.batchSize)).ToSql()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	var pending []outboxMessage
+	for rows.Next() {
+		var m outboxMessage
+		if err := rows.Scan(&m.id, &m.topic, &m.key, &m.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent, publishErr := o.publish(ctx, pending)
+
+	if len(sent) > 0 {
+		query, args, err := o.psql.Update("public.user_outbox").
+			Set("sent_at", squirrel.Expr("now()")).
+			Where(squirrel.Eq{"outbox_id": sent}).ToSql()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(sent), publishErr
+}
+
+// publish sends the messages and returns the ids of those that were delivered, together with
+// the first delivery error. A synchronous Publisher sends them one by one and stops at the first
+// failure. An AsyncPublisher is sent them in waves, each holding the next message of every key
+// whose earlier messages were all delivered, so messages with the same key are delivered in
+// order and none is sent after one with its key failed.
+func (o *OutboxRelay) publish(ctx context.Context, pending []outboxMessage) ([]int64, error) {
+	results := make([]error, len(pending))
+	attempted := make([]bool, len(pending))
+
+	if async, ok := o.publisher.(AsyncPublisher); ok {
+		// queues holds the indexes of each key's messages in insertion order; keys lists the keys
+		// in the order they first appear.
+		queues := map[string][]int{}
+		var keys []string
+		for i, m := range pending {
+			if _, ok := queues[m.key]; !ok {
+				keys = append(keys, m.key)
+			}
+			queues[m.key] = append(queues[m.key], i)
+		}
+
+		for len(keys) > 0 {
+			var wg sync.WaitGroup
+			wg.Add(len(keys))
+			for _, key := range keys {
+				i := queues[key][0]
+				attempted[i] = true
+				m := pending[i]
+				async.PublishAsync(ctx, m.topic, m.key, m.payload, func(err error) {
+					results[i] = err
+					wg.Done()
+				})
+			}
+			wg.Wait()
+
+			next := keys[:0]
+			for _, key := range keys {
+				if results[queues[key][0]] == nil && len(queues[key]) > 1 {
+					queues[key] = queues[key][1:]
+					next = append(next, key)
+				}
+			}
+			keys = next
+		}
+	} else {
+		for i, m := range pending {
+			attempted[i] = true
+			if results[i] = o.publisher.Publish(ctx, m.topic, m.key, m.payload); results[i] != nil {
+				break
+			}
+		}
+	}
+
+	var sent []int64
+	var firstErr error
+	for i, m := range pending {
+		switch {
+		case !attempted[i]:
+		case results[i] != nil:
+			if firstErr == nil {
+				firstErr = results[i]
+			}
+		default:
+			sent = append(sent, m.id)
+		}
+	}
+	return sent, firstErr
+}
@@ -1,12 +1,21 @@
 package repository_test
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"go_userlist/repository"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/IBM/sarama"
+	"github.com/lib/pq"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -16,6 +25,7 @@ var _ = Describe("PostgresUserRepository", func() {
 		repo *repository.PostgresUserRepository
 		mock sqlmock.Sqlmock
 		db   *sql.DB
+		ctx  = context.Background()
 	)
 
 	BeforeEach(func() {
@@ -45,13 +55,59 @@ var _ = Describe("PostgresUserRepository", func() {
 				Department:  "IT",
 			}
 
+			mock.ExpectBegin()
 			mock.ExpectQuery(`INSERT INTO public\.users`).
 				WithArgs(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, user.Department).
-				WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "version"}).AddRow(1, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox \(topic,message_key,payload\)`).
+				WithArgs(repository.TopicUserCreate, "1", eventArg{
+					eventType: repository.EventUserCreated,
+					payload:   `{"user_id":1,"user_name":"johndoe","first_name":"John","last_name":"Doe","email":"john.doe@example.com","user_status":"active","department":"IT","version":1}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
 
-			err := repo.CreateUser(user)
+			err := repo.CreateUser(ctx, user)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(user.User_id).To(Equal(1))
+			Expect(user.Version).To(Equal(1))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should stamp the event with the actor and correlation id", func() {
+			user := &repository.User{User_name: "johndoe", Email: "john.doe@example.com"}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users`).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "version"}).AddRow(42, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserCreate, "42", eventArg{
+					eventType:     repository.EventUserCreated,
+					payload:       `{"user_id":42,"user_name":"johndoe","first_name":"","last_name":"","email":"john.doe@example.com","user_status":"","department":"","version":1}`,
+					actor:         "admin",
+					correlationID: "req-1",
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			err := repo.CreateUser(repository.WithEventMetadata(ctx, repository.EventMetadata{Actor: "admin", CorrelationID: "req-1"}), user)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should return a DuplicateUserError naming the field of a unique violation", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users`).
+				WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_key"})
+			mock.ExpectRollback()
+
+			err := repo.CreateUser(ctx, &repository.User{User_name: "jdoe02", Email: "JDOE01@example.com"})
+			Expect(err).To(MatchError(repository.ErrDuplicateUser))
+
+			var dupErr *repository.DuplicateUserError
+			Expect(errors.As(err, &dupErr)).To(BeTrue())
+			Expect(dupErr.Field).To(Equal("email"))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
 		})
 
 		It("should return an error if insertion fails", func() {
@@ -64,12 +120,15 @@ var _ = Describe("PostgresUserRepository", func() {
 				Department:  "IT",
 			}
 
+			mock.ExpectBegin()
 			mock.ExpectQuery(`INSERT INTO public\.users`).
 				WithArgs(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, user.Department).
 				WillReturnError(errors.New("insert error"))
+			mock.ExpectRollback()
 
-			err := repo.CreateUser(user)
+			err := repo.CreateUser(ctx, user)
 			Expect(err).To(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
 		})
 	})
 
@@ -78,10 +137,10 @@ var _ = Describe("PostgresUserRepository", func() {
 			userID := 1
 			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
 				WithArgs(userID).
-				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department"}).
-					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT"))
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT", 1, nil))
 
-			user, err := repo.GetUserByID(userID)
+			user, err := repo.GetUserByID(ctx, userID)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(user).NotTo(BeNil())
 			Expect(user.User_id).To(Equal(1))
@@ -94,10 +153,35 @@ var _ = Describe("PostgresUserRepository", func() {
 				WithArgs(userID).
 				WillReturnError(sql.ErrNoRows)
 
-			user, err := repo.GetUserByID(userID)
+			user, err := repo.GetUserByID(ctx, userID)
 			Expect(err).To(Equal(repository.ErrUserNotFound))
 			Expect(user).To(BeNil())
 		})
+
+		It("should stop waiting for a slow query when the context deadline passes", func() {
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillDelayFor(time.Second).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+
+			timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := repo.GetUserByID(timeoutCtx, 1)
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+
+		It("should report an expired context as a timeout without touching the database", func() {
+			expiredCtx, cancel := context.WithTimeout(ctx, 0)
+			defer cancel()
+
+			err := repo.DeleteUserByID(expiredCtx, 1, repository.AnyVersion)
+			Expect(err).To(MatchError(repository.ErrTimeout))
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
 	})
 
 	Context("UpdateUser", func() {
@@ -112,12 +196,69 @@ var _ = Describe("PostgresUserRepository", func() {
 				Department:  "IT",
 			}
 
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+				WithArgs(user.User_id).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "HR", 1, nil))
 			mock.ExpectExec(`UPDATE public\.users`).
-				WithArgs(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, user.Department, user.User_id).
+				WithArgs(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, user.Department, user.User_id, 1).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserUpdate, "1", eventArg{
+					eventType: repository.EventUserUpdated,
+					payload:   `{"user_id":1,"changes":{"department":{"before":"HR","after":"IT"}}}`,
+					previous:  `{"user_id":1,"user_name":"johndoe","first_name":"John","last_name":"Doe","email":"john.doe@example.com","user_status":"active","department":"HR","version":1}`,
+				}).
 				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
 
-			err := repo.UpdateUser(user)
+			err := repo.UpdateUser(ctx, user)
 			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Version).To(Equal(2))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should not record an event when nothing changed", func() {
+			user := &repository.User{User_id: 1, User_name: "johndoe", Email: "john.doe@example.com"}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "", "", "john.doe@example.com", "", "", 1, nil))
+			mock.ExpectExec(`UPDATE public\.users`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			err := repo.UpdateUser(ctx, user)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should return ErrUserNotFound if the user doesn't exist", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(999).
+				WillReturnError(sql.ErrNoRows)
+			mock.ExpectRollback()
+
+			err := repo.UpdateUser(ctx, &repository.User{User_id: 999, User_name: "ghost"})
+			Expect(err).To(Equal(repository.ErrUserNotFound))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should return ErrVersionMismatch without writing when the user changed since it was read", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "HR", 3, nil))
+			mock.ExpectRollback()
+
+			err := repo.UpdateUser(ctx, &repository.User{User_id: 1, User_name: "johndoe", Email: "john.doe@example.com", Version: 2})
+			Expect(err).To(Equal(repository.ErrVersionMismatch))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
 		})
 
 		It("should return an error if update fails", func() {
@@ -131,46 +272,1279 @@ var _ = Describe("PostgresUserRepository", func() {
 				Department:  "IT",
 			}
 
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(user.User_id).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT", 1, nil))
 			mock.ExpectExec(`UPDATE public\.users`).
-				WithArgs(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, user.Department, user.User_id).
+				WithArgs(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, user.Department, user.User_id, 1).
 				WillReturnError(errors.New("update error"))
+			mock.ExpectRollback()
 
-			err := repo.UpdateUser(user)
+			err := repo.UpdateUser(ctx, user)
 			Expect(err).To(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("UpsertUser", func() {
+		It("should create a missing user with the given id and move the id sequence past it", func() {
+			user := &repository.User{User_id: 40, User_name: "jdoe40", Email: "jdoe40@example.com"}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users \(user_id,user_name,first_name,last_name,email,user_status,department\) VALUES \(.+\) ON CONFLICT \(user_id\) DO NOTHING RETURNING version`).
+				WithArgs(40, "jdoe40", "", "", "jdoe40@example.com", "", nil).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+			mock.ExpectExec(`SELECT setval\(pg_get_serial_sequence\('public\.users', 'user_id'\), GREATEST\(\$1, nextval`).
+				WithArgs(40).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserCreate, "40", eventArg{
+					eventType: repository.EventUserCreated,
+					payload:   `{"user_id":40,"user_name":"jdoe40","first_name":"","last_name":"","email":"jdoe40@example.com","user_status":"","department":"","version":1}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			created, err := repo.UpsertUser(ctx, user)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created).To(BeTrue())
+			Expect(user.Version).To(Equal(1))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should update the user when the id is taken", func() {
+			user := &repository.User{User_id: 1, User_name: "johndoe", Email: "john.doe@example.com", Version: 1}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users (.+) ON CONFLICT \(user_id\) DO NOTHING`).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "", "", "john.doe@example.com", "", "HR", 1, nil))
+			mock.ExpectExec(`UPDATE public\.users`).
+				WithArgs("johndoe", "", "", "john.doe@example.com", "", nil, 1, 1).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserUpdate, "1", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			created, err := repo.UpsertUser(ctx, user)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created).To(BeFalse())
+			Expect(user.Version).To(Equal(2))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should not create a user when a version was expected", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users`).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+			mock.ExpectRollback()
+
+			_, err := repo.UpsertUser(ctx, &repository.User{User_id: 40, User_name: "jdoe40", Email: "jdoe40@example.com", Version: 3})
+			Expect(err).To(Equal(repository.ErrVersionMismatch))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("PatchUser", func() {
+		It("should update the given fields and record only the changed fields in the outbox", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "IT", 1, nil))
+			mock.ExpectExec(`UPDATE public\.users SET version = version \+ 1, department = \$1 WHERE user_id = \$2 AND version = \$3`).
+				WithArgs("Legal", 1, 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "Legal", 2, nil))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserUpdate, "1", eventArg{
+					eventType: repository.EventUserUpdated,
+					payload:   `{"user_id":1,"changes":{"department":{"before":"IT","after":"Legal"}}}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			err := repo.PatchUser(ctx, 1, repository.AnyVersion, map[string]interface{}{"department": "Legal"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should report a user_name taken by another user", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "IT", 1, nil))
+			mock.ExpectExec(`UPDATE public\.users`).
+				WillReturnError(&pq.Error{Code: "23505", Constraint: "users_user_name_key"})
+			mock.ExpectRollback()
+
+			err := repo.PatchUser(ctx, 1, repository.AnyVersion, map[string]interface{}{"user_name": "JDoe01"})
+			Expect(err).To(Equal(&repository.DuplicateUserError{Field: "user_name"}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should return ErrVersionMismatch when the expected version is stale", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "IT", 5, nil))
+			mock.ExpectRollback()
+
+			err := repo.PatchUser(ctx, 1, 4, map[string]interface{}{"department": "Legal"})
+			Expect(err).To(Equal(repository.ErrVersionMismatch))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should not record an event if the update fails", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "IT", 1, nil))
+			mock.ExpectExec(`UPDATE public\.users`).
+				WillReturnError(errors.New("update error"))
+			mock.ExpectRollback()
+
+			err := repo.PatchUser(ctx, 1, repository.AnyVersion, map[string]interface{}{"department": "Legal"})
+			Expect(err).To(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("ModifyUser", func() {
+		It("should apply the updates computed from the locked record in one transaction", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "IT", 1, nil))
+			mock.ExpectExec(`UPDATE public\.users SET version = version \+ 1, user_status = \$1 WHERE user_id = \$2 AND version = \$3`).
+				WithArgs("I", 1, 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "I", "IT", 2, nil))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			var seen repository.User
+			err := repo.ModifyUser(ctx, 1, repository.AnyVersion, func(current repository.User) (map[string]interface{}, error) {
+				seen = current
+				return map[string]interface{}{"user_status": "I"}, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(seen.User_status).To(Equal("A"))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should roll back and return the error from modify", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "IT", 1, nil))
+			mock.ExpectRollback()
+
+			conflict := errors.New("precondition failed")
+			err := repo.ModifyUser(ctx, 1, repository.AnyVersion, func(current repository.User) (map[string]interface{}, error) {
+				return nil, conflict
+			})
+			Expect(err).To(Equal(conflict))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should reject immutable fields in the computed updates", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "A", "IT", 1, nil))
+			mock.ExpectRollback()
+
+			err := repo.ModifyUser(ctx, 1, repository.AnyVersion, func(current repository.User) (map[string]interface{}, error) {
+				return map[string]interface{}{"user_id": 2.0}, nil
+			})
+			Expect(err).To(MatchError(repository.ErrInvalidPatch))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("PatchColumns", func() {
+		It("should map json names to columns and accept null for optional fields", func() {
+			columns, err := repository.PatchColumns(map[string]interface{}{"department": "HR", "first_name": nil})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(columns).To(Equal(map[string]interface{}{"department": "HR", "first_name": ""}))
+		})
+
+		It("should report unknown, immutable and invalid fields together", func() {
+			_, err := repository.PatchColumns(map[string]interface{}{
+				"user_id":     7,
+				"password":    "secret",
+				"is_admin":    true,
+				"user_status": "Active",
+				"email":       42.0,
+				"user_name":   nil,
+			})
+			Expect(err).To(MatchError(repository.ErrInvalidPatch))
+
+			var patchErr *repository.PatchError
+			Expect(errors.As(err, &patchErr)).To(BeTrue())
+			Expect(patchErr.Unknown).To(Equal([]string{"is_admin", "password"}))
+			Expect(patchErr.Immutable).To(Equal([]string{"user_id"}))
+			Expect(patchErr.Invalid).To(HaveKeyWithValue("user_status", "must be at most 1 characters"))
+			Expect(patchErr.Invalid).To(HaveKeyWithValue("email", "must be a string, got float64"))
+			Expect(patchErr.Invalid).To(HaveKeyWithValue("user_name", "must not be null"))
+		})
+
+		It("should reject an empty patch", func() {
+			_, err := repository.PatchColumns(map[string]interface{}{})
+			Expect(err).To(MatchError(repository.ErrInvalidPatch))
+		})
+
+		It("should keep PatchUser from touching the database when the patch is invalid", func() {
+			err := repo.PatchUser(ctx, 1, repository.AnyVersion, map[string]interface{}{"user_id": 2})
+			Expect(err).To(MatchError(repository.ErrInvalidPatch))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("ValidateUser", func() {
+		It("should accept a complete, well-formed user", func() {
+			Expect(repository.ValidateUser(&repository.User{
+				User_name:   "jdoe.01",
+				Email:       "jdoe01@example.com",
+				User_status: "A",
+				Department:  "HR",
+			})).To(Succeed())
+		})
+
+		It("should report every invalid field with a code in registry order", func() {
+			err := repository.ValidateUser(&repository.User{
+				User_name:   "john doe",
+				Last_name:   strings.Repeat("x", 256),
+				Email:       "John <jdoe@example.com>",
+				User_status: "X",
+			})
+			Expect(err).To(MatchError(repository.ErrValidation))
+
+			var validationErr *repository.ValidationError
+			Expect(errors.As(err, &validationErr)).To(BeTrue())
+			Expect(validationErr.Fields).To(Equal([]repository.FieldError{
+				{Field: "user_name", Code: repository.CodePattern, Message: "may only contain letters, digits, '.', '_' and '-'"},
+				{Field: "last_name", Code: repository.CodeMaxLength, Message: "must be at most 255 characters"},
+				{Field: "email", Code: repository.CodeFormat, Message: "must be a valid email address"},
+				{Field: "user_status", Code: repository.CodeOneOf, Message: "must be one of A, I"},
+			}))
+		})
+
+		It("should require user_name and email", func() {
+			var validationErr *repository.ValidationError
+			Expect(errors.As(repository.ValidateUser(&repository.User{User_name: "  "}), &validationErr)).To(BeTrue())
+			Expect(validationErr.Fields).To(ConsistOf(
+				repository.FieldError{Field: "user_name", Code: repository.CodeRequired, Message: "must not be empty"},
+				repository.FieldError{Field: "email", Code: repository.CodeRequired, Message: "must not be empty"},
+			))
+		})
+
+		It("should build users from import records and reject fields that cannot be set", func() {
+			user, err := repository.UserFromFields(map[string]interface{}{"user_name": "jdoe01", "email": "jdoe01@example.com", "department": nil})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*user).To(Equal(repository.User{User_name: "jdoe01", Email: "jdoe01@example.com"}))
+
+			_, err = repository.UserFromFields(map[string]interface{}{"version": "3", "password": "x", "last_name": 7})
+			Expect(err).To(MatchError(repository.ErrValidation))
+			var validationErr *repository.ValidationError
+			Expect(errors.As(err, &validationErr)).To(BeTrue())
+			Expect(validationErr.Fields).To(Equal([]repository.FieldError{
+				{Field: "last_name", Code: repository.CodeType, Message: "must be a string"},
+				{Field: "password", Code: repository.CodeUnknown, Message: "is not a user field"},
+				{Field: "version", Code: repository.CodeImmutable, Message: "is assigned by the server"},
+			}))
+		})
+
+		It("should apply the same rules to partial updates", func() {
+			_, err := repository.PatchColumns(map[string]interface{}{"email": "not-an-email", "user_status": "Z"})
+
+			var patchErr *repository.PatchError
+			Expect(errors.As(err, &patchErr)).To(BeTrue())
+			Expect(patchErr.Invalid).To(Equal(map[string]string{
+				"email":       "must be a valid email address",
+				"user_status": "must be one of A, I",
+			}))
+		})
+	})
+
+	Context("Errors", func() {
+		It("should give every specific error a code and a category", func() {
+			Expect(repository.ErrUserNotFound).To(MatchError(repository.ErrNotFound))
+			Expect(repository.ErrorCode(repository.ErrUserNotFound)).To(Equal("user_not_found"))
+			Expect(repository.ErrVersionMismatch).To(MatchError(repository.ErrConflict))
+			Expect(repository.ErrorCode(&repository.DuplicateUserError{Field: "email"})).To(Equal("duplicate_user"))
+			Expect(repository.ErrorCode(&repository.PatchError{Empty: true})).To(Equal("invalid_patch"))
+			Expect(repository.ErrorCode(errors.New("boom"))).To(Equal("internal_error"))
+		})
+
+		It("should classify driver errors and keep them for logging", func() {
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnError(&pq.Error{Code: "57014", Message: "canceling statement due to statement timeout"})
+
+			_, err := repo.GetUserByID(ctx, 1)
+			Expect(err).To(MatchError(repository.ErrTimeout))
+			Expect(repository.ErrorCode(err)).To(Equal("timeout"))
+
+			var pqErr *pq.Error
+			Expect(errors.As(err, &pqErr)).To(BeTrue())
+		})
+
+		It("should report unreachable databases as unavailable", func() {
+			mock.ExpectBegin().WillReturnError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+
+			err := repo.DeleteUserByID(ctx, 1, repository.AnyVersion)
+			Expect(err).To(MatchError(repository.ErrUnavailable))
 		})
 	})
 
 	Context("DeleteUserByID", func() {
-		It("should delete the user successfully", func() {
+		It("should soft delete the user", func() {
 			userID := 1
+			deletedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
 
+			mock.ExpectBegin()
 			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
 				WithArgs(userID).
-				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department"}).
-					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT"))
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT", 1, nil))
 
-			mock.ExpectExec(`DELETE FROM public\.users`).
-				WithArgs(userID).
+			mock.ExpectQuery(`UPDATE public\.users SET deleted_at = now\(\), version = version \+ 1 WHERE user_id = \$1 AND version = \$2 RETURNING deleted_at, version`).
+				WithArgs(userID, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"deleted_at", "version"}).AddRow(deletedAt, 2))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserDelete, "1", eventArg{
+					eventType: repository.EventUserDeleted,
+					payload:   `{"user_id":1,"user_name":"johndoe","first_name":"John","last_name":"Doe","email":"john.doe@example.com","user_status":"active","department":"IT","version":2,"deleted_at":"2024-05-01T12:00:00Z"}`,
+				}).
 				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
 
-			err := repo.DeleteUserByID(userID)
+			err := repo.DeleteUserByID(ctx, userID, repository.AnyVersion)
 			Expect(err).NotTo(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should return ErrVersionMismatch when the guarded update matches no row", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT", 2, nil))
+			mock.ExpectQuery(`UPDATE public\.users SET deleted_at = now\(\)`).
+				WithArgs(1, 2).
+				WillReturnError(sql.ErrNoRows)
+			mock.ExpectRollback()
+
+			err := repo.DeleteUserByID(ctx, 1, 2)
+			Expect(err).To(Equal(repository.ErrVersionMismatch))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
 		})
 
 		It("should return ErrUserNotFound if user doesn't exist", func() {
 			userID := 999
 
+			mock.ExpectBegin()
 			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
 				WithArgs(userID).
 				WillReturnError(sql.ErrNoRows)
+			mock.ExpectRollback()
 
-			err := repo.DeleteUserByID(userID)
+			err := repo.DeleteUserByID(ctx, userID, repository.AnyVersion)
 			Expect(err).To(Equal(repository.ErrUserNotFound))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("ApplyBulk", func() {
+		columns := []string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}
+		ops := []repository.BulkOperation{
+			{Op: repository.BulkCreate, User: repository.User{User_name: "johndoe", Email: "john.doe@example.com"}},
+			{Op: repository.BulkDelete, UserID: 9},
+		}
+
+		It("should run each operation in its own transaction and report each outcome", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users`).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "version"}).AddRow(4, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserCreate, "4", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+				WithArgs(9).
+				WillReturnError(sql.ErrNoRows)
+			mock.ExpectRollback()
+
+			results, err := repo.ApplyBulk(ctx, ops, repository.BulkOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results[0].UserID).To(Equal(4))
+			Expect(results[0].User.Version).To(Equal(1))
+			Expect(results[1]).To(Equal(repository.BulkResult{UserID: 9, Err: repository.ErrUserNotFound}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should roll an atomic request back at the first failure", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users`).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "version"}).AddRow(4, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(9).
+				WillReturnError(sql.ErrNoRows)
+			mock.ExpectRollback()
+
+			results, err := repo.ApplyBulk(ctx, ops, repository.BulkOptions{Atomic: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(Equal([]repository.BulkResult{
+				{Err: repository.ErrBulkAborted},
+				{UserID: 9, Err: repository.ErrUserNotFound},
+			}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should lock the users a filtered atomic patch matches before patching them", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT user_id FROM public\.users WHERE department = \$1 AND deleted_at IS NULL ORDER BY user_id FOR UPDATE$`).
+				WithArgs("Marketing").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+				WithArgs(3).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(3, "bwhite01", "Bob", "White", "bwhite01@example.com", "A", "Marketing", 1, nil))
+			mock.ExpectExec(`UPDATE public\.users SET version = version \+ 1, user_status = \$1 WHERE user_id = \$2 AND version = \$3`).
+				WithArgs("I", 3, 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1`).
+				WithArgs(3).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(3, "bwhite01", "Bob", "White", "bwhite01@example.com", "I", "Marketing", 2, nil))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserUpdate, "3", eventArg{
+					eventType: repository.EventUserUpdated,
+					payload:   `{"user_id":3,"changes":{"user_status":{"before":"A","after":"I"}}}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			results, err := repo.PatchMatchingUsers(ctx, repository.ListOptions{Department: "Marketing", SortBy: "last_name"},
+				map[string]interface{}{"user_status": "I"}, repository.BulkOptions{Atomic: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+			Expect(results[0].User.User_status).To(Equal("I"))
+			Expect(results[0].User.Version).To(Equal(2))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("RestoreUser", func() {
+		It("should clear deleted_at and record a restore event", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE user_id = \$1 FOR UPDATE`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT", 2, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+			mock.ExpectQuery(`UPDATE public\.users SET deleted_at = \$1, version = version \+ 1 WHERE user_id = \$2 AND version = \$3 RETURNING version`).
+				WithArgs(nil, 1, 2).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(3))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserRestore, "1", eventArg{
+					eventType: repository.EventUserRestored,
+					payload:   `{"user_id":1,"user_name":"johndoe","first_name":"John","last_name":"Doe","email":"john.doe@example.com","user_status":"active","department":"IT","version":3}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			user, err := repo.RestoreUser(ctx, 1, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Deleted_at).To(BeNil())
+			Expect(user.Version).To(Equal(3))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should return ErrUserNotDeleted for a user that is not deleted", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(1, "johndoe", "John", "Doe", "john.doe@example.com", "active", "IT", 1, nil))
+			mock.ExpectRollback()
+
+			_, err := repo.RestoreUser(ctx, 1, repository.AnyVersion)
+			Expect(err).To(Equal(repository.ErrUserNotDeleted))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("PurgeDeletedUsers", func() {
+		It("should hard delete users deleted before the cutoff and record a purge event for each", func() {
+			cutoff := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+			deletedAt := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`DELETE FROM public\.users WHERE deleted_at < \$1 RETURNING user_id, (.+), deleted_at`).
+				WithArgs(cutoff).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(3, "jdoe01", "John", "Doe", "jdoe01@example.com", "I", "HR", 4, deletedAt).
+					AddRow(7, "asmith01", "Alice", "Smith", "asmith01@example.com", "I", "IT", 2, deletedAt))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserPurge, "3", eventArg{
+					eventType: repository.EventUserPurged,
+					payload:   `{"user_id":3,"user_name":"jdoe01","first_name":"John","last_name":"Doe","email":"jdoe01@example.com","user_status":"I","department":"HR","version":4,"deleted_at":"2024-03-01T00:00:00Z"}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserPurge, "7", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			mock.ExpectCommit()
+
+			n, err := repo.PurgeDeletedUsers(ctx, cutoff)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("ImportUsers", func() {
+		users := func() []repository.User {
+			return []repository.User{
+				{User_name: "cjones01", Email: "cjones01@example.com", Department: "IT"},
+				{User_name: "jdoe01", Email: "jdoe.new@example.com"},
+				{User_name: "dgreen01", Email: "CJONES01@example.com"},
+			}
+		}
+
+		It("should skip taken names, COPY the rest and record their create events", func() {
+			batch := users()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT name FROM public\.departments WHERE name = ANY\(\$1\) FOR KEY SHARE`).
+				WithArgs(pq.Array([]string{"IT"})).
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("IT"))
+			mock.ExpectQuery(`SELECT lower\(user_name\), lower\(email\) FROM public\.users WHERE \(lower\(user_name\) = ANY\(\$1\) OR lower\(email\) = ANY\(\$2\)\)`).
+				WithArgs(pq.Array([]string{"cjones01", "jdoe01", "dgreen01"}), pq.Array([]string{"cjones01@example.com", "jdoe.new@example.com", "cjones01@example.com"})).
+				WillReturnRows(sqlmock.NewRows([]string{"lower", "lower"}).AddRow("jdoe01", "jdoe01@example.com"))
+			mock.ExpectExec(`SAVEPOINT import_copy`).WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn := mock.ExpectPrepare(`COPY "public"\."users" \("user_name", "first_name", "last_name", "email", "user_status", "department"\) FROM STDIN`)
+			copyIn.ExpectExec().
+				WithArgs("cjones01", "", "", "cjones01@example.com", "", "IT").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			copyIn.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE lower\(user_name\) = ANY\(\$1\)`).
+				WithArgs(pq.Array([]string{"cjones01"})).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(12, "cjones01", "", "", "cjones01@example.com", "", "IT", 1, nil))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserCreate, "12", eventArg{
+					eventType: repository.EventUserCreated,
+					payload:   `{"user_id":12,"user_name":"cjones01","first_name":"","last_name":"","email":"cjones01@example.com","user_status":"","department":"IT","version":1}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			skipped, err := repo.ImportUsers(ctx, batch, repository.ImportOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(skipped).To(Equal([]error{
+				nil,
+				&repository.DuplicateUserError{Field: "user_name"},
+				&repository.DuplicateUserError{Field: "email"},
+			}))
+			Expect(batch[0].User_id).To(Equal(12))
+			Expect(batch[0].Version).To(Equal(1))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should only check for unknown departments and duplicates on a dry run", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT name FROM public\.departments WHERE name = ANY\(\$1\)$`).
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("IT"))
+			mock.ExpectQuery(`SELECT lower\(user_name\), lower\(email\) FROM public\.users`).
+				WillReturnRows(sqlmock.NewRows([]string{"lower", "lower"}))
+			mock.ExpectCommit()
+
+			skipped, err := repo.ImportUsers(ctx, users(), repository.ImportOptions{DryRun: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(skipped).To(Equal([]error{nil, nil, &repository.DuplicateUserError{Field: "email"}}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should reject users naming an unknown department and only COPY the rest", func() {
+			batch := []repository.User{
+				{User_name: "cjones01", Email: "cjones01@example.com", Department: "Research"},
+				{User_name: "cjones01", Email: "cjones.it@example.com", Department: "IT"},
+				{User_name: "dgreen01", Email: "dgreen01@example.com", Department: "Research"},
+			}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT name FROM public\.departments WHERE name = ANY\(\$1\) FOR KEY SHARE`).
+				WithArgs(pq.Array([]string{"Research", "IT"})).
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("IT"))
+			mock.ExpectQuery(`SELECT lower\(user_name\)`).
+				WillReturnRows(sqlmock.NewRows([]string{"lower", "lower"}))
+			mock.ExpectExec(`SAVEPOINT import_copy`).WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn := mock.ExpectPrepare(`COPY`)
+			copyIn.ExpectExec().
+				WithArgs("cjones01", "", "", "cjones.it@example.com", "", "IT").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			copyIn.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE lower\(user_name\) = ANY\(\$1\)`).
+				WithArgs(pq.Array([]string{"cjones01"})).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(12, "cjones01", "", "", "cjones.it@example.com", "", "IT", 1, nil))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			rejected, err := repo.ImportUsers(ctx, batch, repository.ImportOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rejected).To(HaveLen(3))
+			Expect(rejected[0]).To(MatchError(repository.ErrValidation))
+			Expect(rejected[1]).NotTo(HaveOccurred())
+			Expect(rejected[2]).To(MatchError(repository.ErrValidation))
+			Expect(batch[1].User_id).To(Equal(12))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should insert the batch row by row, skipping only conflicts, when a name is taken during the COPY", func() {
+			batch := users()[:2]
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT name FROM public\.departments`).
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("IT"))
+			mock.ExpectQuery(`SELECT lower\(user_name\)`).
+				WillReturnRows(sqlmock.NewRows([]string{"lower", "lower"}))
+			mock.ExpectExec(`SAVEPOINT import_copy`).WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn := mock.ExpectPrepare(`COPY`)
+			copyIn.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+			copyIn.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+			copyIn.ExpectExec().WillReturnError(&pq.Error{Code: "23505", Constraint: "users_user_name_key"})
+			mock.ExpectExec(`ROLLBACK TO SAVEPOINT import_copy`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(`INSERT INTO public\.users \(user_name,first_name,last_name,email,user_status,department\) VALUES \(\$1,\$2,\$3,\$4,\$5,\$6\) ON CONFLICT DO NOTHING RETURNING user_id, version`).
+				WithArgs("cjones01", "", "", "cjones01@example.com", "", "IT").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "version"}).AddRow(12, 1))
+			mock.ExpectQuery(`INSERT INTO public\.users`).
+				WithArgs("jdoe01", "", "", "jdoe.new@example.com", "", nil).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "version"}))
+			mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM public\.users WHERE lower\(user_name\) = \$1\)`).
+				WithArgs("jdoe01").
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserCreate, "12", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			rejected, err := repo.ImportUsers(ctx, batch, repository.ImportOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rejected).To(Equal([]error{nil, &repository.DuplicateUserError{Field: "user_name"}}))
+			Expect(batch[0].User_id).To(Equal(12))
+			Expect(batch[0].Version).To(Equal(1))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should roll the whole batch back when the COPY fails otherwise", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT name FROM public\.departments`).
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("IT"))
+			mock.ExpectQuery(`SELECT lower\(user_name\)`).
+				WillReturnRows(sqlmock.NewRows([]string{"lower", "lower"}))
+			mock.ExpectExec(`SAVEPOINT import_copy`).WillReturnResult(sqlmock.NewResult(0, 0))
+			copyIn := mock.ExpectPrepare(`COPY`)
+			copyIn.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+			copyIn.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+			copyIn.ExpectExec().WillReturnError(&pq.Error{Code: "57014"})
+			mock.ExpectRollback()
+
+			_, err := repo.ImportUsers(ctx, users()[:2], repository.ImportOptions{})
+			Expect(err).To(MatchError(repository.ErrTimeout))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("PurgeRetentionFromEnv", func() {
+		It("should default to thirty days and parse durations", func() {
+			GinkgoT().Setenv("USER_PURGE_RETENTION", "")
+			retention, err := repository.PurgeRetentionFromEnv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retention).To(Equal(repository.DefaultPurgeRetention))
+
+			GinkgoT().Setenv("USER_PURGE_RETENTION", "168h")
+			retention, err = repository.PurgeRetentionFromEnv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retention).To(Equal(7 * 24 * time.Hour))
+
+			GinkgoT().Setenv("USER_PURGE_RETENTION", "-1h")
+			_, err = repository.PurgeRetentionFromEnv()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("ListUsers", func() {
+		It("should return a filtered, ordered page with the total count", func() {
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM public\.users WHERE department = \$1 AND user_status = \$2 AND deleted_at IS NULL`).
+				WithArgs("IT", "A").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE department = \$1 AND user_status = \$2 AND deleted_at IS NULL ORDER BY last_name desc, user_id desc LIMIT 2 OFFSET 2`).
+				WithArgs("IT", "A").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}).
+					AddRow(8, "aharris01", "Adam", "Harris", "aharris01@example.com", "A", "IT", 1, nil))
+
+			page, err := repo.ListUsers(ctx, repository.ListOptions{
+				Page:       2,
+				Size:       2,
+				SortBy:     "last_name",
+				SortDir:    "DESC",
+				Department: "IT",
+				UserStatus: "A",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Total).To(Equal(3))
+			Expect(page.Users).To(HaveLen(1))
+			Expect(page.Users[0].User_name).To(Equal("aharris01"))
+			Expect(page.HasNext()).To(BeFalse())
+		})
+
+		It("should match the name prefix case-insensitively with wildcards escaped", func() {
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM public\.users WHERE \(user_name ILIKE \$1 OR first_name ILIKE \$2 OR last_name ILIKE \$3\) AND deleted_at IS NULL`).
+				WithArgs(`jo\_%`, `jo\_%`, `jo\_%`).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE (.+) ORDER BY user_id asc LIMIT 25 OFFSET 0`).
+				WithArgs(`jo\_%`, `jo\_%`, `jo\_%`).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}))
+
+			page, err := repo.ListUsers(ctx, repository.ListOptions{NamePrefix: "jo_"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Users).To(BeEmpty())
+			Expect(page.Size).To(Equal(repository.DefaultPageSize))
+		})
+
+		It("should include soft deleted users only when asked to", func() {
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM public\.users$`).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users ORDER BY user_id asc LIMIT 25 OFFSET 0`).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}))
+
+			_, err := repo.ListUsers(ctx, repository.ListOptions{IncludeDeleted: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should reject unknown sort columns", func() {
+			_, err := repo.ListUsers(ctx, repository.ListOptions{SortBy: "password"})
+			Expect(err).To(MatchError(repository.ErrInvalidListOptions))
+		})
+	})
+
+	Context("ListUsersAfter", func() {
+		columns := []string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}
+
+		It("should walk pages using the returned cursor", func() {
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE deleted_at IS NULL ORDER BY COALESCE\(last_name, ''\) asc, user_id asc LIMIT 3`).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(2, "asmith01", "Alice", "Davis", "asmith01@example.com", "A", "Finance", 1, nil).
+					AddRow(1, "jdoe01", "John", "Doe", "jdoe01@example.com", "A", "HR", 1, nil).
+					AddRow(5, "mdavis01", "Mary", "Doe", "mdavis01@example.com", "I", "Sales", 1, nil))
+
+			first, err := repo.ListUsersAfter(ctx, repository.ListOptions{Size: 2, SortBy: "last_name"}, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first.Users).To(HaveLen(2))
+			Expect(first.NextCursor).NotTo(BeEmpty())
+
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE deleted_at IS NULL AND \(COALESCE\(last_name, ''\), user_id\) > \(\$1, \$2\) ORDER BY COALESCE\(last_name, ''\) asc, user_id asc LIMIT 3`).
+				WithArgs("Doe", 1).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(5, "mdavis01", "Mary", "Doe", "mdavis01@example.com", "I", "Sales", 1, nil))
+
+			second, err := repo.ListUsersAfter(ctx, repository.ListOptions{Size: 2, SortBy: "last_name"}, first.NextCursor)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(second.Users).To(HaveLen(1))
+			Expect(second.Users[0].User_id).To(Equal(5))
+			Expect(second.NextCursor).To(BeEmpty())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should compare only user_id when ordering by user_id descending", func() {
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE deleted_at IS NULL ORDER BY user_id desc LIMIT 2`).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(9, "tlee01", "Tina", "Lee", "tlee01@example.com", "A", "Legal", 1, nil).
+					AddRow(8, "aharris01", "Adam", "Harris", "aharris01@example.com", "A", "IT", 1, nil))
+
+			first, err := repo.ListUsersAfter(ctx, repository.ListOptions{Size: 1, SortDir: "desc"}, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE department = \$1 AND deleted_at IS NULL AND user_id < \$2 ORDER BY user_id desc LIMIT 2`).
+				WithArgs("IT", 9).
+				WillReturnRows(sqlmock.NewRows(columns))
+
+			_, err = repo.ListUsersAfter(ctx, repository.ListOptions{Size: 1, SortDir: "desc", Department: "IT"}, first.NextCursor)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should reject malformed cursors and cursors issued for another ordering", func() {
+			_, err := repo.ListUsersAfter(ctx, repository.ListOptions{}, "not a cursor")
+			Expect(err).To(MatchError(repository.ErrInvalidListOptions))
+
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(1, "jdoe01", "John", "Doe", "jdoe01@example.com", "A", "HR", 1, nil).
+					AddRow(2, "asmith01", "Alice", "Smith", "asmith01@example.com", "A", "Finance", 1, nil))
+
+			page, err := repo.ListUsersAfter(ctx, repository.ListOptions{Size: 1}, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = repo.ListUsersAfter(ctx, repository.ListOptions{Size: 1, SortBy: "email"}, page.NextCursor)
+			Expect(err).To(MatchError(repository.ErrInvalidListOptions))
+		})
+	})
+
+	Context("ExportUsers", func() {
+		columns := []string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"}
+
+		It("should pass every matching user to fn in order without paging", func() {
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users WHERE department = \$1 AND deleted_at IS NULL ORDER BY last_name desc, user_id desc$`).
+				WithArgs("HR").
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(3, "bwhite01", "Bob", "White", "bwhite01@example.com", "I", "HR", 1, nil).
+					AddRow(1, "jdoe01", "John", "Doe", "jdoe01@example.com", "A", "HR", 2, nil))
+
+			var names []string
+			err := repo.ExportUsers(ctx, repository.ListOptions{Department: "HR", SortBy: "last_name", SortDir: "desc", Page: 3, Size: 1},
+				func(u repository.User) error {
+					names = append(names, u.User_name)
+					return nil
+				})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(Equal([]string{"bwhite01", "jdoe01"}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should stop at the first error from fn and return it", func() {
+			mock.ExpectQuery(`SELECT (.+) FROM public\.users`).
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow(1, "jdoe01", "John", "Doe", "jdoe01@example.com", "A", "HR", 1, nil).
+					AddRow(2, "asmith01", "Alice", "Smith", "asmith01@example.com", "A", "IT", 1, nil))
+
+			writeErr := errors.New("client went away")
+			calls := 0
+			err := repo.ExportUsers(ctx, repository.ListOptions{}, func(repository.User) error {
+				calls++
+				return writeErr
+			})
+			Expect(err).To(Equal(writeErr))
+			Expect(calls).To(Equal(1))
+		})
+	})
+
+	Context("SearchUsers", func() {
+		It("should combine prefix and fuzzy matching and highlight the matches", func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(`SET LOCAL pg_trgm\.word_similarity_threshold = 0\.3`).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(`SELECT (.+), ts_rank\(to_tsvector\('simple', (.+)\), to_tsquery\('simple', \$1\)\) \+ word_similarity\(\$2, (.+)\) AS rank FROM public\.users `+
+				`WHERE \(to_tsvector\('simple', (.+)\) @@ to_tsquery\('simple', \$3\) OR \$4 <% \((.+)\)\) AND deleted_at IS NULL ORDER BY rank DESC, user_id LIMIT 5$`).
+				WithArgs("jon:* & do:*", "jon do", "jon:* & do:*", "jon do").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at", "rank"}).
+					AddRow(1, "jdoe01", "John", "Doe", "jdoe01@example.com", "A", "HR", 1, nil, 0.57))
+			mock.ExpectCommit()
+
+			hits, err := repo.SearchUsers(ctx, repository.SearchOptions{Query: "Jon, Do!", Limit: 5})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hits).To(HaveLen(1))
+			Expect(hits[0].User.User_name).To(Equal("jdoe01"))
+			Expect(hits[0].Rank).To(Equal(0.57))
+			Expect(hits[0].Highlights).To(HaveKeyWithValue("first_name", []repository.Span{{Start: 0, End: 4}}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should not query the database for a query without words", func() {
+			_, err := repo.SearchUsers(ctx, repository.SearchOptions{Query: "@@"})
+			Expect(err).To(MatchError(repository.ErrInvalidSearch))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("SuggestValues", func() {
+		It("should count the live values starting with the prefix, most common first", func() {
+			mock.ExpectQuery(`SELECT department, count\(\*\) FROM public\.users WHERE lower\(department\) LIKE \$1 AND department <> \$2 AND deleted_at IS NULL `+
+				`GROUP BY department ORDER BY count\(\*\) DESC, department LIMIT 10$`).
+				WithArgs(`i\_t%`, "").
+				WillReturnRows(sqlmock.NewRows([]string{"department", "count"}).AddRow("I_T", 3).AddRow("i_t", 1))
+
+			suggestions, err := repo.SuggestValues(ctx, repository.SuggestOptions{Field: "department", Prefix: "I_T"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(suggestions).To(Equal([]repository.Suggestion{{Value: "I_T", Count: 3}, {Value: "i_t", Count: 1}}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should only suggest fields registered as suggestable", func() {
+			_, err := repo.SuggestValues(ctx, repository.SuggestOptions{Field: "email"})
+			Expect(err).To(MatchError(repository.ErrInvalidSuggest))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("Departments", func() {
+		departmentRows := func() *sqlmock.Rows {
+			return sqlmock.NewRows([]string{"department_id", "name", "description", "version"})
+		}
+		userRows := func() *sqlmock.Rows {
+			return sqlmock.NewRows([]string{"user_id", "user_name", "first_name", "last_name", "email", "user_status", "department", "version", "deleted_at"})
+		}
+
+		It("should create a department and record its create event", func() {
+			department := &repository.Department{Name: "Sales", Description: "Field sales"}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.departments \(name,description\) VALUES \(\$1,\$2\) RETURNING department_id, version`).
+				WithArgs("Sales", "Field sales").
+				WillReturnRows(sqlmock.NewRows([]string{"department_id", "version"}).AddRow(5, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicDepartmentCreate, "5", eventArg{
+					eventType: repository.EventDepartmentCreated,
+					payload:   `{"department_id":5,"name":"Sales","description":"Field sales","version":1}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			Expect(repo.CreateDepartment(ctx, department)).To(Succeed())
+			Expect(department.Department_id).To(Equal(5))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should report a name taken regardless of case as ErrDuplicateDepartment", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.departments`).
+				WillReturnError(&pq.Error{Code: "23505", Constraint: "departments_lower_name_key"})
+			mock.ExpectRollback()
+
+			err := repo.CreateDepartment(ctx, &repository.Department{Name: "sales"})
+			Expect(err).To(MatchError(repository.ErrDuplicateDepartment))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should report a user naming a missing department as a validation error", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO public\.users`).
+				WillReturnError(&pq.Error{Code: "23503", Constraint: "users_department_fkey"})
+			mock.ExpectRollback()
+
+			err := repo.CreateUser(ctx, &repository.User{User_name: "jdoe02", Email: "jdoe02@example.com", Department: "Sales"})
+			var verr *repository.ValidationError
+			Expect(errors.As(err, &verr)).To(BeTrue())
+			Expect(verr.Fields).To(Equal([]repository.FieldError{{Field: "department", Code: repository.CodeReference, Message: "must name an existing department"}}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should rename a department, bump its users and record every event", func() {
+			department := &repository.Department{Department_id: 3, Name: "Information Technology", Description: "Laptops", Version: 2}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT department_id, name, description, version FROM public\.departments WHERE department_id = \$1 FOR UPDATE`).
+				WithArgs(3).
+				WillReturnRows(departmentRows().AddRow(3, "IT", "Laptops", 2))
+			mock.ExpectQuery(`UPDATE public\.departments SET name = \$1, description = \$2, version = version \+ 1 WHERE department_id = \$3 RETURNING version`).
+				WithArgs("Information Technology", "Laptops", 3).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(3))
+			mock.ExpectQuery(`UPDATE public\.users SET version = version \+ 1 WHERE department = \$1 RETURNING user_id, (.+), deleted_at`).
+				WithArgs("Information Technology").
+				WillReturnRows(userRows().AddRow(7, "jdoe01", "John", "Doe", "jdoe01@example.com", "A", "Information Technology", 4, nil))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicUserUpdate, "7", eventArg{
+					eventType: repository.EventUserUpdated,
+					payload:   `{"user_id":7,"changes":{"department":{"before":"IT","after":"Information Technology"}}}`,
+					previous:  `{"user_id":7,"user_name":"jdoe01","first_name":"John","last_name":"Doe","email":"jdoe01@example.com","user_status":"A","department":"IT","version":3}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicDepartmentUpdate, "3", eventArg{
+					eventType: repository.EventDepartmentUpdated,
+					payload:   `{"department_id":3,"name":"Information Technology","description":"Laptops","version":3}`,
+					previous:  `{"department_id":3,"name":"IT","description":"Laptops","version":2}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			mock.ExpectCommit()
+
+			Expect(repo.UpdateDepartment(ctx, department)).To(Succeed())
+			Expect(department.Version).To(Equal(3))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should refuse to delete a department users still belong to", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.departments WHERE department_id = \$1 FOR UPDATE`).
+				WithArgs(3).
+				WillReturnRows(departmentRows().AddRow(3, "IT", "", 1))
+			mock.ExpectQuery(`SELECT count\(\*\) FROM public\.users WHERE department = \$1`).
+				WithArgs("IT").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+			mock.ExpectRollback()
+
+			err := repo.DeleteDepartmentByID(ctx, 3, 1)
+			Expect(err).To(MatchError(repository.ErrDepartmentInUse))
+			Expect(err.Error()).To(ContainSubstring("2 users"))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should delete an empty department and record its delete event", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT (.+) FROM public\.departments WHERE department_id = \$1 FOR UPDATE`).
+				WithArgs(4).
+				WillReturnRows(departmentRows().AddRow(4, "Sales", "", 1))
+			mock.ExpectQuery(`SELECT count\(\*\) FROM public\.users`).
+				WithArgs("Sales").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectExec(`DELETE FROM public\.departments WHERE department_id = \$1`).
+				WithArgs(4).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO public\.user_outbox`).
+				WithArgs(repository.TopicDepartmentDelete, "4", eventArg{
+					eventType: repository.EventDepartmentDeleted,
+					payload:   `{"department_id":4,"name":"Sales","description":"","version":1}`,
+				}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			Expect(repo.DeleteDepartmentByID(ctx, 4, repository.AnyVersion)).To(Succeed())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should validate department names and descriptions", func() {
+			Expect(repository.ValidateDepartment(&repository.Department{Name: "Sales"})).To(Succeed())
+
+			err := repository.ValidateDepartment(&repository.Department{Name: " Sales", Description: strings.Repeat("x", 1001)})
+			var verr *repository.ValidationError
+			Expect(errors.As(err, &verr)).To(BeTrue())
+			Expect(repository.ErrorCode(err)).To(Equal("invalid_department"))
+			Expect(verr.Fields).To(HaveLen(2))
+			Expect(verr.Fields[0].Code).To(Equal(repository.CodeFormat))
+			Expect(verr.Fields[1].Field).To(Equal("description"))
+		})
+	})
+
+	Context("OutboxRelay", func() {
+		var published []string
+
+		BeforeEach(func() {
+			published = nil
+		})
+
+		newRelay := func(publisher repository.Publisher) *repository.OutboxRelay {
+			relayRepo, err := repository.NewPostgresUserRepository(db, repository.WithPublisher(publisher))
+			Expect(err).NotTo(HaveOccurred())
+			return relayRepo.NewOutboxRelay()
+		}
+
+		It("should publish pending rows in order and mark them sent", func() {
+			relay := newRelay(repository.PublisherFunc(func(_ context.Context, topic, key string, value []byte) error {
+				published = append(published, topic+" "+key+" "+string(value))
+				return nil
+			}))
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+			mock.ExpectQuery(`SELECT outbox_id, topic, message_key, payload FROM public\.user_outbox WHERE sent_at IS NULL ORDER BY outbox_id LIMIT 100$`).
+				WillReturnRows(sqlmock.NewRows([]string{"outbox_id", "topic", "message_key", "payload"}).
+					AddRow(7, repository.TopicUserCreate, "1_a", []byte(`{"user_id":1}`)).
+					AddRow(8, repository.TopicUserDelete, "1_b", []byte(`{"user_id":1}`)))
+			mock.ExpectExec(`UPDATE public\.user_outbox SET sent_at = now\(\) WHERE outbox_id IN \(\$1,\$2\)`).
+				WithArgs(7, 8).
+				WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit()
+
+			sent, err := relay.RelayPending(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sent).To(Equal(2))
+			Expect(published).To(Equal([]string{
+				repository.TopicUserCreate + ` 1_a {"user_id":1}`,
+				repository.TopicUserDelete + ` 1_b {"user_id":1}`,
+			}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should publish nothing while another relay holds the lock", func() {
+			relay := newRelay(repository.PublisherFunc(func(_ context.Context, topic, key string, value []byte) error {
+				published = append(published, key)
+				return nil
+			}))
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(false))
+			mock.ExpectRollback()
+
+			sent, err := relay.RelayPending(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sent).To(BeZero())
+			Expect(published).To(BeEmpty())
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should stop at the first publish failure and only mark earlier rows sent", func() {
+			relay := newRelay(repository.PublisherFunc(func(_ context.Context, topic, key string, value []byte) error {
+				if key == "1_b" {
+					return errors.New("broker unavailable")
+				}
+				published = append(published, key)
+				return nil
+			}))
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock`).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.user_outbox`).
+				WillReturnRows(sqlmock.NewRows([]string{"outbox_id", "topic", "message_key", "payload"}).
+					AddRow(7, repository.TopicUserCreate, "1_a", []byte(`{}`)).
+					AddRow(8, repository.TopicUserUpdate, "1_b", []byte(`{}`)).
+					AddRow(9, repository.TopicUserDelete, "1_c", []byte(`{}`)))
+			mock.ExpectExec(`UPDATE public\.user_outbox SET sent_at = now\(\) WHERE outbox_id IN \(\$1\)`).
+				WithArgs(7).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			sent, err := relay.RelayPending(ctx)
+			Expect(err).To(MatchError("broker unavailable"))
+			Expect(sent).To(Equal(1))
+			Expect(published).To(Equal([]string{"1_a"}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+
+		It("should queue each key's messages in order on an async publisher and stop a key at its first failure", func() {
+			async := &fakeAsyncPublisher{fail: map[string]error{"1:b": errors.New("message too large")}}
+			relay := newRelay(async)
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock`).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+			mock.ExpectQuery(`SELECT (.+) FROM public\.user_outbox`).
+				WillReturnRows(sqlmock.NewRows([]string{"outbox_id", "topic", "message_key", "payload"}).
+					AddRow(7, repository.TopicUserCreate, "1", []byte(`a`)).
+					AddRow(8, repository.TopicUserCreate, "2", []byte(`a`)).
+					AddRow(9, repository.TopicUserUpdate, "1", []byte(`b`)).
+					AddRow(10, repository.TopicUserUpdate, "1", []byte(`c`)).
+					AddRow(11, repository.TopicUserUpdate, "2", []byte(`b`)).
+					AddRow(12, repository.TopicUserDelete, "2", []byte(`c`)))
+			mock.ExpectExec(`UPDATE public\.user_outbox SET sent_at = now\(\) WHERE outbox_id IN \(\$1,\$2,\$3,\$4\)`).
+				WithArgs(7, 8, 11, 12).
+				WillReturnResult(sqlmock.NewResult(0, 4))
+			mock.ExpectCommit()
+
+			sent, err := relay.RelayPending(ctx)
+			Expect(err).To(MatchError("message too large"))
+			Expect(sent).To(Equal(4))
+			Expect(async.queued).To(Equal([]string{"1:a", "2:a", "1:b", "2:b", "2:c"}))
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+		})
+	})
+
+	Context("KafkaConfigFromEnv", func() {
+		It("should read brokers, acks, compression and batching from the environment", func() {
+			GinkgoT().Setenv("KAFKA_BROKERS", "kafka-1:9092, kafka-2:9092")
+			GinkgoT().Setenv("KAFKA_ACKS", "leader")
+			GinkgoT().Setenv("KAFKA_COMPRESSION", "ZSTD")
+			GinkgoT().Setenv("KAFKA_BATCH_MESSAGES", "500")
+			GinkgoT().Setenv("KAFKA_BATCH_FREQUENCY", "200ms")
+
+			cfg, err := repository.KafkaConfigFromEnv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Brokers).To(Equal([]string{"kafka-1:9092", "kafka-2:9092"}))
+			Expect(cfg.RequiredAcks).To(Equal(sarama.WaitForLocal))
+			Expect(cfg.Compression).To(Equal(sarama.CompressionZSTD))
+			Expect(cfg.FlushMessages).To(Equal(500))
+			Expect(cfg.FlushFrequency).To(Equal(200 * time.Millisecond))
+		})
+
+		It("should reject unknown acks settings", func() {
+			GinkgoT().Setenv("KAFKA_ACKS", "some")
+
+			_, err := repository.KafkaConfigFromEnv()
+			Expect(err).To(HaveOccurred())
 		})
 	})
 
 })
 
+// eventArg matches an outbox payload holding a current-version event envelope of eventType
+// whose payload (and previous record, when set) are equivalent to the given JSON.
+type eventArg struct {
+	eventType     string
+	payload       string
+	previous      string
+	actor         string
+	correlationID string
+}
+
+func (e eventArg) Match(v driver.Value) bool {
+	data, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	var envelope struct {
+		EventID       string          `json:"event_id"`
+		Type          string          `json:"type"`
+		SchemaVersion int             `json:"schema_version"`
+		Payload       json.RawMessage `json:"payload"`
+		Previous      json.RawMessage `json:"previous"`
+		Actor         string          `json:"actor"`
+		CorrelationID string          `json:"correlation_id"`
+	}
+	if json.Unmarshal(data, &envelope) != nil {
+		return false
+	}
+	return envelope.EventID != "" &&
+		envelope.Type == e.eventType &&
+		envelope.SchemaVersion == repository.EventSchemaVersion &&
+		jsonEqual(envelope.Payload, e.payload) &&
+		(e.previous == "" || jsonEqual(envelope.Previous, e.previous)) &&
+		envelope.Actor == e.actor &&
+		envelope.CorrelationID == e.correlationID
+}
+
+func jsonEqual(data []byte, expected string) bool {
+	var got, want interface{}
+	if json.Unmarshal(data, &got) != nil || json.Unmarshal([]byte(expected), &want) != nil {
+		return false
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+// fakeAsyncPublisher records queued messages as key:value and reports each delivery from another
+// goroutine, failing those listed in fail.
+type fakeAsyncPublisher struct {
+	fail   map[string]error
+	queued []string
+}
+
+func (p *fakeAsyncPublisher) Publish(ctx context.Context, topic, key string, value []byte) error {
+	return p.fail[key+":"+string(value)]
+}
+
+func (p *fakeAsyncPublisher) PublishAsync(ctx context.Context, topic, key string, value []byte, done func(error)) {
+	p.queued = append(p.queued, key+":"+string(value))
+	go done(p.fail[key+":"+string(value)])
+}
+
 func TestRepository(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "PostgresUserRepository Suite")
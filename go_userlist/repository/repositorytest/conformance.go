@@ -0,0 +1,625 @@
+// Package repositorytest holds a Ginkgo conformance suite that checks the behaviour every
+// repository.UserRepository implementation must share, independent of how it stores users, and
+// the departments those users belong to.
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"go_userlist/repository"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// Factory returns an empty repository for one spec, which must also be a
+// repository.DepartmentRepository. Any cleanup it needs should be registered with DeferCleanup.
+type Factory func() repository.UserRepository
+
+// departmentNames are the departments created before each spec, which users may belong to.
+var departmentNames = []string{"Finance", "HR", "I.T.", "IT", "Information Tech", "Legal"}
+
+// DescribeConformance registers the conformance specs for the repositories newRepo creates under
+// a container named after the implementation. Specs only rely on the ids the repository assigns,
+// so they also run against a database whose sequences have moved on.
+func DescribeConformance(name string, newRepo Factory) bool {
+	return Describe(name+" conformance", func() {
+		var (
+			repo        repository.UserRepository
+			departments repository.DepartmentRepository
+			ctx         = context.Background()
+		)
+
+		BeforeEach(func() {
+			repo = newRepo()
+			var ok bool
+			departments, ok = repo.(repository.DepartmentRepository)
+			Expect(ok).To(BeTrue(), "the repository does not implement DepartmentRepository")
+			for _, name := range departmentNames {
+				Expect(departments.CreateDepartment(ctx, &repository.Department{Name: name})).To(Succeed())
+			}
+		})
+
+		// department returns the stored department with the given name.
+		department := func(name string) repository.Department {
+			all, err := departments.ListDepartments(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			for _, d := range all {
+				if d.Name == name {
+					return d
+				}
+			}
+			Fail("no department named " + name)
+			return repository.Department{}
+		}
+
+		// create stores a user with the given user_name and optional last name and department
+		// and returns it as created.
+		create := func(userName, lastName, department string) *repository.User {
+			user := &repository.User{
+				User_name:   userName,
+				First_name:  "Test",
+				Last_name:   lastName,
+				Email:       userName + "@example.com",
+				User_status: "A",
+				Department:  department,
+			}
+			Expect(repo.CreateUser(ctx, user)).To(Succeed())
+			return user
+		}
+
+		Context("CreateUser", func() {
+			It("should assign a distinct id and version 1", func() {
+				first := create("conf01", "Adams", "HR")
+				second := create("conf02", "Baker", "HR")
+
+				Expect(first.User_id).To(BeNumerically(">", 0))
+				Expect(second.User_id).NotTo(Equal(first.User_id))
+				Expect(first.Version).To(Equal(1))
+
+				stored, err := repo.GetUserByID(ctx, first.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*stored).To(Equal(*first))
+			})
+
+			It("should reject a user_name or email already taken regardless of case", func() {
+				create("conf01", "Adams", "HR")
+
+				err := repo.CreateUser(ctx, &repository.User{User_name: "CONF01", Email: "other@example.com"})
+				Expect(err).To(MatchError(repository.ErrDuplicateUser))
+				Expect(err).To(MatchError(repository.ErrConflict))
+
+				err = repo.CreateUser(ctx, &repository.User{User_name: "conf02", Email: "Conf01@Example.com"})
+				Expect(err).To(Equal(&repository.DuplicateUserError{Field: "email"}))
+			})
+		})
+
+		Context("not found", func() {
+			It("should report ErrUserNotFound for every operation on a missing user", func() {
+				missing := create("conf01", "Adams", "HR").User_id + 1000
+
+				_, err := repo.GetUserByID(ctx, missing)
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+				Expect(err).To(MatchError(repository.ErrNotFound))
+
+				_, err = repo.GetUserByIDIncludingDeleted(ctx, missing)
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+
+				err = repo.UpdateUser(ctx, &repository.User{User_id: missing, User_name: "ghost", Email: "ghost@example.com"})
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+
+				err = repo.PatchUser(ctx, missing, repository.AnyVersion, map[string]interface{}{"department": "IT"})
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+
+				Expect(repo.DeleteUserByID(ctx, missing, repository.AnyVersion)).To(MatchError(repository.ErrUserNotFound))
+
+				_, err = repo.RestoreUser(ctx, missing, repository.AnyVersion)
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+			})
+		})
+
+		Context("PatchUser", func() {
+			It("should change only the given fields and bump the version", func() {
+				user := create("conf01", "Adams", "HR")
+
+				Expect(repo.PatchUser(ctx, user.User_id, user.Version, map[string]interface{}{"department": "Legal"})).To(Succeed())
+
+				patched, err := repo.GetUserByID(ctx, user.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				want := *user
+				want.Department = "Legal"
+				want.Version = user.Version + 1
+				Expect(*patched).To(Equal(want))
+			})
+
+			It("should reject a stale version without changing the user", func() {
+				user := create("conf01", "Adams", "HR")
+				Expect(repo.PatchUser(ctx, user.User_id, user.Version, map[string]interface{}{"department": "Legal"})).To(Succeed())
+
+				err := repo.PatchUser(ctx, user.User_id, user.Version, map[string]interface{}{"department": "IT"})
+				Expect(err).To(MatchError(repository.ErrVersionMismatch))
+
+				current, err := repo.GetUserByID(ctx, user.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(current.Department).To(Equal("Legal"))
+			})
+
+			It("should reject unknown and immutable fields", func() {
+				user := create("conf01", "Adams", "HR")
+
+				err := repo.PatchUser(ctx, user.User_id, repository.AnyVersion, map[string]interface{}{"user_id": 7, "password": "x"})
+				Expect(err).To(MatchError(repository.ErrInvalidPatch))
+			})
+		})
+
+		Context("UpdateUser", func() {
+			It("should replace the fields and return the new version", func() {
+				user := create("conf01", "Adams", "HR")
+
+				user.First_name, user.Department = "Ada", "IT"
+				Expect(repo.UpdateUser(ctx, user)).To(Succeed())
+				Expect(user.Version).To(Equal(2))
+
+				stored, err := repo.GetUserByID(ctx, user.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*stored).To(Equal(*user))
+			})
+		})
+
+		Context("UpsertUser", func() {
+			It("should create a missing user with the given id and update it afterwards", func() {
+				existing := create("conf01", "Adams", "HR")
+				id := existing.User_id + 100
+
+				user := &repository.User{User_id: id, User_name: "conf02", Email: "conf02@example.com"}
+				created, err := repo.UpsertUser(ctx, user)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(created).To(BeTrue())
+				Expect(user.Version).To(Equal(1))
+
+				user.Department = "IT"
+				created, err = repo.UpsertUser(ctx, user)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(created).To(BeFalse())
+				Expect(user.Version).To(Equal(2))
+
+				stored, err := repo.GetUserByID(ctx, id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*stored).To(Equal(*user))
+
+				next := create("conf03", "Baker", "HR")
+				Expect(next.User_id).To(BeNumerically(">", id))
+			})
+
+			It("should not create a user when a version was expected", func() {
+				_, err := repo.UpsertUser(ctx, &repository.User{User_id: 500, User_name: "conf01", Email: "conf01@example.com", Version: 2})
+				Expect(err).To(MatchError(repository.ErrVersionMismatch))
+
+				_, err = repo.GetUserByID(ctx, 500)
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+			})
+		})
+
+		Context("ImportUsers", func() {
+			It("should create new users and skip those reusing a taken user_name or email", func() {
+				existing := create("conf01", "Adams", "HR")
+				Expect(repo.DeleteUserByID(ctx, existing.User_id, repository.AnyVersion)).To(Succeed())
+
+				users := []repository.User{
+					{User_name: "conf02", Email: "conf02@example.com", Department: "IT"},
+					{User_name: "CONF01", Email: "new@example.com"},
+					{User_name: "conf03", Email: "Conf02@Example.com"},
+					{User_name: "conf04", Email: "conf04@example.com"},
+				}
+				skipped, err := repo.ImportUsers(ctx, users, repository.ImportOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(skipped).To(Equal([]error{
+					nil,
+					&repository.DuplicateUserError{Field: "user_name"},
+					&repository.DuplicateUserError{Field: "email"},
+					nil,
+				}))
+
+				Expect(users[3].User_id).NotTo(Equal(users[0].User_id))
+				for _, i := range []int{0, 3} {
+					Expect(users[i].Version).To(Equal(1))
+					stored, err := repo.GetUserByID(ctx, users[i].User_id)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(*stored).To(Equal(users[i]))
+				}
+			})
+
+			It("should reject users naming an unknown department, on dry runs too, and create the rest", func() {
+				users := func() []repository.User {
+					return []repository.User{
+						{User_name: "conf01", Email: "conf01@example.com", Department: "Research"},
+						{User_name: "conf02", Email: "conf02@example.com", Department: "IT"},
+						{User_name: "conf01", Email: "conf01.hr@example.com", Department: "HR"},
+						{User_name: "conf03", Email: "conf03@example.com", Department: "hr"},
+					}
+				}
+				for _, dryRun := range []bool{true, false} {
+					batch := users()
+					rejected, err := repo.ImportUsers(ctx, batch, repository.ImportOptions{DryRun: dryRun})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(rejected).To(HaveLen(4))
+					for _, i := range []int{0, 3} {
+						var validationErr *repository.ValidationError
+						Expect(errors.As(rejected[i], &validationErr)).To(BeTrue())
+						Expect(validationErr.Fields[0].Field).To(Equal("department"))
+						Expect(validationErr.Fields[0].Code).To(Equal(repository.CodeReference))
+					}
+					Expect(rejected[1]).NotTo(HaveOccurred())
+					Expect(rejected[2]).NotTo(HaveOccurred())
+				}
+
+				all, err := repo.GetAllUsers(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(all).To(HaveLen(2))
+			})
+
+			It("should write nothing on a dry run", func() {
+				skipped, err := repo.ImportUsers(ctx, []repository.User{{User_name: "conf01", Email: "conf01@example.com"}}, repository.ImportOptions{DryRun: true})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(skipped).To(Equal([]error{nil}))
+
+				all, err := repo.GetAllUsers(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(all).To(BeEmpty())
+			})
+		})
+
+		Context("ApplyBulk", func() {
+			It("should apply every operation on its own unless atomic", func() {
+				adams := create("conf01", "Adams", "HR")
+				baker := create("conf02", "Baker", "HR")
+
+				ops := []repository.BulkOperation{
+					{Op: repository.BulkCreate, User: repository.User{User_name: "conf03", Email: "conf03@example.com"}},
+					{Op: repository.BulkPatch, UserID: adams.User_id, Version: adams.Version, Changes: map[string]interface{}{"department": "IT"}},
+					{Op: repository.BulkDelete, UserID: baker.User_id, Version: baker.Version + 1},
+					{Op: repository.BulkUpdate, UserID: baker.User_id, User: repository.User{User_name: "conf02", Email: "baker@example.com"}},
+				}
+				results, err := repo.ApplyBulk(ctx, ops, repository.BulkOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(results).To(HaveLen(4))
+				Expect(results[0].Err).NotTo(HaveOccurred())
+				Expect(results[0].User.Version).To(Equal(1))
+				Expect(results[0].UserID).To(Equal(results[0].User.User_id))
+				Expect(results[1].User.Department).To(Equal("IT"))
+				Expect(results[1].User.Version).To(Equal(2))
+				Expect(results[2].Err).To(MatchError(repository.ErrVersionMismatch))
+				Expect(results[2].UserID).To(Equal(baker.User_id))
+				Expect(results[3].User.Email).To(Equal("baker@example.com"))
+
+				stored, err := repo.GetUserByID(ctx, results[0].UserID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*stored).To(Equal(*results[0].User))
+			})
+
+			It("should roll back every operation of an atomic request when one fails", func() {
+				adams := create("conf01", "Adams", "HR")
+				baker := create("conf02", "Baker", "HR")
+
+				ops := []repository.BulkOperation{
+					{Op: repository.BulkCreate, User: repository.User{User_name: "conf03", Email: "conf03@example.com"}},
+					{Op: repository.BulkDelete, UserID: adams.User_id},
+					{Op: repository.BulkPatch, UserID: baker.User_id, Changes: map[string]interface{}{"email": "CONF03@example.com"}},
+					{Op: repository.BulkDelete, UserID: baker.User_id},
+				}
+				results, err := repo.ApplyBulk(ctx, ops, repository.BulkOptions{Atomic: true})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(results).To(HaveLen(4))
+				for _, i := range []int{0, 1, 3} {
+					Expect(results[i].Err).To(MatchError(repository.ErrBulkAborted))
+					Expect(results[i].User).To(BeNil())
+				}
+				Expect(results[1].UserID).To(Equal(adams.User_id))
+				Expect(results[2].Err).To(Equal(&repository.DuplicateUserError{Field: "email"}))
+
+				all, err := repo.GetAllUsers(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(all).To(Equal([]repository.User{*adams, *baker}))
+			})
+		})
+
+		Context("PatchMatchingUsers", func() {
+			It("should patch the matching users in id order", func() {
+				adams := create("conf01", "Adams", "HR")
+				create("conf02", "Baker", "IT")
+				clark := create("conf03", "Clark", "HR")
+				Expect(repo.DeleteUserByID(ctx, clark.User_id, repository.AnyVersion)).To(Succeed())
+				davis := create("conf04", "Davis", "HR")
+
+				filter := repository.ListOptions{Department: "HR", IncludeDeleted: true, Size: 1}
+				results, err := repo.PatchMatchingUsers(ctx, filter, map[string]interface{}{"user_status": "I"}, repository.BulkOptions{Atomic: true})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(results).To(HaveLen(2))
+				Expect(results[0].UserID).To(Equal(adams.User_id))
+				Expect(results[1].UserID).To(Equal(davis.User_id))
+				Expect(results[1].User.User_status).To(Equal("I"))
+
+				page, err := repo.ListUsers(ctx, repository.ListOptions{UserStatus: "I"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(page.Total).To(Equal(2))
+			})
+
+			It("should reject invalid changes before touching any user", func() {
+				create("conf01", "Adams", "HR")
+				_, err := repo.PatchMatchingUsers(ctx, repository.ListOptions{Department: "HR"}, map[string]interface{}{"user_id": 9}, repository.BulkOptions{})
+				Expect(err).To(MatchError(repository.ErrInvalidPatch))
+			})
+		})
+
+		Context("SearchUsers", func() {
+			It("should find users by word prefixes and by typos, best first", func() {
+				john := &repository.User{User_name: "conf01", First_name: "John", Last_name: "Doe", Email: "conf01@example.com", Department: "HR"}
+				Expect(repo.CreateUser(ctx, john)).To(Succeed())
+				create("conf02", "Smith", "Finance")
+				gone := create("conf03", "Doe", "HR")
+				Expect(repo.DeleteUserByID(ctx, gone.User_id, repository.AnyVersion)).To(Succeed())
+
+				hits, err := repo.SearchUsers(ctx, repository.SearchOptions{Query: "Jon Do"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(hits).To(HaveLen(1))
+				Expect(hits[0].User).To(Equal(*john))
+				Expect(hits[0].Highlights).To(Equal(map[string][]repository.Span{
+					"first_name": {{Start: 0, End: 4}},
+					"last_name":  {{Start: 0, End: 2}},
+				}))
+
+				hits, err = repo.SearchUsers(ctx, repository.SearchOptions{Query: "conf", Limit: 1})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(hits).To(HaveLen(1))
+			})
+
+			It("should reject queries without words and out of range limits", func() {
+				_, err := repo.SearchUsers(ctx, repository.SearchOptions{Query: " -- "})
+				Expect(err).To(MatchError(repository.ErrInvalidSearch))
+				_, err = repo.SearchUsers(ctx, repository.SearchOptions{Query: "doe", Limit: repository.MaxSearchLimit + 1})
+				Expect(err).To(MatchError(repository.ErrInvalidSearch))
+			})
+		})
+
+		Context("SuggestValues", func() {
+			It("should count each live value starting with the prefix, most common first", func() {
+				create("conf01", "Adams", "Information Tech")
+				create("conf02", "Baker", "IT")
+				create("conf03", "Clark", "IT")
+				create("conf04", "Davis", "HR")
+				gone := create("conf06", "Fox", "I.T.")
+				Expect(repo.DeleteUserByID(ctx, gone.User_id, repository.AnyVersion)).To(Succeed())
+
+				suggestions, err := repo.SuggestValues(ctx, repository.SuggestOptions{Field: "department", Prefix: "i"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(suggestions).To(Equal([]repository.Suggestion{
+					{Value: "IT", Count: 2},
+					{Value: "Information Tech", Count: 1},
+				}))
+
+				suggestions, err = repo.SuggestValues(ctx, repository.SuggestOptions{Field: "user_name", Prefix: "CONF0", Limit: 2})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(suggestions).To(Equal([]repository.Suggestion{{Value: "conf01", Count: 1}, {Value: "conf02", Count: 1}}))
+			})
+		})
+
+		Context("departments", func() {
+			It("should create, list and get departments, rejecting names taken regardless of case", func() {
+				sales := &repository.Department{Name: "Sales", Description: "Field and inside sales"}
+				Expect(departments.CreateDepartment(ctx, sales)).To(Succeed())
+				Expect(sales.Department_id).To(BeNumerically(">", 0))
+				Expect(sales.Version).To(Equal(1))
+
+				stored, err := departments.GetDepartmentByID(ctx, sales.Department_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*stored).To(Equal(*sales))
+
+				all, err := departments.ListDepartments(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(all).To(HaveLen(len(departmentNames) + 1))
+				Expect(all[len(all)-1]).To(Equal(*sales))
+
+				err = departments.CreateDepartment(ctx, &repository.Department{Name: "SALES"})
+				Expect(err).To(MatchError(repository.ErrDuplicateDepartment))
+				Expect(err).To(MatchError(repository.ErrConflict))
+
+				_, err = departments.GetDepartmentByID(ctx, sales.Department_id+1000)
+				Expect(err).To(MatchError(repository.ErrDepartmentNotFound))
+				Expect(err).To(MatchError(repository.ErrNotFound))
+			})
+
+			It("should only let users reference existing departments by their exact name", func() {
+				user := create("conf01", "Adams", "HR")
+
+				err := repo.CreateUser(ctx, &repository.User{User_name: "conf02", Email: "conf02@example.com", Department: "Sales"})
+				var verr *repository.ValidationError
+				Expect(errors.As(err, &verr)).To(BeTrue())
+				Expect(verr.Fields).To(Equal([]repository.FieldError{{Field: "department", Code: repository.CodeReference, Message: "must name an existing department"}}))
+
+				err = repo.PatchUser(ctx, user.User_id, repository.AnyVersion, map[string]interface{}{"department": "hr"})
+				Expect(err).To(MatchError(repository.ErrValidation))
+
+				Expect(repo.PatchUser(ctx, user.User_id, repository.AnyVersion, map[string]interface{}{"department": nil})).To(Succeed())
+				stored, err := repo.GetUserByID(ctx, user.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stored.Department).To(BeEmpty())
+			})
+
+			It("should rename a department for its users and bump their versions", func() {
+				adams := create("conf01", "Adams", "IT")
+				baker := create("conf02", "Baker", "IT")
+				Expect(repo.DeleteUserByID(ctx, baker.User_id, repository.AnyVersion)).To(Succeed())
+				clark := create("conf03", "Clark", "HR")
+
+				it := department("IT")
+				it.Name, it.Description = "Information Technology", "Laptops and networks"
+				Expect(departments.UpdateDepartment(ctx, &it)).To(Succeed())
+				Expect(it.Version).To(Equal(2))
+
+				stored, err := repo.GetUserByID(ctx, adams.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(stored.Department).To(Equal("Information Technology"))
+				Expect(stored.Version).To(Equal(adams.Version + 1))
+				deleted, err := repo.GetUserByIDIncludingDeleted(ctx, baker.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(deleted.Department).To(Equal("Information Technology"))
+				untouched, err := repo.GetUserByID(ctx, clark.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*untouched).To(Equal(*clark))
+
+				it.Version = 1
+				Expect(departments.UpdateDepartment(ctx, &it)).To(MatchError(repository.ErrDepartmentVersionMismatch))
+				hr := department("HR")
+				hr.Name = "information technology"
+				Expect(departments.UpdateDepartment(ctx, &hr)).To(MatchError(repository.ErrDuplicateDepartment))
+			})
+
+			It("should only delete a department no user belongs to", func() {
+				user := create("conf01", "Adams", "Legal")
+				Expect(repo.DeleteUserByID(ctx, user.User_id, repository.AnyVersion)).To(Succeed())
+				legal := department("Legal")
+
+				err := departments.DeleteDepartmentByID(ctx, legal.Department_id, repository.AnyVersion)
+				Expect(err).To(MatchError(repository.ErrDepartmentInUse))
+				Expect(err).To(MatchError(repository.ErrConflict))
+
+				_, err = repo.PurgeDeletedUsers(ctx, time.Now().Add(time.Hour))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(departments.DeleteDepartmentByID(ctx, legal.Department_id, legal.Version+1)).To(MatchError(repository.ErrDepartmentVersionMismatch))
+				Expect(departments.DeleteDepartmentByID(ctx, legal.Department_id, legal.Version)).To(Succeed())
+
+				_, err = departments.GetDepartmentByID(ctx, legal.Department_id)
+				Expect(err).To(MatchError(repository.ErrDepartmentNotFound))
+				Expect(departments.DeleteDepartmentByID(ctx, legal.Department_id, repository.AnyVersion)).To(MatchError(repository.ErrDepartmentNotFound))
+			})
+		})
+
+		Context("DeleteUserByID", func() {
+			It("should hide the user and report not found when deleting it again", func() {
+				user := create("conf01", "Adams", "HR")
+				Expect(repo.DeleteUserByID(ctx, user.User_id, user.Version)).To(Succeed())
+
+				_, err := repo.GetUserByID(ctx, user.User_id)
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+				deleted, err := repo.GetUserByIDIncludingDeleted(ctx, user.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(deleted.Deleted_at).NotTo(BeNil())
+
+				Expect(repo.DeleteUserByID(ctx, user.User_id, repository.AnyVersion)).To(MatchError(repository.ErrUserNotFound))
+				again, err := repo.GetUserByIDIncludingDeleted(ctx, user.User_id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(again.Version).To(Equal(deleted.Version))
+			})
+
+			It("should restore a deleted user once and purge it after the cutoff", func() {
+				user := create("conf01", "Adams", "HR")
+				Expect(repo.DeleteUserByID(ctx, user.User_id, repository.AnyVersion)).To(Succeed())
+
+				restored, err := repo.RestoreUser(ctx, user.User_id, repository.AnyVersion)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(restored.Deleted_at).To(BeNil())
+				_, err = repo.RestoreUser(ctx, user.User_id, repository.AnyVersion)
+				Expect(err).To(MatchError(repository.ErrUserNotDeleted))
+
+				Expect(repo.DeleteUserByID(ctx, user.User_id, repository.AnyVersion)).To(Succeed())
+				n, err := repo.PurgeDeletedUsers(ctx, time.Now().Add(-time.Hour))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(n).To(Equal(0))
+				n, err = repo.PurgeDeletedUsers(ctx, time.Now().Add(time.Hour))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(n).To(Equal(1))
+
+				_, err = repo.GetUserByIDIncludingDeleted(ctx, user.User_id)
+				Expect(err).To(MatchError(repository.ErrUserNotFound))
+			})
+		})
+
+		Context("listing", func() {
+			var adams, baker1, baker2, clark *repository.User
+
+			BeforeEach(func() {
+				baker1 = create("conf01", "Baker", "HR")
+				clark = create("conf02", "Clark", "IT")
+				adams = create("conf03", "Adams", "HR")
+				baker2 = create("conf04", "Baker", "HR")
+			})
+
+			ids := func(users []repository.User) []int {
+				result := make([]int, len(users))
+				for i, u := range users {
+					result[i] = u.User_id
+				}
+				return result
+			}
+
+			It("should order by the sort column with user_id breaking ties", func() {
+				page, err := repo.ListUsers(ctx, repository.ListOptions{SortBy: "last_name"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ids(page.Users)).To(Equal([]int{adams.User_id, baker1.User_id, baker2.User_id, clark.User_id}))
+				Expect(page.Total).To(Equal(4))
+
+				page, err = repo.ListUsers(ctx, repository.ListOptions{SortBy: "last_name", SortDir: repository.SortDesc})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ids(page.Users)).To(Equal([]int{clark.User_id, baker2.User_id, baker1.User_id, adams.User_id}))
+			})
+
+			It("should filter, page and leave out deleted users", func() {
+				Expect(repo.DeleteUserByID(ctx, baker2.User_id, repository.AnyVersion)).To(Succeed())
+
+				page, err := repo.ListUsers(ctx, repository.ListOptions{Department: "HR", Size: 1, Page: 2})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(page.Total).To(Equal(2))
+				Expect(ids(page.Users)).To(Equal([]int{adams.User_id}))
+				Expect(page.HasNext()).To(BeFalse())
+
+				page, err = repo.ListUsers(ctx, repository.ListOptions{Department: "HR", IncludeDeleted: true})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(page.Total).To(Equal(3))
+
+				all, err := repo.GetAllUsers(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(all).To(HaveLen(3))
+			})
+
+			It("should return every user once when walking cursors", func() {
+				opts := repository.ListOptions{SortBy: "last_name", Size: 3}
+				var walked []repository.User
+				cursor := ""
+				for {
+					page, err := repo.ListUsersAfter(ctx, opts, cursor)
+					Expect(err).NotTo(HaveOccurred())
+					walked = append(walked, page.Users...)
+					if page.NextCursor == "" {
+						break
+					}
+					cursor = page.NextCursor
+				}
+				Expect(ids(walked)).To(Equal([]int{adams.User_id, baker1.User_id, baker2.User_id, clark.User_id}))
+			})
+
+			It("should export every matching user in order", func() {
+				Expect(repo.DeleteUserByID(ctx, baker2.User_id, repository.AnyVersion)).To(Succeed())
+
+				var exported []repository.User
+				collect := func(u repository.User) error {
+					exported = append(exported, u)
+					return nil
+				}
+				Expect(repo.ExportUsers(ctx, repository.ListOptions{SortBy: "last_name", SortDir: repository.SortDesc, Size: 1}, collect)).To(Succeed())
+				Expect(ids(exported)).To(Equal([]int{clark.User_id, baker1.User_id, adams.User_id}))
+
+				exported = nil
+				Expect(repo.ExportUsers(ctx, repository.ListOptions{Department: "HR", IncludeDeleted: true}, collect)).To(Succeed())
+				Expect(ids(exported)).To(Equal([]int{baker1.User_id, adams.User_id, baker2.User_id}))
+			})
+
+			It("should reject invalid options", func() {
+				_, err := repo.ListUsers(ctx, repository.ListOptions{SortBy: "password"})
+				Expect(err).To(MatchError(repository.ErrInvalidListOptions))
+				_, err = repo.ListUsersAfter(ctx, repository.ListOptions{}, "not a cursor")
+				Expect(err).To(MatchError(repository.ErrInvalidListOptions))
+			})
+		})
+	})
+}
@@ -0,0 +1,281 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Masterminds/squirrel"
+)
+
+const (
+	// DefaultSearchLimit is how many hits SearchUsers returns when SearchOptions.Limit is 0.
+	DefaultSearchLimit = 20
+	// MaxSearchLimit is the largest SearchOptions.Limit accepted.
+	MaxSearchLimit = 100
+	// MaxSearchLength is the longest query accepted, in characters.
+	MaxSearchLength = 200
+
+	// searchThreshold is the word similarity a fuzzy match needs, as
+	// pg_trgm.word_similarity_threshold.
+	searchThreshold = 0.3
+)
+
+// ErrInvalidSearch is returned (wrapped with details) for a search SearchUsers cannot run.
+var ErrInvalidSearch = newError(ErrValidation, "invalid_search", "invalid search")
+
+// SearchOptions is a free-text search over the searchable fields of users.
+type SearchOptions struct {
+	Query string
+	Limit int
+}
+
+// Span marks the characters [Start, End) of a field value that matched a search.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SearchHit is a user found by SearchUsers. Rank orders hits, higher first; it is only
+// comparable between hits of the same search. Highlights lists the matching parts of each field
+// that has any, keyed by json name.
+type SearchHit struct {
+	User       User              `json:"user"`
+	Rank       float64           `json:"rank"`
+	Highlights map[string][]Span `json:"highlights,omitempty"`
+}
+
+// searchDocument is the SQL expression SearchUsers matches: the searchable columns joined with
+// spaces. migrations/0004_user_search.sql indexes exactly this expression, so the two must
+// change together.
+var searchDocument = func() string {
+	var parts []string
+	for _, f := range userFields {
+		if f.Searchable {
+			parts = append(parts, fmt.Sprintf("coalesce(%s, '')", f.Column))
+		}
+	}
+	return strings.Join(parts, " || ' ' || ")
+}()
+
+// normalize applies the default limit and splits the query into lower-cased terms.
+func (o SearchOptions) normalize() (SearchOptions, []string, error) {
+	if o.Limit == 0 {
+		o.Limit = DefaultSearchLimit
+	}
+	if o.Limit < 1 || o.Limit > MaxSearchLimit {
+		return o, nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidSearch, MaxSearchLimit)
+	}
+	if utf8.RuneCountInString(o.Query) > MaxSearchLength {
+		return o, nil, fmt.Errorf("%w: the query must be at most %d characters", ErrInvalidSearch, MaxSearchLength)
+	}
+	terms := searchWords(strings.ToLower(o.Query))
+	if len(terms) == 0 {
+		return o, nil, fmt.Errorf("%w: the query must contain a letter or digit", ErrInvalidSearch)
+	}
+	return o, terms, nil
+}
+
+// SearchUsers returns the users that are not soft deleted and match opts.Query, best first.
+// A user matches when every term of the query starts a word of it, by full-text search, or when
+// the query as a whole is similar enough to part of it, by pg_trgm word similarity, which
+// tolerates typos such as "Jon Do" for John Doe.
+func (r *PostgresUserRepository) SearchUsers(ctx context.Context, opts SearchOptions) ([]SearchHit, error) {
+	opts, terms, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]string, len(terms))
+	for i, t := range terms {
+		prefixes[i] = t + ":*"
+	}
+	tsQuery, text := strings.Join(prefixes, " & "), strings.Join(terms, " ")
+
+	vector := fmt.Sprintf("to_tsvector('simple', %s)", searchDocument)
+	query, args, err := r.psql.Select(userColumns...).
+		Column(squirrel.Expr(fmt.Sprintf("ts_rank(%s, to_tsquery('simple', ?)) + word_similarity(?, %s) AS rank", vector, searchDocument), tsQuery, text)).
+		From("public.users").
+		Where(squirrel.Or{
+			squirrel.Expr(fmt.Sprintf("%s @@ to_tsquery('simple', ?)", vector), tsQuery),
+			squirrel.Expr(fmt.Sprintf("? <%% (%s)", searchDocument), text),
+		}).
+		Where(notDeleted).
+		OrderBy("rank DESC", "user_id").
+		Limit(uint64(opts.Limit)).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	hits := []SearchHit{}
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		// <% compares against this setting, whose default of 0.6 misses most typos.
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL pg_trgm.word_similarity_threshold = %g", searchThreshold)); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hit SearchHit
+			if hit.User, err = scanUser(rows, &hit.Rank); err != nil {
+				return err
+			}
+			hit.Highlights = highlight(hit.User, terms)
+			hits = append(hits, hit)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// SearchUsers returns the users that are not soft deleted and match opts.Query, best first. It
+// is a simpler take on PostgresUserRepository.SearchUsers: each term scores 1 when it starts a
+// word of the user and its best word similarity otherwise, and users whose average score
+// reaches the fuzzy threshold match.
+func (r *MemoryUserRepository) SearchUsers(ctx context.Context, opts SearchOptions) ([]SearchHit, error) {
+	opts, terms, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hits := []SearchHit{}
+	for _, u := range r.users {
+		if u.Deleted_at != nil {
+			continue
+		}
+		if rank := searchRank(*u, terms); rank >= searchThreshold {
+			hits = append(hits, SearchHit{User: *u, Rank: rank, Highlights: highlight(*u, terms)})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Rank != hits[j].Rank {
+			return hits[i].Rank > hits[j].Rank
+		}
+		return hits[i].User.User_id < hits[j].User.User_id
+	})
+	if len(hits) > opts.Limit {
+		hits = hits[:opts.Limit]
+	}
+	return hits, nil
+}
+
+// searchRank is the average over terms of how well each matches a word of the user.
+func searchRank(u User, terms []string) float64 {
+	var words []string
+	for _, f := range userFields {
+		if f.Searchable {
+			words = append(words, searchWords(strings.ToLower(f.get(&u).(string)))...)
+		}
+	}
+
+	total := 0.0
+	for _, term := range terms {
+		best := 0.0
+		for _, word := range words {
+			if strings.HasPrefix(word, term) {
+				best = 1
+				break
+			}
+			if s := wordSimilarity(term, word); s > best {
+				best = s
+			}
+		}
+		total += best
+	}
+	return total / float64(len(terms))
+}
+
+// highlight returns the parts of each searchable field of u that match one of terms: the
+// prefix a term matched, or the whole of a word similar to a term.
+func highlight(u User, terms []string) map[string][]Span {
+	var highlights map[string][]Span
+	for _, f := range userFields {
+		if !f.Searchable {
+			continue
+		}
+		value := f.get(&u).(string)
+		var spans []Span
+		start := -1
+		// Walk the value by character, closing a word at each separator and at the end.
+		runes := []rune(value)
+		for i := 0; i <= len(runes); i++ {
+			if i < len(runes) && isWordRune(runes[i]) {
+				if start < 0 {
+					start = i
+				}
+				continue
+			}
+			if start < 0 {
+				continue
+			}
+			word := strings.ToLower(string(runes[start:i]))
+			for _, term := range terms {
+				if strings.HasPrefix(word, term) {
+					spans = append(spans, Span{Start: start, End: start + utf8.RuneCountInString(term)})
+					break
+				}
+				if wordSimilarity(term, word) >= searchThreshold {
+					spans = append(spans, Span{Start: start, End: i})
+					break
+				}
+			}
+			start = -1
+		}
+		if len(spans) > 0 {
+			if highlights == nil {
+				highlights = map[string][]Span{}
+			}
+			highlights[f.JSONName] = spans
+		}
+	}
+	return highlights
+}
+
+// searchWords splits s into its runs of letters and digits.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return !isWordRune(r) })
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordSimilarity is the share of the trigrams of term that word also has, the measure pg_trgm's
+// word_similarity applies to a single word.
+func wordSimilarity(term, word string) float64 {
+	termGrams, wordGrams := trigrams(term), trigrams(word)
+	shared := 0
+	for g := range termGrams {
+		if wordGrams[g] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(termGrams))
+}
+
+// trigrams returns the set of trigrams of a lower-cased word, padded as pg_trgm pads it: two
+// spaces in front and one behind.
+func trigrams(word string) map[string]bool {
+	runes := []rune("  " + word + " ")
+	grams := make(map[string]bool, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = true
+	}
+	return grams
+}
@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+)
+
+const (
+	// DefaultPurgeRetention is how long soft deleted users are kept before they are purged.
+	DefaultPurgeRetention = 30 * 24 * time.Hour
+	// DefaultPurgeInterval is how often a Purger looks for users past the retention period.
+	DefaultPurgeInterval = time.Hour
+)
+
+// PurgeRetentionFromEnv returns the retention period set in USER_PURGE_RETENTION (a Go duration
+// such as 720h), or DefaultPurgeRetention when it is unset.
+func PurgeRetentionFromEnv() (time.Duration, error) {
+	loadDotEnv()
+	v := os.Getenv("USER_PURGE_RETENTION")
+	if v == "" {
+		return DefaultPurgeRetention, nil
+	}
+	retention, err := time.ParseDuration(v)
+	if err != nil || retention <= 0 {
+		return 0, fmt.Errorf("invalid USER_PURGE_RETENTION %q: must be a positive duration", v)
+	}
+	return retention, nil
+}
+
+// RestoreUser clears deleted_at on a soft deleted user and records a restore event in the outbox.
+// It returns the restored user, or ErrUserNotDeleted if the user is not deleted.
+func (r *PostgresUserRepository) RestoreUser(ctx context.Context, userID int, expectedVersion int) (*User, error) {
+	var user *User
+	err := r.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		user, err = r.queryUser(ctx, tx, r.selectUserByID(userID, true).Suffix("FOR UPDATE"))
+		if err != nil {
+			return err
+		}
+		if user.Deleted_at == nil {
+			return ErrUserNotDeleted
+		}
+		if err := checkVersion(user, expectedVersion); err != nil {
+			return err
+		}
+
+		query, args, err := r.psql.Update("public.users").
+			Set("deleted_at", nil).
+			Set("version", squirrel.Expr("version + 1")).
+			Where(squirrel.Eq{"user_id": userID, "version": user.Version}).
+			Suffix("RETURNING version").ToSql()
+
+		if err != nil {
+			return err
+		}
+
+		if err := queryVersioned(ctx, tx, query, args, &user.Version); err != nil {
+			return err
+		}
+		user.Deleted_at = nil
+
+		return r.enqueueEvent(ctx, tx, EventUserRestored, user.User_id, user, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// PurgeDeletedUsers hard deletes the users soft deleted before deletedBefore, records a purge
+// event for each of them in the outbox and returns how many were purged.
+func (r *PostgresUserRepository) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int, error) {
+	query, args, err := r.psql.Delete("public.users").
+		Where(squirrel.Lt{"deleted_at": deletedBefore}).
+		Suffix("RETURNING " + strings.Join(userColumns, ", ")).ToSql()
+	if err != nil {
+		return 0, err
+	}
+
+	var purged []User
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			purged = append(purged, user)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// The outbox inserts run once the DELETE's rows are drained, as a connection
+		// cannot interleave statements.
+		for i := range purged {
+			if err := r.enqueueEvent(ctx, tx, EventUserPurged, purged[i].User_id, &purged[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(purged), nil
+}
+
+// Purger periodically hard deletes users that have been soft deleted for longer than its
+// retention period.
+type Purger struct {
+	repo      *PostgresUserRepository
+	retention time.Duration
+	interval  time.Duration
+}
+
+// NewPurger creates a purger for the repository's users with the given retention period.
+func (r *PostgresUserRepository) NewPurger(retention time.Duration) *Purger {
+	return &Purger{repo: r, retention: retention, interval: DefaultPurgeInterval}
+}
+
+// Run purges expired users once per interval until ctx is cancelled, which also aborts a purge
+// in progress.
+func (p *Purger) Run(ctx context.Context) {
+	for {
+		n, err := p.repo.PurgeDeletedUsers(ctx, time.Now().Add(-p.retention))
+		if err != nil {
+			log.Printf("error purging deleted users: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted users", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.interval):
+		}
+	}
+}
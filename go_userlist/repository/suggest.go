@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+)
+
+const (
+	// DefaultSuggestLimit is how many suggestions SuggestValues returns when
+	// SuggestOptions.Limit is 0.
+	DefaultSuggestLimit = 10
+	// MaxSuggestLimit is the largest SuggestOptions.Limit accepted.
+	MaxSuggestLimit = 50
+)
+
+// ErrInvalidSuggest is returned (wrapped with details) for suggestions SuggestValues cannot give.
+var ErrInvalidSuggest = newError(ErrValidation, "invalid_suggest", "invalid suggestion request")
+
+// SuggestOptions asks for the values of a suggestable field that start with Prefix, regardless
+// of case. An empty Prefix matches every value.
+type SuggestOptions struct {
+	Field  string // json name of a field registered as Suggestable
+	Prefix string
+	Limit  int
+}
+
+// Suggestion is a distinct value of a field and how many users have it.
+type Suggestion struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// normalize applies the default limit and returns the field the options name.
+func (o SuggestOptions) normalize() (SuggestOptions, Field, error) {
+	f, ok := LookupField(o.Field)
+	if !ok || !f.Suggestable {
+		return o, Field{}, fmt.Errorf("%w: cannot suggest values for %q", ErrInvalidSuggest, o.Field)
+	}
+	if o.Limit == 0 {
+		o.Limit = DefaultSuggestLimit
+	}
+	if o.Limit < 1 || o.Limit > MaxSuggestLimit {
+		return o, Field{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidSuggest, MaxSuggestLimit)
+	}
+	return o, f, nil
+}
+
+// SuggestValues returns the most common non-empty values of a field among users that are not
+// soft deleted, most common first and then alphabetically. The prefix lookup uses the indexes
+// from migrations/0005_suggest_indexes.sql.
+func (r *PostgresUserRepository) SuggestValues(ctx context.Context, opts SuggestOptions) ([]Suggestion, error) {
+	opts, f, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, err := r.psql.Select(f.Column, "count(*)").
+		From("public.users").
+		Where(squirrel.Like{fmt.Sprintf("lower(%s)", f.Column): escapeLike(strings.ToLower(opts.Prefix)) + "%"}).
+		Where(squirrel.NotEq{f.Column: ""}).
+		Where(notDeleted).
+		GroupBy(f.Column).
+		OrderBy("count(*) DESC", f.Column).
+		Limit(uint64(opts.Limit)).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapDBError(err)
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+	for rows.Next() {
+		var s Suggestion
+		if err := rows.Scan(&s.Value, &s.Count); err != nil {
+			return nil, wrapDBError(err)
+		}
+		suggestions = append(suggestions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	return suggestions, nil
+}
+
+// SuggestValues returns the most common values of a field, as
+// PostgresUserRepository.SuggestValues does.
+func (r *MemoryUserRepository) SuggestValues(ctx context.Context, opts SuggestOptions) ([]Suggestion, error) {
+	opts, f, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	prefix := strings.ToLower(opts.Prefix)
+	counts := map[string]int{}
+	for _, u := range r.users {
+		v := f.get(u).(string)
+		if u.Deleted_at == nil && v != "" && strings.HasPrefix(strings.ToLower(v), prefix) {
+			counts[v]++
+		}
+	}
+
+	suggestions := []Suggestion{}
+	for v, n := range counts {
+		suggestions = append(suggestions, Suggestion{Value: v, Count: n})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Count != suggestions[j].Count {
+			return suggestions[i].Count > suggestions[j].Count
+		}
+		return suggestions[i].Value < suggestions[j].Value
+	})
+	if len(suggestions) > opts.Limit {
+		suggestions = suggestions[:opts.Limit]
+	}
+	return suggestions, nil
+}
@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSuggestCacheTTL is how long a SuggestCache keeps results when SUGGEST_CACHE_TTL is
+	// unset.
+	DefaultSuggestCacheTTL = 30 * time.Second
+
+	// maxSuggestCacheEntries bounds the memory a SuggestCache uses; storing more clears it.
+	maxSuggestCacheEntries = 10000
+)
+
+// SuggestCacheTTLFromEnv returns the time-to-live set in SUGGEST_CACHE_TTL (a Go duration such
+// as 1m), or DefaultSuggestCacheTTL when it is unset.
+func SuggestCacheTTLFromEnv() (time.Duration, error) {
+	loadDotEnv()
+	v := os.Getenv("SUGGEST_CACHE_TTL")
+	if v == "" {
+		return DefaultSuggestCacheTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid SUGGEST_CACHE_TTL %q: must be a positive duration", v)
+	}
+	return ttl, nil
+}
+
+// SuggestCache is a UserRepository that keeps SuggestValues results in memory for a TTL and
+// passes every other call through. Every change made through it, or through the
+// DepartmentRepository returned by Departments, clears the cache, so this process never serves
+// suggestions older than its own writes; changes made by other processes show up once the TTL
+// expires.
+type SuggestCache struct {
+	UserRepository
+	ttl time.Duration
+	now func() time.Time
+
+	mu sync.Mutex
+	// generation counts clears, so that a result read before a clear is not stored after it.
+	generation uint64
+	entries    map[SuggestOptions]suggestEntry
+}
+
+var _ UserRepository = &SuggestCache{}
+
+type suggestEntry struct {
+	suggestions []Suggestion
+	expires     time.Time
+}
+
+// NewSuggestCache wraps repo with a suggestion cache whose entries live for ttl.
+func NewSuggestCache(repo UserRepository, ttl time.Duration) *SuggestCache {
+	return &SuggestCache{
+		UserRepository: repo,
+		ttl:            ttl,
+		now:            time.Now,
+		entries:        map[SuggestOptions]suggestEntry{},
+	}
+}
+
+// SuggestValues returns cached suggestions while they are fresh and asks the wrapped repository
+// otherwise. Callers share the returned slice and must not modify it.
+func (c *SuggestCache) SuggestValues(ctx context.Context, opts SuggestOptions) ([]Suggestion, error) {
+	opts, _, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	// Matching ignores case, so prefixes that differ only in case share an entry.
+	opts.Prefix = strings.ToLower(opts.Prefix)
+
+	c.mu.Lock()
+	entry, ok := c.entries[opts]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.suggestions, nil
+	}
+
+	suggestions, err := c.UserRepository.SuggestValues(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		if len(c.entries) >= maxSuggestCacheEntries {
+			c.entries = map[SuggestOptions]suggestEntry{}
+		}
+		c.entries[opts] = suggestEntry{suggestions: suggestions, expires: c.now().Add(c.ttl)}
+	}
+	return suggestions, nil
+}
+
+// clear drops every cached result.
+func (c *SuggestCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = map[SuggestOptions]suggestEntry{}
+}
+
+// The methods below change users. Each clears the cache once the wrapped call returns, even when
+// it fails, since a failed bulk change may still have applied some of its operations.
+
+func (c *SuggestCache) CreateUser(ctx context.Context, user *User) error {
+	defer c.clear()
+	return c.UserRepository.CreateUser(ctx, user)
+}
+
+func (c *SuggestCache) UpdateUser(ctx context.Context, user *User) error {
+	defer c.clear()
+	return c.UserRepository.UpdateUser(ctx, user)
+}
+
+func (c *SuggestCache) UpsertUser(ctx context.Context, user *User) (bool, error) {
+	defer c.clear()
+	return c.UserRepository.UpsertUser(ctx, user)
+}
+
+func (c *SuggestCache) ImportUsers(ctx context.Context, users []User, opts ImportOptions) ([]error, error) {
+	defer c.clear()
+	return c.UserRepository.ImportUsers(ctx, users, opts)
+}
+
+func (c *SuggestCache) PatchUser(ctx context.Context, userID int, expectedVersion int, updates map[string]interface{}) error {
+	defer c.clear()
+	return c.UserRepository.PatchUser(ctx, userID, expectedVersion, updates)
+}
+
+func (c *SuggestCache) ModifyUser(ctx context.Context, userID int, expectedVersion int, modify func(current User) (map[string]interface{}, error)) error {
+	defer c.clear()
+	return c.UserRepository.ModifyUser(ctx, userID, expectedVersion, modify)
+}
+
+func (c *SuggestCache) ApplyBulk(ctx context.Context, ops []BulkOperation, opts BulkOptions) ([]BulkResult, error) {
+	defer c.clear()
+	return c.UserRepository.ApplyBulk(ctx, ops, opts)
+}
+
+func (c *SuggestCache) PatchMatchingUsers(ctx context.Context, filter ListOptions, changes map[string]interface{}, opts BulkOptions) ([]BulkResult, error) {
+	defer c.clear()
+	return c.UserRepository.PatchMatchingUsers(ctx, filter, changes, opts)
+}
+
+func (c *SuggestCache) RestoreUser(ctx context.Context, userID int, expectedVersion int) (*User, error) {
+	defer c.clear()
+	return c.UserRepository.RestoreUser(ctx, userID, expectedVersion)
+}
+
+func (c *SuggestCache) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int, error) {
+	defer c.clear()
+	return c.UserRepository.PurgeDeletedUsers(ctx, deletedBefore)
+}
+
+func (c *SuggestCache) DeleteUserByID(ctx context.Context, userID int, expectedVersion int) error {
+	defer c.clear()
+	return c.UserRepository.DeleteUserByID(ctx, userID, expectedVersion)
+}
+
+// Departments returns repo with every department change clearing the cache, since renaming a
+// department renames it for its users.
+func (c *SuggestCache) Departments(repo DepartmentRepository) DepartmentRepository {
+	return &suggestCacheDepartments{DepartmentRepository: repo, cache: c}
+}
+
+// suggestCacheDepartments is a DepartmentRepository whose changes clear a SuggestCache.
+type suggestCacheDepartments struct {
+	DepartmentRepository
+	cache *SuggestCache
+}
+
+func (d *suggestCacheDepartments) CreateDepartment(ctx context.Context, department *Department) error {
+	defer d.cache.clear()
+	return d.DepartmentRepository.CreateDepartment(ctx, department)
+}
+
+func (d *suggestCacheDepartments) UpdateDepartment(ctx context.Context, department *Department) error {
+	defer d.cache.clear()
+	return d.DepartmentRepository.UpdateDepartment(ctx, department)
+}
+
+func (d *suggestCacheDepartments) DeleteDepartmentByID(ctx context.Context, departmentID int, expectedVersion int) error {
+	defer d.cache.clear()
+	return d.DepartmentRepository.DeleteDepartmentByID(ctx, departmentID, expectedVersion)
+}
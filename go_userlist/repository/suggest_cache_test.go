@@ -0,0 +1,96 @@
+package repository_test
+
+import (
+	"context"
+	"go_userlist/repository"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// countingRepository counts the SuggestValues calls that reach the memory repository.
+type countingRepository struct {
+	*repository.MemoryUserRepository
+	suggests int
+}
+
+func (r *countingRepository) SuggestValues(ctx context.Context, opts repository.SuggestOptions) ([]repository.Suggestion, error) {
+	r.suggests++
+	return r.MemoryUserRepository.SuggestValues(ctx, opts)
+}
+
+var _ = Describe("SuggestCache", func() {
+	var (
+		inner *countingRepository
+		ctx   = context.Background()
+		hr    = repository.SuggestOptions{Field: "department", Prefix: "h"}
+	)
+
+	BeforeEach(func() {
+		inner = &countingRepository{MemoryUserRepository: repository.NewMemoryUserRepository(
+			repository.User{User_name: "jdoe01", Email: "jdoe01@example.com", Department: "HR"},
+			repository.User{User_name: "asmith01", Email: "asmith01@example.com", Department: "Finance"},
+		)}
+	})
+
+	It("should serve repeated requests from the cache, whatever the case of the prefix", func() {
+		cache := repository.NewSuggestCache(inner, time.Minute)
+		first, err := cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first).To(Equal([]repository.Suggestion{{Value: "HR", Count: 1}}))
+
+		again, err := cache.SuggestValues(ctx, repository.SuggestOptions{Field: "department", Prefix: "H", Limit: repository.DefaultSuggestLimit})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(first))
+		Expect(inner.suggests).To(Equal(1))
+
+		_, err = cache.SuggestValues(ctx, repository.SuggestOptions{Field: "email"})
+		Expect(err).To(MatchError(repository.ErrInvalidSuggest))
+		Expect(inner.suggests).To(Equal(1))
+	})
+
+	It("should forget everything when a user changes through it", func() {
+		cache := repository.NewSuggestCache(inner, time.Minute)
+		_, err := cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(cache.CreateUser(ctx, &repository.User{User_name: "bwhite01", Email: "bwhite01@example.com", Department: "HR"})).To(Succeed())
+		suggestions, err := cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(suggestions).To(Equal([]repository.Suggestion{{Value: "HR", Count: 2}}))
+		Expect(inner.suggests).To(Equal(2))
+
+		_, err = cache.ApplyBulk(ctx, []repository.BulkOperation{{Op: repository.BulkDelete, UserID: 99}}, repository.BulkOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(inner.suggests).To(Equal(3))
+	})
+
+	It("should forget everything when a department changes through it", func() {
+		cache := repository.NewSuggestCache(inner, time.Minute)
+		departments := cache.Departments(inner)
+		_, err := cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+
+		hrDepartment, err := departments.GetDepartmentByID(ctx, 1)
+		Expect(err).NotTo(HaveOccurred())
+		hrDepartment.Name = "Human Resources"
+		Expect(departments.UpdateDepartment(ctx, hrDepartment)).To(Succeed())
+		suggestions, err := cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(suggestions).To(Equal([]repository.Suggestion{{Value: "Human Resources", Count: 1}}))
+		Expect(inner.suggests).To(Equal(2))
+	})
+
+	It("should ask the repository again once an entry expires", func() {
+		cache := repository.NewSuggestCache(inner, time.Millisecond)
+		_, err := cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+		time.Sleep(5 * time.Millisecond)
+		_, err = cache.SuggestValues(ctx, hr)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(inner.suggests).To(Equal(2))
+	})
+})
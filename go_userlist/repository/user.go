@@ -1,5 +1,7 @@
 package repository
 
+import "time"
+
 // User represents a user in the system
 type User struct {
 	User_id     int    `json:"user_id"`
@@ -9,4 +11,7 @@ type User struct {
 	Email       string `json:"email"`
 	User_status string `json:"user_status"`
 	Department  string `json:"department"`
+	Version     int    `json:"version"` // incremented on every change, used for optimistic concurrency
+
+	Deleted_at *time.Time `json:"deleted_at,omitempty"` // set while the user is soft deleted
 }
@@ -1,48 +1,160 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync"
 	"time"
 
-	"github.com/IBM/sarama"
 	"github.com/Masterminds/squirrel"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
-// UserRepository defines the interface that the PostgresUserRepository must implement
+// UserRepository defines the interface that the PostgresUserRepository must implement.
+// Every method stops waiting on the database once ctx is done and returns its error.
 type UserRepository interface {
-	CreateUser(user *User) error
-	UpdateUser(user *User) error
-	GetUserByID(userID int) (*User, error)
-	PatchUser(userID int, updates map[string]interface{}) error
-	GetAllUsers() ([]User, error)
+	CreateUser(ctx context.Context, user *User) error
+	UpdateUser(ctx context.Context, user *User) error
+	UpsertUser(ctx context.Context, user *User) (created bool, err error)
+	ImportUsers(ctx context.Context, users []User, opts ImportOptions) (rejected []error, err error)
+	GetUserByID(ctx context.Context, userID int) (*User, error)
+	GetUserByIDIncludingDeleted(ctx context.Context, userID int) (*User, error)
+	PatchUser(ctx context.Context, userID int, expectedVersion int, updates map[string]interface{}) error
+	ModifyUser(ctx context.Context, userID int, expectedVersion int, modify func(current User) (map[string]interface{}, error)) error
+	GetAllUsers(ctx context.Context) ([]User, error)
+	ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error)
+	ListUsersAfter(ctx context.Context, opts ListOptions, cursor string) (*UserPage, error)
+	ExportUsers(ctx context.Context, opts ListOptions, fn func(User) error) error
+	SearchUsers(ctx context.Context, opts SearchOptions) ([]SearchHit, error)
+	SuggestValues(ctx context.Context, opts SuggestOptions) ([]Suggestion, error)
+	ApplyBulk(ctx context.Context, ops []BulkOperation, opts BulkOptions) ([]BulkResult, error)
+	PatchMatchingUsers(ctx context.Context, filter ListOptions, changes map[string]interface{}, opts BulkOptions) ([]BulkResult, error)
+	RestoreUser(ctx context.Context, userID int, expectedVersion int) (*User, error)
+	PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int, error)
+	DeleteUserByID(ctx context.Context, userID int, expectedVersion int) error
+	Close() error
 }
 
 // Ensure PostgresUserRepository implements UserRepository
 var _ UserRepository = &PostgresUserRepository{}
 
 // ErrUserNotFound is returned when a user is not found in the database.
-var ErrUserNotFound = errors.New("user not found")
+var ErrUserNotFound = newError(ErrNotFound, "user_not_found", "user not found")
+
+// ErrUserNotDeleted is returned when restoring a user that is not soft deleted.
+var ErrUserNotDeleted = newError(ErrConflict, "user_not_deleted", "user is not deleted")
+
+// notDeleted restricts a query to users that are not soft deleted.
+var notDeleted = squirrel.Eq{"deleted_at": nil}
+
+// ErrVersionMismatch is returned when a user has changed since the version the caller expected.
+var ErrVersionMismatch = newError(ErrConflict, "version_mismatch", "user version mismatch")
+
+// AnyVersion, passed as an expected version, skips the optimistic concurrency check.
+const AnyVersion = 0
+
+// checkVersion returns ErrVersionMismatch unless current is at the expected version.
+func checkVersion(current *User, expectedVersion int) error {
+	if expectedVersion != AnyVersion && current.Version != expectedVersion {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// execVersioned runs an UPDATE or DELETE guarded by the row's version and reports
+// ErrVersionMismatch when the guard matched no row.
+func execVersioned(ctx context.Context, tx dbtx, query string, args []interface{}) error {
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// queryVersioned runs an UPDATE guarded by the row's version that returns columns into dest and
+// reports ErrVersionMismatch when the guard matched no row.
+func queryVersioned(ctx context.Context, tx dbtx, query string, args []interface{}, dest ...interface{}) error {
+	err := tx.QueryRowContext(ctx, query, args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return ErrVersionMismatch
+	}
+	return err
+}
+
+// userColumns are the columns of public.users in the order scanUser expects them.
+var userColumns = fieldColumns()
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads one row selected with userColumns into a User. Columns selected after
+// userColumns are scanned into extra.
+func scanUser(row rowScanner, extra ...interface{}) (User, error) {
+	var user User
+	var department sql.NullString
+	dest := append([]interface{}{&user.User_id, &user.User_name, &user.First_name, &user.Last_name, &user.Email, &user.User_status, &department, &user.Version, &user.Deleted_at}, extra...)
+	err := row.Scan(dest...)
+	user.Department = department.String
+	return user, err
+}
+
+// departmentValue returns what users.department stores for a department name: NULL for no
+// department, which the users_department_fkey foreign key lets through, and the name otherwise.
+func departmentValue(name string) interface{} {
+	if name == "" {
+		return nil
+	}
+	return name
+}
 
 type PostgresUserRepository struct {
-	db   *sql.DB
-	psql squirrel.StatementBuilderType
+	db        *sql.DB
+	psql      squirrel.StatementBuilderType
+	publisher Publisher
+}
+
+// Option configures optional dependencies of a PostgresUserRepository.
+type Option func(*PostgresUserRepository)
+
+// WithPublisher sets the publisher the outbox relay delivers user change events through.
+func WithPublisher(publisher Publisher) Option {
+	return func(r *PostgresUserRepository) {
+		r.publisher = publisher
+	}
+}
+
+var dotEnvOnce sync.Once
+
+// loadDotEnv loads the .env file, if present, into the environment once per process.
+func loadDotEnv() {
+	dotEnvOnce.Do(func() {
+		if err := godotenv.Load(); err != nil {
+			fmt.Println("Error loading .env file, using system environment variables")
+		}
+	})
 }
 
 // NewPostgresUserRepository initializes a new PostgresUserRepository with an optional *sql.DB parameter.
-func NewPostgresUserRepository(db *sql.DB) (*PostgresUserRepository, error) {
+func NewPostgresUserRepository(db *sql.DB, opts ...Option) (*PostgresUserRepository, error) {
 	if db == nil {
 		// Load .env file if present
-		err := godotenv.Load()
-		if err != nil {
-			fmt.Println("Error loading .env file, using system environment variables")
-		}
+		loadDotEnv()
+
+		var err error
 
 		// Construct the connection string
 		connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=%s",
@@ -60,203 +172,517 @@ func NewPostgresUserRepository(db *sql.DB) (*PostgresUserRepository, error) {
 	}
 
 	// Return the initialized repository
-	return &PostgresUserRepository{
+	r := &PostgresUserRepository{
 		db:   db,
 		psql: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
 }
 
 // Close closes the database connection when done.
-func (r *PostgresUserRepository) Close() {
-	r.db.Close()
+func (r *PostgresUserRepository) Close() error {
+	return r.db.Close()
+}
+
+// CreateUser inserts a new user into the database and records a create event in the outbox.
+func (r *PostgresUserRepository) CreateUser(ctx context.Context, user *User) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		return r.createInTx(ctx, tx, user)
+	})
 }
 
-// CreateUser inserts a new user into the database.
-func (r *PostgresUserRepository) CreateUser(user *User) error {
+// createInTx inserts user inside tx, sets the id and version the database assigned and records
+// the create event.
+func (r *PostgresUserRepository) createInTx(ctx context.Context, tx *sql.Tx, user *User) error {
 	query, args, err := r.psql.Insert("public.users").
 		Columns("user_name", "first_name", "last_name", "email", "user_status", "department").
-		Values(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, user.Department).
-		Suffix("RETURNING user_id").ToSql()
+		Values(user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, departmentValue(user.Department)).
+		Suffix("RETURNING user_id, version").ToSql()
 
 	if err != nil {
 		return err
 	}
-	ProduceKafkaMessage(user, "prism-user-create")
-	return r.db.QueryRow(query, args...).Scan(&user.User_id)
+
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&user.User_id, &user.Version); err != nil {
+		return err
+	}
+	return r.enqueueEvent(ctx, tx, EventUserCreated, user.User_id, user, nil)
 }
 
-// UpdateUser updates the entire user record in the database.
-func (r *PostgresUserRepository) UpdateUser(user *User) error {
+// UpdateUser updates the entire user record in the database and records an update event
+// carrying the changed fields in the outbox. user.Version is the version the caller last saw
+// (AnyVersion to overwrite unconditionally); on success it is set to the new version.
+func (r *PostgresUserRepository) UpdateUser(ctx context.Context, user *User) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		return r.updateInTx(ctx, tx, user)
+	})
+}
+
+// UpsertUser creates the user with the given User_id if no user has that id, and otherwise
+// updates it as UpdateUser does. It reports whether the user was created. A soft deleted user
+// keeps its id, so upserting it returns ErrUserNotFound until it is restored; an expected
+// version other than AnyVersion on a missing user returns ErrVersionMismatch.
+func (r *PostgresUserRepository) UpsertUser(ctx context.Context, user *User) (bool, error) {
+	query, args, err := r.psql.Insert("public.users").
+		Columns("user_id", "user_name", "first_name", "last_name", "email", "user_status", "department").
+		Values(user.User_id, user.User_name, user.First_name, user.Last_name, user.Email, user.User_status, departmentValue(user.Department)).
+		Suffix("ON CONFLICT (user_id) DO NOTHING RETURNING version").ToSql()
+	if err != nil {
+		return false, err
+	}
+
+	var created bool
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		var version int
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&version)
+		if err == sql.ErrNoRows {
+			// The id is taken, so this is an update.
+			return r.updateInTx(ctx, tx, user)
+		}
+		if err != nil {
+			return err
+		}
+		if user.Version != AnyVersion {
+			return ErrVersionMismatch
+		}
+
+		// Move the id sequence past the chosen id so CreateUser never hands it out. nextval keeps
+		// the sequence from ever going backwards under concurrent inserts.
+		if _, err := tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('public.users', 'user_id'), GREATEST($1, nextval(pg_get_serial_sequence('public.users', 'user_id'))))", user.User_id); err != nil {
+			return err
+		}
+
+		user.Version = version
+		user.Deleted_at = nil
+		created = true
+		return r.enqueueEvent(ctx, tx, EventUserCreated, user.User_id, user, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// updateInTx replaces the fields of user inside tx, guarded by the version the caller expects,
+// and records the update event.
+func (r *PostgresUserRepository) updateInTx(ctx context.Context, tx *sql.Tx, user *User) error {
+	before, err := r.lockUserByID(ctx, tx, user.User_id)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(before, user.Version); err != nil {
+		return err
+	}
+
 	query, args, err := r.psql.Update("public.users").
 		Set("user_name", user.User_name).
 		Set("first_name", user.First_name).
 		Set("last_name", user.Last_name).
 		Set("email", user.Email).
 		Set("user_status", user.User_status).
-		Set("department", user.Department).
-		Where(squirrel.Eq{"user_id": user.User_id}).ToSql()
+		Set("department", departmentValue(user.Department)).
+		Set("version", squirrel.Expr("version + 1")).
+		Where(squirrel.Eq{"user_id": user.User_id, "version": before.Version}).ToSql()
 
 	if err != nil {
 		return err
 	}
 
-	_, err = r.db.Exec(query, args...)
-	ProduceKafkaMessage(user, "prism-user-update")
-	return err
+	if err := execVersioned(ctx, tx, query, args); err != nil {
+		return err
+	}
+	user.Version = before.Version + 1
+	return r.enqueueUpdate(ctx, tx, before, user)
 }
 
-// PatchUser updates specific fields of a user in the database.
-func (r *PostgresUserRepository) PatchUser(userID int, updates map[string]interface{}) error {
-	queryBuilder := r.psql.Update("public.users").Where(squirrel.Eq{"user_id": userID})
+// PatchUser updates specific fields of a user in the database and records an update event
+// carrying the changed fields in the outbox. updates is keyed by json field name; unknown or
+// immutable fields and values of the wrong type are rejected with a *PatchError.
+func (r *PostgresUserRepository) PatchUser(ctx context.Context, userID int, expectedVersion int, updates map[string]interface{}) error {
+	columns, err := PatchColumns(updates)
+	if err != nil {
+		return err
+	}
 
-	// Dynamically add fields to update
-	for key, value := range updates {
-		queryBuilder = queryBuilder.Set(key, value)
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := r.patchInTx(ctx, tx, userID, expectedVersion, columns)
+		return err
+	})
+}
+
+// patchInTx locks the user, checks its version and sets the given columns inside tx. It returns
+// the user as patched.
+func (r *PostgresUserRepository) patchInTx(ctx context.Context, tx *sql.Tx, userID int, expectedVersion int, columns map[string]interface{}) (*User, error) {
+	before, err := r.lockUserByID(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(before, expectedVersion); err != nil {
+		return nil, err
+	}
+	return r.patchLocked(ctx, tx, before, columns)
+}
+
+// ModifyUser loads the user, locks it and calls modify with the current record. The updates
+// modify returns (keyed by json field name, validated as for PatchUser) are applied in the same
+// transaction, so the read-modify-write cannot interleave with other changes to the user.
+// An error from modify aborts the transaction and is returned unchanged; no updates is a no-op.
+func (r *PostgresUserRepository) ModifyUser(ctx context.Context, userID int, expectedVersion int, modify func(current User) (map[string]interface{}, error)) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := r.lockUserByID(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(before, expectedVersion); err != nil {
+			return err
+		}
+
+		updates, err := modify(*before)
+		if err != nil {
+			return err
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+
+		columns, err := PatchColumns(updates)
+		if err != nil {
+			return err
+		}
+		_, err = r.patchLocked(ctx, tx, before, columns)
+		return err
+	})
+}
+
+// patchLocked sets the given columns on a user whose row tx has locked, bumps its version and
+// records the update event. It returns the user as patched.
+func (r *PostgresUserRepository) patchLocked(ctx context.Context, tx *sql.Tx, before *User, columns map[string]interface{}) (*User, error) {
+	queryBuilder := r.psql.Update("public.users").
+		Set("version", squirrel.Expr("version + 1")).
+		Where(squirrel.Eq{"user_id": before.User_id, "version": before.Version})
+
+	// Dynamically add the validated columns to update
+	for column, value := range columns {
+		if column == "department" {
+			value = departmentValue(value.(string))
+		}
+		queryBuilder = queryBuilder.Set(column, value)
 	}
 
 	query, args, err := queryBuilder.ToSql()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = r.db.Exec(query, args...)
-	return err
+	if err := execVersioned(ctx, tx, query, args); err != nil {
+		return nil, err
+	}
+
+	after, err := r.getUserByID(ctx, tx, before.User_id)
+	if err != nil {
+		return nil, err
+	}
+	return after, r.enqueueUpdate(ctx, tx, before, after)
+}
+
+// enqueueUpdate records an update event with the fields that differ between before and after,
+// and the full record before the update. Nothing is recorded when no field changed.
+func (r *PostgresUserRepository) enqueueUpdate(ctx context.Context, tx dbtx, before, after *User) error {
+	changes := diffUsers(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+	return r.enqueueEvent(ctx, tx, EventUserUpdated, before.User_id, UserUpdate{User_id: before.User_id, Changes: changes}, before)
 }
 
 // GetUserByID fetches a user by their ID.
-func (r *PostgresUserRepository) GetUserByID(userID int) (*User, error) {
-	var user User
-	query, args, err := r.psql.Select("user_id", "user_name", "first_name", "last_name", "email", "user_status", "department").
+func (r *PostgresUserRepository) GetUserByID(ctx context.Context, userID int) (*User, error) {
+	return r.getUserByID(ctx, r.db, userID)
+}
+
+// GetUserByIDIncludingDeleted fetches a user by their ID even if the user is soft deleted.
+func (r *PostgresUserRepository) GetUserByIDIncludingDeleted(ctx context.Context, userID int) (*User, error) {
+	return r.queryUser(ctx, r.db, r.selectUserByID(userID, true))
+}
+
+// getUserByID fetches a user that is not soft deleted by their ID through q, which may be the
+// database or a transaction.
+func (r *PostgresUserRepository) getUserByID(ctx context.Context, q dbtx, userID int) (*User, error) {
+	return r.queryUser(ctx, q, r.selectUserByID(userID, false))
+}
+
+// lockUserByID fetches a user that is not soft deleted by their ID and locks the row until tx ends.
+func (r *PostgresUserRepository) lockUserByID(ctx context.Context, tx dbtx, userID int) (*User, error) {
+	return r.queryUser(ctx, tx, r.selectUserByID(userID, false).Suffix("FOR UPDATE"))
+}
+
+// selectUserByID selects the user with the given ID, skipping soft deleted users unless includeDeleted is set.
+func (r *PostgresUserRepository) selectUserByID(userID int, includeDeleted bool) squirrel.SelectBuilder {
+	sb := r.psql.Select(userColumns...).
 		From("public.users").
-		Where(squirrel.Eq{"user_id": userID}).ToSql()
+		Where(squirrel.Eq{"user_id": userID})
+	if !includeDeleted {
+		sb = sb.Where(notDeleted)
+	}
+	return sb
+}
 
+// queryUser runs a single-row user query, translating no rows into ErrUserNotFound.
+func (r *PostgresUserRepository) queryUser(ctx context.Context, q dbtx, sb squirrel.SelectBuilder) (*User, error) {
+	query, args, err := sb.ToSql()
 	if err != nil {
 		return nil, err
 	}
 
-	err = r.db.QueryRow(query, args...).Scan(&user.User_id, &user.User_name, &user.First_name, &user.Last_name, &user.Email, &user.User_status, &user.Department)
+	user, err := scanUser(q.QueryRowContext(ctx, query, args...))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrUserNotFound
 		}
-		return nil, err
+		return nil, wrapDBError(err)
 	}
 	return &user, nil
 }
 
-// GetAllUsers fetches all users from the database.
-func (r *PostgresUserRepository) GetAllUsers() ([]User, error) {
-	query, args, err := r.psql.Select("user_id", "user_name", "first_name", "last_name", "email", "user_status", "department").
-		From("public.users").ToSql()
+// GetAllUsers fetches all users that are not soft deleted from the database.
+func (r *PostgresUserRepository) GetAllUsers(ctx context.Context) ([]User, error) {
+	query, args, err := r.psql.Select(userColumns...).
+		From("public.users").
+		Where(notDeleted).ToSql()
 
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := r.db.Query(query, args...)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, wrapDBError(err)
 	}
 	defer rows.Close()
 
 	var users []User
 
 	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.User_id, &user.User_name, &user.First_name, &user.Last_name, &user.Email, &user.User_status, &user.Department)
+		user, err := scanUser(rows)
 		if err != nil {
-			return nil, err
+			return nil, wrapDBError(err)
 		}
 		users = append(users, user)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, wrapDBError(err)
 	}
 
 	return users, nil
 }
 
-// DeleteUserByID deletes a user by their ID from the database.
-func (r *PostgresUserRepository) DeleteUserByID(userID int) error {
-	// get the user info from database so it can be used in Kafka
-	user, err2 := r.GetUserByID(userID)
+// ListUsers fetches one page of users matching the filters in opts, ordered as requested.
+func (r *PostgresUserRepository) ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	opts, err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
 
-	if err2 != nil {
-		return err2
+	countQuery, countArgs, err := applyListFilters(r.psql.Select("COUNT(*)").From("public.users"), opts).ToSql()
+	if err != nil {
+		return nil, err
 	}
 
-	query, args, err := r.psql.Delete("public.users").
-		Where(squirrel.Eq{"user_id": userID}).ToSql()
+	page := &UserPage{Users: []User{}, Page: opts.Page, Size: opts.Size}
+	if err := r.db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&page.Total); err != nil {
+		return nil, wrapDBError(err)
+	}
 
+	query, args, err := applyListFilters(r.psql.Select(userColumns...).From("public.users"), opts).
+		OrderBy(opts.orderBy()...).
+		Limit(uint64(opts.Size)).
+		Offset(uint64(opts.offset())).ToSql()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	result, err := r.db.Exec(query, args...)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return err
+		return nil, wrapDBError(err)
 	}
+	defer rows.Close()
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, wrapDBError(err)
+		}
+		page.Users = append(page.Users, user)
 	}
 
-	if rowsAffected == 0 {
-		return ErrUserNotFound
+	if err = rows.Err(); err != nil {
+		return nil, wrapDBError(err)
 	}
 
-	ProduceKafkaMessage(user, "prism-user-delete")
-	return nil
+	return page, nil
 }
 
-// prism-user-create
-// prism-user-delete
-// prism-user-update
-func ProduceKafkaMessage(user *User, topic string) error {
-	broker := "localhost:9092"
+// ListUsersAfter fetches up to opts.Size users ordered as requested, starting strictly after the
+// row identified by cursor (or from the beginning when cursor is empty). Unlike ListUsers it does
+// not count the matching rows; the returned page carries a NextCursor while more rows remain.
+func (r *PostgresUserRepository) ListUsersAfter(ctx context.Context, opts ListOptions, cursor string) (*UserPage, error) {
+	opts, err := opts.Normalize()
+	if err != nil {
+		return nil, err
+	}
 
-	// Serialize user struct to JSON
-	userData, err := json.Marshal(user)
+	sb := applyListFilters(r.psql.Select(userColumns...).From("public.users"), opts)
+	sortExpr := opts.keysetColumn()
+	op := ">"
+	if opts.SortDir == SortDesc {
+		op = "<"
+	}
+
+	if cursor != "" {
+		c, err := decodeCursor(cursor, opts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.SortBy == "user_id" {
+			sb = sb.Where("user_id "+op+" ?", c.UserID)
+		} else {
+			sb = sb.Where("("+sortExpr+", user_id) "+op+" (?, ?)", c.Key, c.UserID)
+		}
+	}
+
+	orderBy := []string{"user_id " + opts.SortDir}
+	if opts.SortBy != "user_id" {
+		orderBy = append([]string{sortExpr + " " + opts.SortDir}, orderBy...)
+	}
+
+	// Fetch one extra row to find out whether another page follows.
+	query, args, err := sb.OrderBy(orderBy...).Limit(uint64(opts.Size + 1)).ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("error serializing user data: %w", err)
+		return nil, wrapDBError(err)
+	}
+	defer rows.Close()
+
+	page := &UserPage{Users: []User{}, Size: opts.Size}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, wrapDBError(err)
+		}
+		page.Users = append(page.Users, user)
 	}
 
-	// Create Kafka producer config with idempotent option enabled
-	config := sarama.NewConfig()
-	config.Producer.Idempotent = true // Enable idempotent producer
-	config.Producer.Return.Successes = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
+	if err = rows.Err(); err != nil {
+		return nil, wrapDBError(err)
+	}
+
+	if len(page.Users) > opts.Size {
+		page.Users = page.Users[:opts.Size]
+		page.NextCursor = cursorAfter(page.Users[opts.Size-1], opts)
+	}
+
+	return page, nil
+}
+
+// ExportUsers calls fn for every user matching the filters in opts, in the requested order,
+// while reading them from the database, so the whole listing is never held in memory. Page and
+// Size are ignored. An error from fn stops the export and is returned unchanged.
+func (r *PostgresUserRepository) ExportUsers(ctx context.Context, opts ListOptions, fn func(User) error) error {
+	opts.Page, opts.Size = 0, 0
+	opts, err := opts.Normalize()
+	if err != nil {
+		return err
+	}
+
+	query, args, err := applyListFilters(r.psql.Select(userColumns...).From("public.users"), opts).
+		OrderBy(opts.orderBy()...).ToSql()
+	if err != nil {
+		return err
+	}
 
-	// Create Kafka producer
-	producer, err := sarama.NewSyncProducer([]string{broker}, config)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("error creating Kafka producer: %w", err)
+		return wrapDBError(err)
 	}
-	defer func() {
-		if err := producer.Close(); err != nil {
-			log.Printf("error closing Kafka producer: %v", err)
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return wrapDBError(err)
+		}
+		if err := fn(user); err != nil {
+			return err
 		}
-	}()
+	}
+	return wrapDBError(rows.Err())
+}
 
-	// Generate a unique key using user_id and datetime stamp
-	timestamp := time.Now().Format(time.RFC3339) // Using RFC3339 for a standard format
-	key := fmt.Sprintf("%d_%s", user.User_id, timestamp)
+// applyListFilters adds the WHERE clauses for the filters in opts.
+func applyListFilters(sb squirrel.SelectBuilder, opts ListOptions) squirrel.SelectBuilder {
+	if opts.Department != "" {
+		sb = sb.Where(squirrel.Eq{"department": opts.Department})
+	}
+	if opts.UserStatus != "" {
+		sb = sb.Where(squirrel.Eq{"user_status": opts.UserStatus})
+	}
+	if opts.NamePrefix != "" {
+		prefix := escapeLike(opts.NamePrefix) + "%"
+		sb = sb.Where(squirrel.Or{
+			squirrel.ILike{"user_name": prefix},
+			squirrel.ILike{"first_name": prefix},
+			squirrel.ILike{"last_name": prefix},
+		})
+	}
+	if !opts.IncludeDeleted {
+		sb = sb.Where(notDeleted)
+	}
+	return sb
+}
 
-	// Create Kafka message
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   sarama.StringEncoder(key),
-		Value: sarama.ByteEncoder(userData),
+// DeleteUserByID soft deletes a user by setting deleted_at and records a delete event in the outbox.
+// The row stays in public.users until PurgeDeletedUsers removes it, so RestoreUser can undo this.
+// expectedVersion guards against deleting a user that changed since the caller last saw it.
+func (r *PostgresUserRepository) DeleteUserByID(ctx context.Context, userID int, expectedVersion int) error {
+	return r.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := r.deleteInTx(ctx, tx, userID, expectedVersion)
+		return err
+	})
+}
+
+// deleteInTx soft deletes a user inside tx, records the delete event and returns the user as
+// deleted.
+func (r *PostgresUserRepository) deleteInTx(ctx context.Context, tx *sql.Tx, userID int, expectedVersion int) (*User, error) {
+	// get the user info from database so it can be used in the event
+	user, err := r.lockUserByID(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion(user, expectedVersion); err != nil {
+		return nil, err
 	}
 
-	// Produce the message
-	partition, offset, err := producer.SendMessage(msg)
+	query, args, err := r.psql.Update("public.users").
+		Set("deleted_at", squirrel.Expr("now()")).
+		Set("version", squirrel.Expr("version + 1")).
+		Where(squirrel.Eq{"user_id": userID, "version": user.Version}).
+		Suffix("RETURNING deleted_at, version").ToSql()
+
 	if err != nil {
-		return fmt.Errorf("error producing to Kafka: %w", err)
+		return nil, err
 	}
 
-	fmt.Printf("Produced message to topic %s, partition %d, offset %d, key: %s\n", topic, partition, offset, key)
-	return nil
+	if err := queryVersioned(ctx, tx, query, args, &user.Deleted_at, &user.Version); err != nil {
+		return nil, err
+	}
+
+	return user, r.enqueueEvent(ctx, tx, EventUserDeleted, user.User_id, user, nil)
 }
@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// FormatEmail is the Field.Format of fields holding a single bare e-mail address.
+const FormatEmail = "email"
+
+// UserStatuses are the allowed values of user_status: active and inactive.
+var UserStatuses = []string{"A", "I"}
+
+// userNamePattern restricts user names to characters that are safe in logins and URLs.
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Codes of FieldError, stable so clients can map them to their own messages.
+const (
+	CodeRequired  = "required"
+	CodeMaxLength = "max_length"
+	CodeFormat    = "format"
+	CodePattern   = "pattern"
+	CodeOneOf     = "one_of"
+	CodeUnknown   = "unknown"
+	CodeImmutable = "immutable"
+	CodeType      = "type"
+	CodeReference = "reference"
+)
+
+// FieldError describes one field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Message
+}
+
+// ValidationError lists every field of a user or department that failed validation, in
+// registry order.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+	Code   string       `json:"-"` // the error code, "invalid_user" when empty
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Field + " " + f.Message
+	}
+	return ErrValidation.Error() + ": " + strings.Join(parts, "; ")
+}
+
+// Unwrap lets errors.Is match ErrValidation.
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+// ErrorCode returns the stable code of a failed validation.
+func (e *ValidationError) ErrorCode() string {
+	if e.Code != "" {
+		return e.Code
+	}
+	return "invalid_user"
+}
+
+// ValidateUser checks every mutable field of user against the registry and reports all
+// failures together in a *ValidationError.
+func ValidateUser(user *User) error {
+	verr := &ValidationError{}
+	for _, f := range userFields {
+		if f.Immutable {
+			continue
+		}
+		v, ok := f.get(user).(string)
+		if !ok {
+			continue
+		}
+		if ferr := f.validate(v); ferr != nil {
+			verr.Fields = append(verr.Fields, *ferr)
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validate checks a string value against the field's constraints. Empty values only fail
+// when the field is required.
+func (f Field) validate(v string) *FieldError {
+	fail := func(code, format string, args ...interface{}) *FieldError {
+		return &FieldError{Field: f.JSONName, Code: code, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if strings.TrimSpace(v) == "" {
+		if f.Required {
+			return fail(CodeRequired, "must not be empty")
+		}
+		return nil
+	}
+	if f.MaxLength > 0 && utf8.RuneCountInString(v) > f.MaxLength {
+		return fail(CodeMaxLength, "must be at most %d characters", f.MaxLength)
+	}
+	if f.Format == FormatEmail {
+		if addr, err := mail.ParseAddress(v); err != nil || addr.Address != v {
+			return fail(CodeFormat, "must be a valid email address")
+		}
+	}
+	if f.Pattern != nil && !f.Pattern.MatchString(v) {
+		return fail(CodePattern, "may only contain %s", f.PatternHint)
+	}
+	if len(f.OneOf) > 0 && !contains(f.OneOf, v) {
+		return fail(CodeOneOf, "must be one of %s", strings.Join(f.OneOf, ", "))
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
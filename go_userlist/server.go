@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go_userlist/repository"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultRequestTimeout bounds how long a request may wait on the repository when
+	// REQUEST_TIMEOUT is unset.
+	defaultRequestTimeout = 10 * time.Second
+	// defaultAllowedOrigin is the Angular development server.
+	defaultAllowedOrigin = "http://localhost:4200"
+)
+
+// server serves the users API. It only depends on repository.UserRepository and, for the
+// departments routes, repository.DepartmentRepository, so any backend or test double can stand
+// behind it.
+type server struct {
+	repo           repository.UserRepository
+	departments    repository.DepartmentRepository
+	requestTimeout time.Duration
+	allowedOrigins []string
+}
+
+// serverOption configures optional settings of a server.
+type serverOption func(*server)
+
+// withRequestTimeout bounds how long each request other than an export or import may wait on
+// the repository.
+func withRequestTimeout(timeout time.Duration) serverOption {
+	return func(s *server) {
+		s.requestTimeout = timeout
+	}
+}
+
+// withDepartments serves the /departments routes from departments; without it they are not
+// registered.
+func withDepartments(departments repository.DepartmentRepository) serverOption {
+	return func(s *server) {
+		s.departments = departments
+	}
+}
+
+// withAllowedOrigins sets the origins browsers may call the API from.
+func withAllowedOrigins(origins ...string) serverOption {
+	return func(s *server) {
+		s.allowedOrigins = origins
+	}
+}
+
+// newRouter returns a gin engine serving the users API from repo, with the CORS, correlation id,
+// problem+json and request deadline middleware installed. Exports and imports stream bodies of any
+// size, so they get no deadline and only stop early when the client goes away.
+func newRouter(repo repository.UserRepository, opts ...serverOption) *gin.Engine {
+	s := &server{
+		repo:           repo,
+		requestTimeout: defaultRequestTimeout,
+		allowedOrigins: []string{defaultAllowedOrigin},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	r := gin.Default()
+
+	// Enable CORS middleware
+	r.Use(cors.New(cors.Config{
+		AllowOrigins:     s.allowedOrigins,
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "If-Match", "If-None-Match", correlationIDHeader, actorHeader},
+		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "ETag", correlationIDHeader},
+		AllowCredentials: true,
+	}))
+	r.Use(correlationID())
+	r.Use(problemDetails())
+
+	// Define routes
+	transfers := r.Group("", requestContext(0))
+	transfers.GET("/users/export", s.exportUsersHandler)
+	transfers.POST("/users/import", s.importUsersHandler)
+
+	api := r.Group("", requestContext(s.requestTimeout))
+	api.GET("/users", s.getAllUsersHandler)
+	api.GET("/users/search", s.searchUsersHandler)
+	api.GET("/users/suggest", s.suggestUsersHandler)
+	api.GET("/users/:id", s.getUserHandler)
+	api.POST("/users", s.createUserHandler)
+	api.POST("/users/bulk", s.bulkUsersHandler)
+	api.PUT("/users/:id", s.updateUserHandler)
+	api.PATCH("/users/:id", s.patchUserHandler)
+	api.DELETE("/users/:id", s.deleteUserHandler)
+	api.POST("/users/:id/restore", s.restoreUserHandler)
+
+	if s.departments != nil {
+		api.GET("/departments", s.listDepartmentsHandler)
+		api.POST("/departments", s.createDepartmentHandler)
+		api.GET("/departments/:id", s.getDepartmentHandler)
+		api.PUT("/departments/:id", s.updateDepartmentHandler)
+		api.DELETE("/departments/:id", s.deleteDepartmentHandler)
+		api.GET("/departments/:id/users", s.departmentUsersHandler)
+	}
+	return r
+}
+
+const (
+	// correlationIDHeader carries the id that ties a request to the events it causes.
+	correlationIDHeader = "X-Correlation-ID"
+	// actorHeader names the user or system performing the request.
+	actorHeader = "X-Actor"
+)
+
+// correlationID reuses the caller's correlation id, or generates one, and echoes it in the response.
+func correlationID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(correlationIDHeader)
+		if id == "" {
+			id = repository.NewEventID()
+		}
+		c.Set(correlationIDHeader, id)
+		c.Header(correlationIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestTimeoutFromEnv returns the per-request timeout set in REQUEST_TIMEOUT (a Go duration
+// such as 5s), or defaultRequestTimeout when it is unset.
+func requestTimeoutFromEnv() (time.Duration, error) {
+	v := os.Getenv("REQUEST_TIMEOUT")
+	if v == "" {
+		return defaultRequestTimeout, nil
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid REQUEST_TIMEOUT %q: must be a positive duration", v)
+	}
+	return timeout, nil
+}
+
+// requestContext bounds the request's context by timeout, unless it is zero, and attaches the
+// caller and correlation id, so repository calls made with c.Request.Context() are cancelled when
+// the client goes away or the deadline passes, and stamp the request on the events they record.
+func requestContext(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		c.Request = c.Request.WithContext(repository.WithEventMetadata(ctx, eventMetadata(c)))
+		c.Next()
+	}
+}
+
+// etag returns the entity tag of a user or department at the given version.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersion returns the version named by the request's If-Match header, fallback when the
+// header is absent and repository.AnyVersion for "*".
+func ifMatchVersion(c *gin.Context, fallback int) (int, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	switch header {
+	case "":
+		return fallback, nil
+	case "*":
+		return repository.AnyVersion, nil
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, badRequest("invalid_if_match", fmt.Sprintf("invalid If-Match header %q", header))
+	}
+	version, err := strconv.Atoi(header[1 : len(header)-1])
+	if err != nil || version < 1 {
+		return 0, badRequest("invalid_if_match", fmt.Sprintf("invalid If-Match header %q", header))
+	}
+	return version, nil
+}
+
+// requiredVersion is ifMatchVersion for writes that must not overwrite blindly: a request with
+// neither an If-Match header nor a version in its body fails with 428. Clients that really mean
+// to overwrite send If-Match: *.
+func requiredVersion(c *gin.Context, bodyVersion int) (int, error) {
+	if strings.TrimSpace(c.GetHeader("If-Match")) == "" && bodyVersion == repository.AnyVersion {
+		return 0, &requestError{
+			status: http.StatusPreconditionRequired,
+			code:   "precondition_required",
+			detail: `send If-Match with the ETag of the last read, or If-Match: * to overwrite`,
+		}
+	}
+	return ifMatchVersion(c, bodyVersion)
+}
+
+// eventMetadata returns the actor and correlation id of the current request.
+func eventMetadata(c *gin.Context) repository.EventMetadata {
+	return repository.EventMetadata{
+		Actor:         c.GetHeader(actorHeader),
+		CorrelationID: c.GetString(correlationIDHeader),
+	}
+}
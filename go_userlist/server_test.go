@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"go_userlist/repository"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// stubRepository serves GetUserByID from a fixed user; any other method panics through the
+// nil embedded interface.
+type stubRepository struct {
+	repository.UserRepository
+	user     repository.User
+	deadline time.Time
+}
+
+// slowExportRepository exports its users one every delay, failing once the context is done.
+type slowExportRepository struct {
+	repository.UserRepository
+	users []repository.User
+	delay time.Duration
+}
+
+func (r *slowExportRepository) ExportUsers(ctx context.Context, opts repository.ListOptions, fn func(repository.User) error) error {
+	for _, user := range r.users {
+		time.Sleep(r.delay)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *stubRepository) GetUserByID(ctx context.Context, userID int) (*repository.User, error) {
+	r.deadline, _ = ctx.Deadline()
+	if userID != r.user.User_id {
+		return nil, repository.ErrUserNotFound
+	}
+	user := r.user
+	return &user, nil
+}
+
+var _ = Describe("newRouter", func() {
+	BeforeEach(func() {
+		gin.SetMode(gin.TestMode)
+	})
+
+	It("should serve users from any UserRepository with the configured request timeout", func() {
+		repo := &stubRepository{user: repository.User{User_id: 7, User_name: "jdoe", Version: 3}}
+		r := newRouter(repo, withRequestTimeout(time.Minute))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/7", nil))
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("ETag")).To(Equal(`"3"`))
+		Expect(repo.deadline).To(BeTemporally("~", time.Now().Add(time.Minute), 5*time.Second))
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/8", nil))
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+		Expect(w.Header().Get("Content-Type")).To(Equal(problemContentType))
+	})
+
+	It("should keep streaming an export after the request timeout has passed", func() {
+		repo := &slowExportRepository{
+			users: []repository.User{{User_id: 1, User_name: "jdoe"}, {User_id: 2, User_name: "asmith"}, {User_id: 3, User_name: "bwayne"}},
+			delay: 20 * time.Millisecond,
+		}
+		r := newRouter(repo, withRequestTimeout(10*time.Millisecond))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/export?format=ndjson", nil))
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(strings.Split(strings.TrimSpace(w.Body.String()), "\n")).To(HaveLen(3))
+		Expect(w.Body.String()).To(ContainSubstring("bwayne"))
+	})
+})
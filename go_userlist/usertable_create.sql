@@ -1,3 +1,12 @@
+-- Departments users belong to, see migrations/0006_departments.sql
+CREATE TABLE departments (
+    department_id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    description VARCHAR(1000) NOT NULL DEFAULT '',
+    version INTEGER NOT NULL DEFAULT 1
+);
+CREATE UNIQUE INDEX departments_lower_name_key ON departments (lower(name));
+
 CREATE TABLE users (
     user_id SERIAL PRIMARY KEY,
     user_name VARCHAR(50) NOT NULL,
@@ -5,6 +14,24 @@ CREATE TABLE users (
     last_name VARCHAR(255),
     email VARCHAR(255) NOT NULL,
     user_status VARCHAR(1),
-    department VARCHAR(255)
+    department VARCHAR(255) CONSTRAINT users_department_fkey REFERENCES departments (name) ON UPDATE CASCADE,
+    version INTEGER NOT NULL DEFAULT 1,
+    deleted_at TIMESTAMPTZ
 );
 
+-- Lets the purge job find expired soft deleted users without scanning live ones
+CREATE INDEX users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- user_name and email are unique regardless of case. Soft deleted users keep theirs until
+-- they are purged, so a restore can never collide.
+CREATE UNIQUE INDEX users_user_name_key ON users (lower(user_name));
+CREATE UNIQUE INDEX users_email_key ON users (lower(email));
+
+-- Full-text and fuzzy search over the searchable fields, see migrations/0004_user_search.sql
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX users_search_fts_idx ON users USING gin (to_tsvector('simple', coalesce(user_name, '') || ' ' || coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' || coalesce(email, '') || ' ' || coalesce(department, '')));
+CREATE INDEX users_search_trgm_idx ON users USING gin ((coalesce(user_name, '') || ' ' || coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' || coalesce(email, '') || ' ' || coalesce(department, '')) gin_trgm_ops);
+
+-- Prefix lookups for typeahead suggestions, see migrations/0005_suggest_indexes.sql
+CREATE INDEX users_department_prefix_idx ON users (lower(department) text_pattern_ops) WHERE deleted_at IS NULL;
+CREATE INDEX users_user_name_prefix_idx ON users (lower(user_name) text_pattern_ops) WHERE deleted_at IS NULL;
@@ -0,0 +1,91 @@
+package xlsx_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"go_userlist/xlsx"
+	"io"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// sheet is the part of a worksheet the specs read back.
+type sheet struct {
+	Rows []struct {
+		R     string `xml:"r,attr"`
+		Cells []struct {
+			R      string `xml:"r,attr"`
+			T      string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readPart returns the contents of the named part of the workbook in data.
+func readPart(data []byte, name string) string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	f, err := zr.Open(name)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	defer f.Close()
+	body, err := io.ReadAll(f)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return string(body)
+}
+
+var _ = Describe("Writer", func() {
+	It("should write a workbook with text and number cells", func() {
+		var buf bytes.Buffer
+		w, err := xlsx.NewWriter(&buf, "Users & Co")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.WriteRow("user_id", "user_name", "note")).To(Succeed())
+		Expect(w.WriteRow(7, "jdoe01", " <b>&\x00 ")).To(Succeed())
+		Expect(w.WriteRow(int64(8), nil, 1.5)).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+
+		Expect(readPart(buf.Bytes(), "[Content_Types].xml")).To(ContainSubstring(`PartName="/xl/worksheets/sheet1.xml"`))
+		Expect(readPart(buf.Bytes(), "xl/workbook.xml")).To(ContainSubstring(`<sheet name="Users &amp; Co"`))
+
+		var s sheet
+		Expect(xml.Unmarshal([]byte(readPart(buf.Bytes(), "xl/worksheets/sheet1.xml")), &s)).To(Succeed())
+		Expect(s.Rows).To(HaveLen(3))
+		Expect(s.Rows[0].Cells[2].R).To(Equal("C1"))
+		Expect(s.Rows[0].Cells[2].Inline).To(Equal("note"))
+
+		Expect(s.Rows[1].Cells[0].Value).To(Equal("7"))
+		Expect(s.Rows[1].Cells[0].T).To(BeEmpty())
+		Expect(s.Rows[1].Cells[2].T).To(Equal("inlineStr"))
+		Expect(s.Rows[1].Cells[2].Inline).To(Equal(" <b>&� "))
+
+		Expect(s.Rows[2].Cells).To(HaveLen(2))
+		Expect(s.Rows[2].Cells[1].R).To(Equal("C3"))
+		Expect(s.Rows[2].Cells[1].Value).To(Equal("1.5"))
+	})
+
+	It("should name columns past Z with two letters", func() {
+		var buf bytes.Buffer
+		w, err := xlsx.NewWriter(&buf, "Sheet1")
+		Expect(err).NotTo(HaveOccurred())
+		cells := make([]interface{}, 28)
+		for i := range cells {
+			cells[i] = i
+		}
+		Expect(w.WriteRow(cells...)).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+
+		var s sheet
+		Expect(xml.Unmarshal([]byte(readPart(buf.Bytes(), "xl/worksheets/sheet1.xml")), &s)).To(Succeed())
+		Expect(s.Rows[0].Cells[25].R).To(Equal("Z1"))
+		Expect(s.Rows[0].Cells[26].R).To(Equal("AA1"))
+		Expect(s.Rows[0].Cells[27].R).To(Equal("AB1"))
+	})
+})
+
+func TestXLSX(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "XLSX Suite")
+}